@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/starling-protocol/starling/device"
+	"github.com/starling-protocol/starling/network_layer"
 	"github.com/starling-protocol/starling/sync"
 	"github.com/starling-protocol/starling/transport_layer"
 )
@@ -96,9 +97,37 @@ func (app *ApplicationLayer) OnDisconnection(address device.DeviceAddress) {
 	app.transportLayer.OnDisconnection(address)
 }
 
-func (app *ApplicationLayer) SendMessage(session device.SessionID, message []byte) (device.MessageID, error) {
+func (app *ApplicationLayer) SendMessage(session device.SessionID, message []byte, options *device.SendOptions) (device.MessageID, error) {
+	if options == nil {
+		options = device.DefaultSendOptions()
+	}
+
 	data := append([]byte{0x01}, message...) // 0x01 user data extension
-	return app.transportLayer.SendMessage(session, data)
+	return app.transportLayer.SendMessageWithOptions(session, data, options)
+}
+
+func (app *ApplicationLayer) OpenStream(session device.SessionID) (*transport_layer.Stream, error) {
+	return app.transportLayer.OpenStream(session)
+}
+
+func (app *ApplicationLayer) CancelMessage(messageID device.MessageID) error {
+	return app.transportLayer.CancelMessage(messageID)
+}
+
+func (app *ApplicationLayer) SessionMetrics(session device.SessionID) (*device.SessionMetrics, error) {
+	return app.transportLayer.SessionMetrics(session)
+}
+
+func (app *ApplicationLayer) AllSessionMetrics() []device.SessionMetrics {
+	return app.transportLayer.AllSessionMetrics()
+}
+
+func (app *ApplicationLayer) AddPolicy(policy network_layer.Policy) {
+	app.transportLayer.AddPolicy(policy)
+}
+
+func (app *ApplicationLayer) RemovePolicy(policy network_layer.Policy) {
+	app.transportLayer.RemovePolicy(policy)
 }
 
 func (app *ApplicationLayer) BroadcastRouteRequest() {
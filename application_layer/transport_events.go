@@ -2,6 +2,7 @@ package application_layer
 
 import (
 	"github.com/starling-protocol/starling/device"
+	"github.com/starling-protocol/starling/transport_layer"
 )
 
 type transportEvents struct {
@@ -80,3 +81,37 @@ func (t *transportEvents) MessageDelivered(messageID device.MessageID) {
 		t.app.dev.MessageDelivered(messageID)
 	}
 }
+
+// MessageProgress implements transport_layer.TransportEvents.
+func (t *transportEvents) MessageProgress(messageID device.MessageID, sent int, total int) {
+	if _, found := t.app.pendingSyncPushPackets[messageID]; found {
+		return
+	}
+
+	t.app.logf("progress_packet:device:%d:%d:%d", messageID, sent, total)
+	t.app.dev.MessageProgress(messageID, sent, total)
+}
+
+// StreamOpened implements transport_layer.TransportEvents.
+func (t *transportEvents) StreamOpened(session device.SessionID, stream *transport_layer.Stream) {
+	t.app.logf("stream_opened:%d:%d", session, stream.ID())
+	t.app.dev.StreamOpened(session, stream)
+}
+
+// StreamReady implements transport_layer.TransportEvents.
+func (t *transportEvents) StreamReady(session device.SessionID, stream *transport_layer.Stream) {
+	t.app.logf("stream_ready:%d:%d", session, stream.ID())
+	t.app.dev.StreamReady(session, stream)
+}
+
+// MessageFailed implements transport_layer.TransportEvents.
+func (t *transportEvents) MessageFailed(messageID device.MessageID) {
+	if _, found := t.app.pendingSyncPushPackets[messageID]; found {
+		t.app.logf("failed_packet:sync:%d", messageID)
+		delete(t.app.pendingSyncPushPackets, messageID)
+		return
+	}
+
+	t.app.logf("failed_packet:device:%d", messageID)
+	t.app.dev.MessageFailed(messageID)
+}
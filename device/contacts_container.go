@@ -1,6 +1,7 @@
 package device
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/rand"
 	"crypto/sha256"
@@ -38,6 +39,7 @@ func (secret SharedSecret) toContactID() (ContactID, error) {
 	return ContactID(base64.StdEncoding.EncodeToString(hash[:])), nil
 }
 
+// MemoryContactsContainer keeps its own copy of every secret, which is wiped when the contact is deleted.
 type MemoryContactsContainer struct {
 	links  map[ContactID]SharedSecret
 	groups map[ContactID]SharedSecret
@@ -63,6 +65,8 @@ func (c *MemoryContactsContainer) ContactSecret(contact ContactID) (SharedSecret
 }
 
 func (c *MemoryContactsContainer) DeleteContact(contact ContactID) {
+	clear(c.links[contact])
+	clear(c.groups[contact])
 	delete(c.links, contact)
 	delete(c.groups, contact)
 }
@@ -105,7 +109,7 @@ func (c *MemoryContactsContainer) JoinGroup(groupSecret SharedSecret) (ContactID
 		return "", fmt.Errorf("group already joined '%v'", contactID)
 	}
 
-	c.groups[contactID] = groupSecret
+	c.groups[contactID] = bytes.Clone(groupSecret)
 	return contactID, nil
 }
 
@@ -115,7 +119,7 @@ func (c *MemoryContactsContainer) NewLink(linkSecret SharedSecret) (ContactID, e
 		return "", fmt.Errorf("failed to generate contact id: '%w'", err)
 	}
 
-	c.links[contactID] = linkSecret
+	c.links[contactID] = bytes.Clone(linkSecret)
 	return contactID, nil
 }
 
@@ -125,6 +129,6 @@ func (c *MemoryContactsContainer) DebugLink(sharedSecret SharedSecret) ContactID
 		panic(fmt.Sprintf("failed to debug link: %v", err))
 	}
 
-	c.links[contactID] = sharedSecret
+	c.links[contactID] = bytes.Clone(sharedSecret)
 	return contactID
 }
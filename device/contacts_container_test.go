@@ -0,0 +1,45 @@
+package device_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/starling-protocol/starling/device"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryContactsContainerDeleteWipesSecrets(t *testing.T) {
+	random := rand.New(rand.NewSource(1234))
+
+	linkSecret := make([]byte, 32)
+	random.Read(linkSecret)
+	groupSecret := make([]byte, 32)
+	random.Read(groupSecret)
+
+	container := device.NewMemoryContactsContainer()
+	link, err := container.NewLink(bytes.Clone(linkSecret))
+	assert.NoError(t, err)
+	group, err := container.JoinGroup(bytes.Clone(groupSecret))
+	assert.NoError(t, err)
+
+	// The container hands out its own copies of the secrets, which are cleared when the contact is deleted
+	for _, contact := range []device.ContactID{link, group} {
+		secret, err := container.ContactSecret(contact)
+		assert.NoError(t, err)
+		assert.NotEqual(t, make([]byte, 32), []byte(secret))
+
+		container.DeleteContact(contact)
+		assert.Equal(t, make([]byte, 32), []byte(secret))
+
+		_, err = container.ContactSecret(contact)
+		assert.Error(t, err)
+	}
+	assert.Empty(t, container.AllLinks())
+	assert.Empty(t, container.AllGroups())
+
+	// The secrets passed in by the caller are left alone
+	assert.NotEqual(t, make([]byte, 32), linkSecret)
+	assert.NotEqual(t, make([]byte, 32), groupSecret)
+}
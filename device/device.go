@@ -24,6 +24,19 @@ type MessageID uint64
 // A SessionID is used to identify a network layer session
 type SessionID uint64
 
+// A Stream is an ordered byte stream multiplexed over a session.
+// Like the rest of the protocol it never blocks, so it is not an io.Reader or io.Writer.
+type Stream interface {
+	// TryRead reads the data which is available on the stream. It fails when there is none,
+	// and returns io.EOF once the peer has closed the stream and all data has been read.
+	TryRead(p []byte) (int, error)
+	// TryWrite queues as much of the data as the peer can receive, and returns the number of bytes queued.
+	// It fails if not all of the data was queued, and StreamReady is called once more can be written.
+	TryWrite(p []byte) (int, error)
+	// Close ends the writing side of the stream.
+	Close() error
+}
+
 type ProtocolOptions struct {
 	// EnableSync determines whether the sync extension is enabled.
 	EnableSync bool
@@ -39,12 +52,160 @@ type ProtocolOptions struct {
 	ACKDelay time.Duration
 	// ACKTimeout
 	ACKTimeout time.Duration
+	// Messages larger than MaxFragmentSize bytes are split into fragments that are acknowledged independently.
+	// Fragmentation is disabled when it is zero.
+	MaxFragmentSize int
+	// SendWindow is the maximum number of DATA packets awaiting an ACK per session.
+	// Further messages are queued until earlier ones are acknowledged, the window is unlimited when it is zero.
+	SendWindow int
+	// StreamWindow is the maximum number of chunks of a single stream awaiting an ACK,
+	// such that one stream cannot occupy the whole send window. The window is unlimited when it is zero.
+	StreamWindow int
+	// StreamReceiveWindow is the maximum number of chunks of a single stream which are buffered until the application
+	// reads them. The window is announced to the peer, which does not write more. The window is unlimited when it is zero.
+	StreamReceiveWindow int
+	// MaxConcurrentStreams is the maximum number of streams each side of a session may have open at once,
+	// which bounds the buffers a peer can make this device allocate. Streams opened by the peer beyond
+	// the limit are reset, so both sides should use the same limit. It must be positive.
+	MaxConcurrentStreams int
+	// HeartbeatInterval is how often an idle session is probed with an end-to-end heartbeat.
+	// Shorter intervals detect broken routes sooner at the cost of battery. Heartbeats are disabled when it is zero.
+	HeartbeatInterval time.Duration
+	// MaxMissedHeartbeats is the number of unanswered heartbeats in a row after which the session is broken.
+	MaxMissedHeartbeats int
+	// RekeyAfterMessages is the number of SESS packets encrypted with a session key before it is ratcheted forward.
+	// Rekeying after a number of packets is disabled when it is zero.
+	RekeyAfterMessages int
+	// RekeyInterval is how long a session key is used for sending before it is ratcheted forward.
+	// Old keys are erased, so a compromised key does not reveal earlier traffic. Rekeying over time is disabled when it is zero.
+	RekeyInterval time.Duration
+	// PaddingBuckets are the sizes in bytes, in ascending order, which the encrypted payloads of RREP and SESS packets
+	// are padded up to, such that an observer cannot tell ACKs, chat messages and sync pushes apart by their length.
+	// Payloads larger than the largest bucket are padded to a multiple of it.
+	// Payloads above the smallest bucket grow by less than the ratio between neighbouring buckets, e.g. buckets of
+	// 64, 256 and 1024 bytes at most quadruple them, while a 10 byte ACK is padded with 54 bytes.
+	// Only a single byte marking the end of the payload is added when there are no buckets.
+	// Sessions with nodes which only support the original key derivation are never padded.
+	PaddingBuckets []int
+	// CoverTrafficInterval is the average time between dummy route requests and SESS packets,
+	// which hide when the user is actually communicating. The actual delays are randomized.
+	// Cover traffic is disabled when it is zero.
+	CoverTrafficInterval time.Duration
+	// CoverTrafficBudget is the maximum number of cover packets sent per hour.
+	CoverTrafficBudget int
+	// HybridKeyExchange adds an ML-KEM-768 key exchange to route setup, on top of X25519, such that recorded
+	// traffic cannot be decrypted later by an attacker with a quantum computer. It is used for a session when
+	// the initiator enables it and the responder supports it, otherwise the classic key exchange is used.
+	// Route requests grow by about 1200 bytes and route replies by about 1100 bytes.
+	HybridKeyExchange bool
+	// RequireHybridKeyExchange only accepts sessions using the hybrid key exchange, such that no session falls
+	// back to the classic key exchange. Route requests and replies without ML-KEM are dropped, which excludes
+	// older nodes. It implies HybridKeyExchange.
+	RequireHybridKeyExchange bool
+	// AllowLegacyKeyDerivation replies to route requests from nodes which only support the original key derivation,
+	// where a single session secret is used in both directions and is not bound to the route setup. Such sessions keep
+	// the original packet format: the session has the same ID on every link, SESS packets have random nonces
+	// without replay protection, and they are neither padded nor rekeyed. Route replies are only accepted with the
+	// key derivation offered by this node, such that its own requests cannot be downgraded.
+	// It should be disabled once all nodes have been upgraded.
+	AllowLegacyKeyDerivation bool
+	// CipherSuite is the preferred cipher suite of this device. XChaCha20-Poly1305 is used for a session
+	// if either contact prefers it, otherwise AES-GCM is used. Older nodes only support AES-GCM.
+	CipherSuite CipherSuite
+	// RREQStampDifficulty is the number of leading zero bits of the proof-of-work stamp required on route requests,
+	// which makes flooding the network with route requests expensive. Sending a request takes about 2^difficulty hashes.
+	// Unstamped route requests are dropped, so all nodes in a network must use the same difficulty.
+	// Stamps are disabled when it is zero, and the difficulty can be at most 16.
+	RREQStampDifficulty int
+	// RREQStampLoadThreshold is the number of route requests received per minute above which this node only
+	// forwards route requests with a higher difficulty, by one bit and another for each doubling of the rate.
+	// Requests of a lower difficulty are still answered, and this node sends its own requests with the higher
+	// difficulty, up to 16 bits. The difficulty is fixed when it is zero.
+	RREQStampLoadThreshold int
+	// ReputationThreshold is the misbehaviour score above which a neighbour is quarantined. Neighbours score
+	// for packets that cannot be decoded, repeated route requests, invalid stamps and forged route errors.
+	// Scores halve every 10 minutes.
+	// Route requests from a quarantined neighbour are ignored, no sessions are relayed through it,
+	// and Device.PeerQuarantined is called such that it can be disconnected. Quarantine is disabled when it is zero.
+	ReputationThreshold int
+	// QuarantineDuration is how long a neighbour stays quarantined once its score exceeds ReputationThreshold.
+	QuarantineDuration time.Duration
+	// LeafOnly stops the device from relaying for others, such that it only sends and receives its own traffic,
+	// e.g. to save battery. Route requests are not forwarded, and route replies and SESS packets of other sessions
+	// are dropped. Neighbours are told when connecting and in the route requests sent by the device,
+	// and stop counting it as a relay.
+	LeafOnly bool
+	// RelaySessionRate is the number of bytes per second forwarded for each session relayed by this device.
+	// Packets above the rate are queued, such that one heavy session crossing the device cannot hog its links.
+	// Relayed sessions are not limited individually when it is zero.
+	RelaySessionRate int
+	// RelayBandwidth is the number of bytes per second forwarded for all relayed sessions together,
+	// which is shared fairly between them. The device's own sessions are not limited by it.
+	// The total is not limited when it is zero.
+	RelayBandwidth int
+	// RelayQueueSize is the number of packets queued for a relayed session which is over its limits,
+	// after which further packets are dropped. Packets over the limits are dropped right away when it is zero.
+	RelayQueueSize int
+	// EphemeralKeyLifetime is how long the ephemeral keys of a route request are kept while waiting for replies,
+	// after which replies to it are ignored. The keys of a request to links are discarded as soon as every link
+	// has replied, while those of a request to a group are kept for the full lifetime, since any member may reply.
+	EphemeralKeyLifetime time.Duration
 
 	// Proposed:
 	// * RREQ throttling
 	// * Different priorities when encoding bitmap for route requests
 }
 
+// SendOptions control how a single message is delivered on a session.
+type SendOptions struct {
+	// Unreliable sends the message as a datagram which is neither acknowledged nor retransmitted.
+	// Datagrams are delivered as soon as they arrive, possibly out of order, and are useful
+	// for messages where only the latest value matters such as location updates.
+	// No MessageDelivered event is given for unreliable messages.
+	Unreliable bool
+	// Priority determines the order in which queued messages are sent, higher priorities are sent first.
+	Priority MessagePriority
+	// Expiry is the time after which the message is no longer worth delivering.
+	// An expired message is not transmitted or retransmitted any more, and MessageFailed is called for it.
+	// The message never expires when Expiry is the zero time.
+	Expiry time.Time
+}
+
+type MessagePriority int
+
+const (
+	PriorityLow    MessagePriority = -1
+	PriorityNormal MessagePriority = 0
+	PriorityHigh   MessagePriority = 1
+)
+
+func DefaultSendOptions() *SendOptions {
+	return &SendOptions{
+		Unreliable: false,
+		Priority:   PriorityNormal,
+		Expiry:     time.Time{},
+	}
+}
+
+// SessionMetrics describes the state of the transport on a single session,
+// and can be used to show the connection quality or to diagnose slow routes.
+type SessionMetrics struct {
+	Session SessionID
+	Contact ContactID
+	// RTT is the smoothed round trip time from sending a packet until it is acknowledged.
+	// It is zero until the first acknowledgement has been received.
+	RTT time.Duration
+	// Retransmissions is the number of DATA packets that have been sent again.
+	Retransmissions int
+	// BytesSent and BytesReceived count the encoded transport packets of the session.
+	BytesSent     int
+	BytesReceived int
+	// UnackedMessages is the number of DATA packets that are sent or queued but not yet acknowledged.
+	UnackedMessages int
+	// UnackedAge is the time since the oldest unacknowledged DATA packet was sent.
+	UnackedAge time.Duration
+}
+
 type BroadcastStrategy int
 
 const (
@@ -57,6 +218,17 @@ const (
 	BroadcastTwo
 )
 
+// A CipherSuite is the AEAD used to encrypt the RREP and SESS packets of a session.
+type CipherSuite byte
+
+const (
+	// AES-256-GCM, which is fast on devices with AES instructions.
+	CipherSuiteAESGCM CipherSuite = iota + 1
+	// XChaCha20-Poly1305, which is fast and constant-time in software,
+	// and is preferable on devices without AES instructions.
+	CipherSuiteXChaCha20Poly1305
+)
+
 func DefaultProtocolOptions() *ProtocolOptions {
 	return &ProtocolOptions{
 		EnableSync:                  false,
@@ -66,6 +238,31 @@ func DefaultProtocolOptions() *ProtocolOptions {
 		ForwardRREQsWhenMatching:    false,
 		ACKDelay:                    1 * time.Second,
 		ACKTimeout:                  3 * time.Second,
+		MaxFragmentSize:             0,
+		SendWindow:                  0,
+		StreamWindow:                8,
+		StreamReceiveWindow:         64,
+		MaxConcurrentStreams:        32,
+		HeartbeatInterval:           0,
+		MaxMissedHeartbeats:         3,
+		RekeyAfterMessages:          1 << 16,
+		RekeyInterval:               10 * time.Minute,
+		PaddingBuckets:              nil,
+		CoverTrafficInterval:        0,
+		CoverTrafficBudget:          120,
+		HybridKeyExchange:           false,
+		RequireHybridKeyExchange:    false,
+		AllowLegacyKeyDerivation:    true,
+		CipherSuite:                 CipherSuiteAESGCM,
+		RREQStampDifficulty:         0,
+		RREQStampLoadThreshold:      0,
+		ReputationThreshold:         0,
+		QuarantineDuration:          1 * time.Hour,
+		LeafOnly:                    false,
+		RelaySessionRate:            0,
+		RelayBandwidth:              0,
+		RelayQueueSize:              16,
+		EphemeralKeyLifetime:        1 * time.Minute,
 	}
 }
 
@@ -83,6 +280,11 @@ type Device interface {
 	SendPacket(address DeviceAddress, packet []byte)
 	// MessageDelivered is called when a message has been confirmed to have been received.
 	MessageDelivered(messageID MessageID)
+	// MessageProgress is called when a fragment of a large message has been confirmed to have been received.
+	// The sent and total arguments are in bytes.
+	MessageProgress(messageID MessageID, sent int, total int)
+	// MessageFailed is called when a message will not be delivered, because it expired before it was acknowledged.
+	MessageFailed(messageID MessageID)
 	// MaxPacketSize returns the max packet size for some peer given by its address.
 	MaxPacketSize(address DeviceAddress) (int, error)
 	// ProcessMessage is called when packet(s) from a peer have been decoded to a message
@@ -95,10 +297,18 @@ type Device interface {
 	// SessionBroken is called when a previously established session has been broken
 	// and is no longer available
 	SessionBroken(session SessionID)
+	// StreamOpened is called when the peer of a session has opened a new stream.
+	StreamOpened(session SessionID, stream Stream)
+	// StreamReady is called when data can be read from a stream, or when the peer has opened its receive window
+	// such that more data can be written to it.
+	StreamReady(session SessionID, stream Stream)
 	// SyncStateChanged is called whenever the synchronization state changes for a given contact.
 	// The state is encoded as JSON.
 	// This event is only called when the sync option is turned on.
 	SyncStateChanged(contact ContactID, stateUpdate []byte)
+	// PeerQuarantined is called when a neighbour has been quarantined because of misbehaviour,
+	// such that the host can disconnect it and avoid reconnecting to it for a while.
+	PeerQuarantined(address DeviceAddress)
 	// Rand is used for generating all random values, a default is used when nil is returned
 	Rand() *rand.Rand
 	// CryptoRand should produce cryptographically secure random bytes in production
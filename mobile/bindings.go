@@ -1,6 +1,8 @@
 package mobile
 
 import (
+	"time"
+
 	"github.com/starling-protocol/starling"
 	"github.com/starling-protocol/starling/contacts"
 	"github.com/starling-protocol/starling/device"
@@ -18,6 +20,90 @@ func (p *ProtocolOptions) bindings() *device.ProtocolOptions {
 	return device.DefaultSyncProtocolOptions()
 }
 
+type SendOptions struct {
+	Unreliable bool
+	// Priority is one of -1 (low), 0 (normal) or 1 (high).
+	Priority int
+	// ExpiryUnixMilli is the expiry of the message in milliseconds since the Unix epoch, zero means no expiry.
+	ExpiryUnixMilli int64
+}
+
+func (o *SendOptions) bindings() *device.SendOptions {
+	if o == nil {
+		return nil
+	}
+
+	options := device.DefaultSendOptions()
+	options.Unreliable = o.Unreliable
+	options.Priority = device.MessagePriority(o.Priority)
+	if o.ExpiryUnixMilli != 0 {
+		options.Expiry = time.UnixMilli(o.ExpiryUnixMilli)
+	}
+	return options
+}
+
+// Stream wraps a device.Stream, since byte slices passed to the bindings are copied.
+type Stream struct {
+	stream device.Stream
+}
+
+// Read returns at most maxBytes bytes of the data available on the stream.
+// It fails when there is none, and StreamReady is called once data arrives.
+func (s *Stream) Read(maxBytes int) ([]byte, error) {
+	buf := make([]byte, maxBytes)
+	n, err := s.stream.TryRead(buf)
+	return buf[:n], err
+}
+
+func (s *Stream) Write(data []byte) (int, error) {
+	return s.stream.TryWrite(data)
+}
+
+func (s *Stream) Close() error {
+	return s.stream.Close()
+}
+
+// SessionMetrics describes the transport state of a session, durations are in milliseconds.
+type SessionMetrics struct {
+	Session         int64
+	Contact         string
+	RTTMilli        int64
+	Retransmissions int
+	BytesSent       int
+	BytesReceived   int
+	UnackedMessages int
+	UnackedAgeMilli int64
+}
+
+func newSessionMetrics(metrics *device.SessionMetrics) *SessionMetrics {
+	return &SessionMetrics{
+		Session:         int64(metrics.Session),
+		Contact:         string(metrics.Contact),
+		RTTMilli:        metrics.RTT.Milliseconds(),
+		Retransmissions: metrics.Retransmissions,
+		BytesSent:       metrics.BytesSent,
+		BytesReceived:   metrics.BytesReceived,
+		UnackedMessages: metrics.UnackedMessages,
+		UnackedAgeMilli: metrics.UnackedAge.Milliseconds(),
+	}
+}
+
+// SessionMetricsList wraps a list of session metrics, since slices of structs cannot be passed to the bindings.
+type SessionMetricsList struct {
+	metrics []device.SessionMetrics
+}
+
+func (l *SessionMetricsList) Len() int {
+	return len(l.metrics)
+}
+
+func (l *SessionMetricsList) Get(index int) *SessionMetrics {
+	if index < 0 || index >= len(l.metrics) {
+		return nil
+	}
+	return newSessionMetrics(&l.metrics[index])
+}
+
 type Protocol struct {
 	proto *starling.Protocol
 }
@@ -49,6 +135,35 @@ func (p *Protocol) SendMessage(session int64, message []byte) (int64, error) {
 	return int64(msgID), err
 }
 
+func (p *Protocol) SendMessageWithOptions(session int64, message []byte, options *SendOptions) (int64, error) {
+	msgID, err := p.proto.SendMessageWithOptions(device.SessionID(session), message, options.bindings())
+	return int64(msgID), err
+}
+
+func (p *Protocol) OpenStream(session int64) (*Stream, error) {
+	stream, err := p.proto.OpenStream(device.SessionID(session))
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{stream: stream}, nil
+}
+
+func (p *Protocol) CancelMessage(messageID int64) error {
+	return p.proto.CancelMessage(device.MessageID(messageID))
+}
+
+func (p *Protocol) SessionMetrics(session int64) (*SessionMetrics, error) {
+	metrics, err := p.proto.SessionMetrics(device.SessionID(session))
+	if err != nil {
+		return nil, err
+	}
+	return newSessionMetrics(metrics), nil
+}
+
+func (p *Protocol) AllSessionMetrics() *SessionMetricsList {
+	return &SessionMetricsList{metrics: p.proto.AllSessionMetrics()}
+}
+
 func (p *Protocol) NewGroup() (string, error) {
 	contact, err := p.proto.NewGroup()
 	return string(contact), err
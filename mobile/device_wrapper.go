@@ -19,7 +19,12 @@ type Device interface {
 	SessionEstablished(session int64, contact string, address string)
 	SessionBroken(session int64)
 	MessageDelivered(messageID int64)
+	MessageProgress(messageID int64, sent int, total int)
+	MessageFailed(messageID int64)
+	StreamOpened(session int64, stream *Stream)
+	StreamReady(session int64, stream *Stream)
 	SyncStateChanged(contact string, stateUpdate []byte)
+	PeerQuarantined(address string)
 }
 
 type deviceWrapper struct {
@@ -71,6 +76,11 @@ func (d *deviceWrapper) SyncStateChanged(contact device.ContactID, stateUpdate [
 	d.dev.SyncStateChanged(string(contact), stateUpdate)
 }
 
+// PeerQuarantined implements device.Device.
+func (d *deviceWrapper) PeerQuarantined(address device.DeviceAddress) {
+	d.dev.PeerQuarantined(string(address))
+}
+
 // Rand implements device.Device.
 func (d *deviceWrapper) Rand() *rand.Rand {
 	if d.random == nil {
@@ -101,6 +111,26 @@ func (d *deviceWrapper) MessageDelivered(messageID device.MessageID) {
 	d.dev.MessageDelivered(int64(messageID))
 }
 
+// MessageProgress implements device.Device.
+func (d *deviceWrapper) MessageProgress(messageID device.MessageID, sent int, total int) {
+	d.dev.MessageProgress(int64(messageID), sent, total)
+}
+
+// StreamOpened implements device.Device.
+func (d *deviceWrapper) StreamOpened(session device.SessionID, stream device.Stream) {
+	d.dev.StreamOpened(int64(session), &Stream{stream: stream})
+}
+
+// StreamReady implements device.Device.
+func (d *deviceWrapper) StreamReady(session device.SessionID, stream device.Stream) {
+	d.dev.StreamReady(int64(session), &Stream{stream: stream})
+}
+
+// MessageFailed implements device.Device.
+func (d *deviceWrapper) MessageFailed(messageID device.MessageID) {
+	d.dev.MessageFailed(int64(messageID))
+}
+
 // Delay implements device.Device.
 func (*deviceWrapper) Delay(action func(), duration time.Duration) {
 	go func() {
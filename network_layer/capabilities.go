@@ -0,0 +1,76 @@
+package network_layer
+
+import (
+	"fmt"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// Capabilities are flags which a node announces to its neighbours when connecting and in the route requests it sends.
+// They describe the node itself rather than the request, so every node replaces them with its own before
+// forwarding a route request. Nodes without the extension leave them out, and are assumed to have none.
+type Capabilities byte
+
+const (
+	// CapabilityLeafOnly is announced by nodes which do not relay for others, see ProtocolOptions.LeafOnly.
+	// Neighbours still send route requests to them, since they may be the destination,
+	// but do not count them as relays when picking which neighbours to forward route requests to.
+	CapabilityLeafOnly Capabilities = 1 << 0
+)
+
+// capabilities returns the capabilities of this node.
+func (network *NetworkLayer) capabilities() Capabilities {
+	var capabilities Capabilities
+	if network.options.LeafOnly {
+		capabilities |= CapabilityLeafOnly
+	}
+	return capabilities
+}
+
+// CAPSPacket announces the capabilities of a node to a new neighbour. It is needed since a node
+// which does not relay may never send a route request of its own. Older nodes ignore the packet type.
+type CAPSPacket struct {
+	Capabilities Capabilities
+}
+
+func NewCAPS(capabilities Capabilities) *CAPSPacket {
+	return &CAPSPacket{
+		Capabilities: capabilities,
+	}
+}
+
+func (p *CAPSPacket) PacketType() PacketType {
+	return CAPS
+}
+
+func (p *CAPSPacket) EncodePacket() []byte {
+	return []byte{byte(CAPS), byte(p.Capabilities)}
+}
+
+func DecodeCAPS(buf []byte) (*CAPSPacket, error) {
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("buffer too small when decoding CAPS: %d", len(buf))
+	}
+
+	if buf[0] != byte(CAPS) {
+		return nil, fmt.Errorf("wrong packet header when decoding CAPS packet: %d", buf[0])
+	}
+
+	return NewCAPS(Capabilities(buf[1])), nil
+}
+
+// announceCapabilities sends the capabilities of this node to a new neighbour, unless it has none.
+func (network *NetworkLayer) announceCapabilities(neighbour device.DeviceAddress) {
+	capabilities := network.capabilities()
+	if capabilities == 0 {
+		return
+	}
+
+	network.logf("packet:caps:send:%s", neighbour)
+	network.packetLayer.SendBytes(neighbour, NewCAPS(capabilities).EncodePacket())
+}
+
+// updateNeighbourCapabilities records the capabilities announced by a neighbour in a CAPS packet or a route request.
+func (network *NetworkLayer) updateNeighbourCapabilities(neighbour device.DeviceAddress, capabilities Capabilities) {
+	network.packetLayer.SetLeafOnly(neighbour, capabilities&CapabilityLeafOnly != 0)
+}
@@ -0,0 +1,74 @@
+package network_layer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/starling-protocol/starling/device"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The initiator announces its preferred cipher suite in the RREQ, and the responder announces the
+// chosen one in the RREP. Older nodes announce nothing and only support AES-GCM.
+//
+// The nonces on the wire are 12 bytes for every suite. They are already unique, since SESS nonces are
+// counters and every RREP is encrypted under a fresh key, so the XChaCha20-Poly1305 nonce is the
+// nonce padded with zeros.
+
+// negotiateCipherSuite returns the cipher suite of a session, given the suite announced by the initiator.
+func negotiateCipherSuite(offered device.CipherSuite, preferred device.CipherSuite) device.CipherSuite {
+	if offered == 0 {
+		return device.CipherSuiteAESGCM
+	}
+	if offered == device.CipherSuiteXChaCha20Poly1305 || preferred == device.CipherSuiteXChaCha20Poly1305 {
+		return device.CipherSuiteXChaCha20Poly1305
+	}
+	return device.CipherSuiteAESGCM
+}
+
+// sessionAEAD is an AEAD of a cipher suite, which takes the 12 byte nonces of the packets.
+type sessionAEAD struct {
+	aead cipher.AEAD
+}
+
+func newSessionAEAD(suite device.CipherSuite, key []byte) (*sessionAEAD, error) {
+	var aead cipher.AEAD
+	var err error
+
+	switch suite {
+	case device.CipherSuiteAESGCM:
+		var block cipher.Block
+		block, err = aes.NewCipher(key)
+		if err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	case device.CipherSuiteXChaCha20Poly1305:
+		aead, err = chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("unknown cipher suite: %d", suite)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionAEAD{aead: aead}, nil
+}
+
+func (s *sessionAEAD) nonce(nonce []byte) []byte {
+	if s.aead.NonceSize() == len(nonce) {
+		return nonce
+	}
+	extended := make([]byte, s.aead.NonceSize())
+	copy(extended, nonce)
+	return extended
+}
+
+func (s *sessionAEAD) Seal(nonce []byte, plaintext []byte, additionalData []byte) []byte {
+	return s.aead.Seal(nil, s.nonce(nonce), plaintext, additionalData)
+}
+
+func (s *sessionAEAD) Open(nonce []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	return s.aead.Open(nil, s.nonce(nonce), ciphertext, additionalData)
+}
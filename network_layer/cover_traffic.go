@@ -0,0 +1,234 @@
+package network_layer
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"io"
+	"time"
+
+	"github.com/starling-protocol/starling/device"
+	"github.com/starling-protocol/starling/network_layer/contact_bitmap"
+	"github.com/starling-protocol/starling/utils"
+)
+
+// coverBuckets are the sizes cover SESS payloads are padded to when no PaddingBuckets are configured,
+// since an unpadded empty payload would be recognisable by its length.
+var coverBuckets = []int{64, 256, 1024}
+
+// coverRequestLifetime is how long the IDs of cover route requests are remembered,
+// such that they are not forwarded again when a neighbour sends them back.
+const coverRequestLifetime = time.Minute
+
+// coverTraffic keeps track of the budget of the cover traffic generator.
+type coverTraffic struct {
+	periodStart time.Time
+	sent        int
+	// requests are the cover route requests sent recently, and when they were sent.
+	requests map[RequestID]time.Time
+}
+
+func newCoverTraffic() coverTraffic {
+	return coverTraffic{
+		requests: make(map[RequestID]time.Time),
+	}
+}
+
+// isCoverRequest reports whether the route request is a cover request sent recently by this node.
+func (network *NetworkLayer) isCoverRequest(requestID RequestID) bool {
+	sent, found := network.cover.requests[requestID]
+	return found && network.dev.Now().Sub(sent) < coverRequestLifetime
+}
+
+// coverBucket returns a random size to pad a cover SESS payload to.
+func (network *NetworkLayer) coverBucket() int {
+	buckets := network.options.PaddingBuckets
+	if len(buckets) == 0 {
+		buckets = coverBuckets
+	}
+	return buckets[network.dev.Rand().Intn(len(buckets))]
+}
+
+// startCoverTraffic schedules the next cover packet, if cover traffic is enabled.
+// The delay is drawn uniformly between half and one and a half times the CoverTrafficInterval,
+// such that cover packets do not arrive at a fixed rhythm.
+func (network *NetworkLayer) startCoverTraffic() {
+	interval := network.options.CoverTrafficInterval
+	if interval <= 0 {
+		return
+	}
+
+	delay := interval/2 + time.Duration(network.dev.Rand().Int63n(int64(interval)))
+	network.dev.Delay(func() {
+		network.sendCoverPacket()
+		network.startCoverTraffic()
+	}, delay)
+}
+
+// sendCoverPacket sends either a dummy route request or a dummy SESS packet on an endpoint or a relayed session,
+// unless the budget for the current hour has been spent.
+func (network *NetworkLayer) sendCoverPacket() {
+	now := network.dev.Now()
+	if now.Sub(network.cover.periodStart) >= time.Hour {
+		network.cover.periodStart = now
+		network.cover.sent = 0
+	}
+
+	if network.cover.sent >= network.options.CoverTrafficBudget {
+		network.log("cover:budget_spent")
+		return
+	}
+	network.cover.sent++
+
+	sessions := utils.ShuffleMapKeys(network.dev.Rand(), network.sessionTable)
+	if len(sessions) == 0 || network.dev.Rand().Intn(2) == 0 {
+		network.sendCoverRREQ()
+	} else if network.sessionTable[sessions[0]].EndpointSession() {
+		network.sendCoverSESS(sessions[0])
+	} else {
+		network.sendRelayCoverSESS(sessions[0])
+	}
+}
+
+// sendCoverRREQ broadcasts a route request with a random bitmap that matches no contact.
+// It is forwarded like any other route request, since relays cannot tell it apart.
+func (network *NetworkLayer) sendCoverRREQ() {
+	cryptoRand := network.dev.CryptoRand()
+
+	bitmapResult, err := contact_bitmap.EncodeContactBitmap(cryptoRand, nil, network.dev.ContactsContainer(), 1)
+	if err != nil {
+		network.logf("cover:rreq:error '%v'", err)
+		return
+	}
+
+	ephemeralPrivate, err := ecdh.X25519().GenerateKey(cryptoRand)
+	if err != nil {
+		network.logf("cover:rreq:error '%v'", err)
+		return
+	}
+
+	_, commitment, err := newTeardownKey(cryptoRand)
+	if err != nil {
+		network.logf("cover:rreq:error '%v'", err)
+		return
+	}
+
+	requestID := RequestID(bitmapResult.Seed)
+	// No contact can reply to a cover request, so it is not kept in the request table.
+	// Only its ID is remembered, such that it is recognised as a duplicate when it comes back.
+	now := network.dev.Now()
+	for id, sent := range network.cover.requests {
+		if now.Sub(sent) >= coverRequestLifetime {
+			delete(network.cover.requests, id)
+		}
+	}
+	network.cover.requests[requestID] = now
+
+	rreq := NewRREQPacket(requestID, TTL(network.options.MaxRREQTTL), *ephemeralPrivate.PublicKey(), bitmapResult.Bitmap)
+	rreq.TeardownCommitment = commitment
+	rreq.KeyDerivation = LatestKeyDerivation
+	rreq.CipherSuite = network.options.CipherSuite
+	rreq.Capabilities = network.capabilities()
+
+	// Cover requests carry a KEM key as well, such that they have the same size as real ones
+	if network.options.HybridKeyExchange || network.options.RequireHybridKeyExchange {
+		kemKey, err := newKEMKey(cryptoRand)
+		if err != nil {
+			network.logf("cover:rreq:error '%v'", err)
+			return
+		}
+		rreq.KEMKey = kemKey.EncapsulationKey().Bytes()
+	}
+
+	if err := network.stampRouteRequest(rreq); err != nil {
+		network.logf("cover:rreq:error '%v'", err)
+		return
+	}
+
+	network.logf("cover:rreq:%d", requestID)
+	network.packetLayer.BroadcastBytes(rreq.EncodePacket())
+}
+
+// sendCoverSESS sends an encrypted SESS packet with an empty payload, which the peer discards after decrypting it.
+// The payload is padded to a random bucket, such that it cannot be told apart by its length. Relays forward it like
+// any other SESS packet.
+// Sessions with nodes of the original protocol are skipped, since they would deliver the empty payload.
+func (network *NetworkLayer) sendCoverSESS(sessionID device.SessionID) {
+	if network.sessionTable[sessionID].legacy() {
+		network.logf("cover:sess:legacy:%d 'not sending cover packet'", sessionID)
+		return
+	}
+
+	network.logf("cover:sess:%d", sessionID)
+	if err := network.sendPaddedData(sessionID, []byte{}, []int{network.coverBucket()}); err != nil {
+		network.logf("cover:sess:error:%d '%v'", sessionID, err)
+	}
+}
+
+// sendRelayCoverSESS sends a SESS packet with random contents on a relayed session, towards either end of it.
+// Relays forward it like any other SESS packet, and the endpoint discards it since it cannot be decrypted.
+// Its nonce continues the counter of the packets relayed in the same direction, see relayCoverNonce.
+func (network *NetworkLayer) sendRelayCoverSESS(sessionID device.SessionID) {
+	session := network.sessionTable[sessionID]
+	labels := session.labels()
+	if len(labels) == 0 {
+		return
+	}
+	link := labels[network.dev.Rand().Intn(len(labels))]
+
+	nonce, err := network.relayCoverNonce(session, link.neighbour)
+	if err != nil {
+		network.logf("cover:sess:error:%d '%v'", sessionID, err)
+		return
+	}
+	cipher := make([]byte, network.coverBucket()+16)
+	if _, err := io.ReadFull(network.dev.CryptoRand(), cipher); err != nil {
+		network.logf("cover:sess:error:%d '%v'", sessionID, err)
+		return
+	}
+
+	packet := SESSPacket{
+		SessionID: link.label,
+		Nonce:     nonce,
+		Cipher:    cipher,
+	}
+
+	network.logf("cover:sess:relay:%d:%s", sessionID, link.neighbour)
+	network.packetLayer.SendBytes(link.neighbour, packet.EncodePacket())
+}
+
+// relayCoverNonce returns the nonce of a relay cover packet towards the neighbour. It continues the counter of the
+// latest SESS packet sent towards it, or starts a new counter when none has been sent, such that it cannot be told
+// apart from the packets of the endpoint. A later packet of the endpoint may repeat the counter, like a duplicated
+// packet would. Sessions with nodes of the original protocol have random nonces.
+func (network *NetworkLayer) relayCoverNonce(session *SessionTableEntry, neighbour device.DeviceAddress) ([]byte, error) {
+	if session.legacy() {
+		nonce := make([]byte, 12)
+		if _, err := io.ReadFull(network.dev.CryptoRand(), nonce); err != nil {
+			return nil, err
+		}
+		return nonce, nil
+	}
+
+	// Packets towards the source neighbour are sent by the responder
+	last, direction := session.targetNonce, directionFromInitiator
+	if session.SourceNeighbour != nil && *session.SourceNeighbour == neighbour {
+		last, direction = session.sourceNonce, directionFromResponder
+	}
+
+	nonce := sessionNonce(direction, 0, 1)
+	if last != nil {
+		direction, epoch, counter := parseSessionNonce(last)
+		nonce = sessionNonce(direction, epoch, counter+1)
+	}
+	session.relayedNonce(neighbour, nonce)
+	return nonce, nil
+}
+
+// relayedNonce records the nonce of a SESS packet sent towards the neighbour on a relayed session.
+func (s *SessionTableEntry) relayedNonce(neighbour device.DeviceAddress, nonce []byte) {
+	if s.SourceNeighbour != nil && *s.SourceNeighbour == neighbour {
+		s.sourceNonce = bytes.Clone(nonce)
+	} else {
+		s.targetNonce = bytes.Clone(nonce)
+	}
+}
@@ -0,0 +1,7 @@
+package network_layer
+
+// ReputationEntries exposes the number of neighbours with a reputation to the tests,
+// such that they can observe reputations being forgotten.
+func (network *NetworkLayer) ReputationEntries() int {
+	return len(network.reputations)
+}
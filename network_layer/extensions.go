@@ -0,0 +1,102 @@
+package network_layer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Route packets keep the layout of the original protocol, and any further fields are appended as extensions,
+// which older nodes ignore since they do not read past the original fields. The extensions start with a version
+// byte, followed by a list of extensions which each consist of a type byte, a two byte length and the value.
+// Extensions of unknown types are skipped, such that new fields can be added without breaking existing nodes.
+
+// extensionsVersion marks the start of the extensions. Extensions of other versions are ignored as a whole.
+const extensionsVersion = 0x01
+
+type extensionType byte
+
+const (
+	// extensionTeardown is the teardown commitment of a RREQ or RREP, or the teardown token of a RERR, see newTeardownKey.
+	extensionTeardown extensionType = 0x01
+	// extensionKEM is the ML-KEM encapsulation key of a RREQ, or the ML-KEM ciphertext of a RREP.
+	extensionKEM extensionType = 0x02
+	// extensionKeyDerivation is the highest key derivation version supported by the initiator of a RREQ.
+	extensionKeyDerivation extensionType = 0x03
+	// extensionCipherSuite is the cipher suite preferred by the initiator of a RREQ, or chosen by the responder in a RREP.
+	extensionCipherSuite extensionType = 0x04
+	// extensionStamp is the proof-of-work stamp of a RREQ.
+	extensionStamp extensionType = 0x05
+	// extensionCapabilities are the capabilities of the node sending a RREQ.
+	extensionCapabilities extensionType = 0x06
+)
+
+// extension is a single field appended to a packet. Extensions without a value are left out.
+type extension struct {
+	typ   extensionType
+	value []byte
+}
+
+// appendExtensions appends the extensions which have a value, and nothing at all if none of them has.
+func appendExtensions(buf []byte, extensions ...extension) []byte {
+	versionAdded := false
+	for _, ext := range extensions {
+		if ext.value == nil {
+			continue
+		}
+		if !versionAdded {
+			buf = append(buf, extensionsVersion)
+			versionAdded = true
+		}
+		buf = append(buf, byte(ext.typ))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(ext.value)))
+		buf = append(buf, ext.value...)
+	}
+	return buf
+}
+
+// decodeExtensions decodes the extensions following the original fields of a packet.
+func decodeExtensions(buf []byte) (map[extensionType][]byte, error) {
+	extensions := map[extensionType][]byte{}
+	if len(buf) == 0 || buf[0] != extensionsVersion {
+		return extensions, nil
+	}
+
+	buf = buf[1:]
+	for len(buf) > 0 {
+		if len(buf) < 3 {
+			return nil, errors.New("buffer too small when decoding extension header")
+		}
+		typ := extensionType(buf[0])
+		size := int(binary.BigEndian.Uint16(buf[1:3]))
+		if len(buf) < 3+size {
+			return nil, fmt.Errorf("buffer too small when decoding extension %d of size %d: %d", typ, size, len(buf))
+		}
+		if _, found := extensions[typ]; found {
+			return nil, fmt.Errorf("duplicate extension %d", typ)
+		}
+		extensions[typ] = buf[3 : 3+size]
+		buf = buf[3+size:]
+	}
+	return extensions, nil
+}
+
+// fixedExtension returns the value of an extension which must have the given size, or nil if it is not present.
+func fixedExtension(extensions map[extensionType][]byte, typ extensionType, size int) ([]byte, error) {
+	value, found := extensions[typ]
+	if !found {
+		return nil, nil
+	}
+	if len(value) != size {
+		return nil, fmt.Errorf("extension %d has size %d, expected %d", typ, len(value), size)
+	}
+	return value, nil
+}
+
+// byteExtension encodes a single byte field, which is left out when it has its default value of zero.
+func byteExtension(typ extensionType, value byte) extension {
+	if value == 0 {
+		return extension{typ: typ}
+	}
+	return extension{typ: typ, value: []byte{value}}
+}
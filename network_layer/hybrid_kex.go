@@ -0,0 +1,44 @@
+package network_layer
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"io"
+)
+
+// In the hybrid key exchange, the initiator adds an ML-KEM-768 encapsulation key to its RREQ,
+// and a responder which supports it replies with a ciphertext encapsulating a second shared secret.
+// Both the X25519 and the ML-KEM shared secrets are fed into the session secret,
+// such that recorded traffic stays confidential unless both are broken.
+//
+// The extension is negotiated by its presence: nodes which support it always reply with a ciphertext,
+// while older nodes ignore the encapsulation key and reply with a classic RREP using the original key derivation.
+// The ciphertext is authenticated by the RREP, but a relay may still strip the encapsulation key from the RREQ.
+// The initiator therefore rejects a classic reply to a RREQ with an encapsulation key.
+
+// newKEMKey generates an ephemeral ML-KEM decapsulation key from the given source of randomness.
+func newKEMKey(cryptoRand io.Reader) (*mlkem.DecapsulationKey768, error) {
+	seed := make([]byte, mlkem.SeedSize)
+	if _, err := io.ReadFull(cryptoRand, seed); err != nil {
+		return nil, err
+	}
+	return mlkem.NewDecapsulationKey768(seed)
+}
+
+// encapsulateKEMSecret returns a shared secret and its ciphertext for the encapsulation key of a RREQ.
+func encapsulateKEMSecret(encapsulationKey []byte) ([]byte, []byte, error) {
+	key, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedKey, ciphertext := key.Encapsulate()
+	return sharedKey, ciphertext, nil
+}
+
+// decapsulateKEMSecret returns the shared secret of the ciphertext of a RREP.
+func decapsulateKEMSecret(key *mlkem.DecapsulationKey768, ciphertext []byte) ([]byte, error) {
+	if key == nil {
+		return nil, errors.New("route reply contains a KEM ciphertext, but no KEM key was sent")
+	}
+	return key.Decapsulate(ciphertext)
+}
@@ -0,0 +1,115 @@
+package network_layer
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/starling-protocol/starling/device"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyDerivationVersion identifies how the keys of a session are derived during route setup.
+// The initiator announces the highest version it supports in the RREQ, and the responder picks the
+// highest version supported by both. The initiator only accepts the version it announced, such that
+// a relay cannot downgrade the session, while responders may still reply to older initiators.
+type KeyDerivationVersion byte
+
+const (
+	// KeyDerivationV1 derives a single session secret, which is used in both directions.
+	KeyDerivationV1 KeyDerivationVersion = 1
+	// KeyDerivationV2 derives a separate key for each direction, bound to a transcript of the route setup.
+	KeyDerivationV2 KeyDerivationVersion = 2
+)
+
+// LatestKeyDerivation is the highest version supported by this node.
+const LatestKeyDerivation = KeyDerivationV2
+
+const keyDerivationLabel = "starling session v2"
+
+// SessionKeyMaterial is the key material of an endpoint session derived during route setup.
+type SessionKeyMaterial struct {
+	Version KeyDerivationVersion
+	// SessionID is derived from KeyDerivationV2 on. With KeyDerivationV1 the responder chooses a random session ID
+	// and sends it in the RREP, as nodes of the original protocol do, and it is left zero.
+	SessionID device.SessionID
+	// ReplyKey encrypts the payload of the RREP.
+	ReplyKey []byte
+	// InitiatorKey and ResponderKey are the first keys of the send chains of the initiator and the responder.
+	InitiatorKey []byte
+	ResponderKey []byte
+}
+
+// SessionTranscript hashes the fields of the RREQ and RREP which the endpoints agree on.
+// It includes the key derivation version, as well as the cipher suite offered in the RREQ and the one chosen
+// in the RREP, such that a relay cannot downgrade them without the endpoints deriving different keys.
+// The KEM key and ciphertext are only included if the hybrid key exchange was used.
+func SessionTranscript(version KeyDerivationVersion, reqID RequestID, offeredSuite device.CipherSuite, suite device.CipherSuite, initiatorEphemeral ecdh.PublicKey, responderEphemeral ecdh.PublicKey, kemKey []byte, kemCiphertext []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(keyDerivationLabel))
+	hash.Write([]byte{byte(version), byte(offeredSuite), byte(suite)})
+	hash.Write(reqID.Encode([]byte{}))
+	hash.Write(initiatorEphemeral.Bytes())
+	hash.Write(responderEphemeral.Bytes())
+	hash.Write(binary.BigEndian.AppendUint16([]byte{}, uint16(len(kemKey))))
+	hash.Write(kemKey)
+	hash.Write(binary.BigEndian.AppendUint16([]byte{}, uint16(len(kemCiphertext))))
+	hash.Write(kemCiphertext)
+	return hash.Sum(nil)
+}
+
+// DeriveSessionKeys derives the key material of a session using the given version.
+// The transcript is only used from KeyDerivationV2, see SessionTranscript.
+func DeriveSessionKeys(version KeyDerivationVersion, container device.ContactsContainer, contact device.ContactID, ephemeral []byte, remoteEphemeral []byte, kemSecret []byte, transcript []byte) (*SessionKeyMaterial, error) {
+	if version < KeyDerivationV2 {
+		sessionSecret, err := SessionSecret(container, contact, ephemeral, remoteEphemeral, kemSecret)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SessionKeyMaterial{
+			Version:      KeyDerivationV1,
+			ReplyKey:     sessionSecret,
+			InitiatorKey: sessionSecret,
+			ResponderKey: sessionSecret,
+		}, nil
+	}
+
+	secret, err := sessionInputKeyMaterial(container, contact, ephemeral, remoteEphemeral, kemSecret)
+	if err != nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, secret, transcript)
+	clear(secret)
+	defer clear(prk)
+
+	expand := func(label string, size int) ([]byte, error) {
+		key := make([]byte, size)
+		if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(keyDerivationLabel+" "+label)), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	material := &SessionKeyMaterial{Version: KeyDerivationV2}
+	if material.ReplyKey, err = expand("reply key", 32); err != nil {
+		return nil, err
+	}
+	if material.InitiatorKey, err = expand("initiator key", 32); err != nil {
+		return nil, err
+	}
+	if material.ResponderKey, err = expand("responder key", 32); err != nil {
+		return nil, err
+	}
+
+	sessionID, err := expand("session id", 8)
+	if err != nil {
+		return nil, err
+	}
+	material.SessionID = device.SessionID(binary.BigEndian.Uint64(sessionID) & math.MaxInt64)
+
+	return material, nil
+}
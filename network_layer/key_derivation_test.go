@@ -0,0 +1,56 @@
+package network_layer_test
+
+import (
+	"crypto/ecdh"
+	"math/rand"
+	"testing"
+
+	"github.com/starling-protocol/starling/device"
+	"github.com/starling-protocol/starling/network_layer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveSessionKeys(t *testing.T) {
+	random := rand.New(rand.NewSource(1234))
+
+	contacts := device.NewMemoryContactsContainer()
+	secret := make([]byte, 32)
+	random.Read(secret)
+	contact := contacts.DebugLink(secret)
+
+	initiator, err := ecdh.X25519().GenerateKey(random)
+	assert.NoError(t, err)
+	responder, err := ecdh.X25519().GenerateKey(random)
+	assert.NoError(t, err)
+
+	derive := func(version network_layer.KeyDerivationVersion, reqID network_layer.RequestID, private *ecdh.PrivateKey, public *ecdh.PublicKey) *network_layer.SessionKeyMaterial {
+		transcript := network_layer.SessionTranscript(version, reqID, device.CipherSuiteAESGCM, device.CipherSuiteAESGCM, *initiator.PublicKey(), *responder.PublicKey(), nil, nil)
+		keys, err := network_layer.DeriveSessionKeys(version, contacts, contact, private.Bytes(), public.Bytes(), nil, transcript)
+		assert.NoError(t, err)
+		return keys
+	}
+
+	initiatorKeys := derive(network_layer.KeyDerivationV2, 1, initiator, responder.PublicKey())
+	responderKeys := derive(network_layer.KeyDerivationV2, 1, responder, initiator.PublicKey())
+	assert.Equal(t, initiatorKeys, responderKeys)
+
+	// Every key is separate
+	assert.NotEqual(t, initiatorKeys.InitiatorKey, initiatorKeys.ResponderKey)
+	assert.NotEqual(t, initiatorKeys.InitiatorKey, initiatorKeys.ReplyKey)
+	assert.NotEqual(t, initiatorKeys.ResponderKey, initiatorKeys.ReplyKey)
+
+	// The keys are bound to the transcript
+	otherRequest := derive(network_layer.KeyDerivationV2, 2, initiator, responder.PublicKey())
+	assert.NotEqual(t, initiatorKeys.InitiatorKey, otherRequest.InitiatorKey)
+	assert.NotEqual(t, initiatorKeys.SessionID, otherRequest.SessionID)
+
+	// The original derivation uses the session secret for everything
+	legacy := derive(network_layer.KeyDerivationV1, 1, initiator, responder.PublicKey())
+	sessionSecret, err := network_layer.SessionSecret(contacts, contact, initiator.Bytes(), responder.PublicKey().Bytes(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(sessionSecret), legacy.ReplyKey)
+	assert.Equal(t, []byte(sessionSecret), legacy.InitiatorKey)
+	assert.Equal(t, []byte(sessionSecret), legacy.ResponderKey)
+	assert.NotEqual(t, initiatorKeys.ReplyKey, legacy.ReplyKey)
+}
@@ -1,6 +1,7 @@
 package network_layer
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/starling-protocol/starling/device"
@@ -15,6 +16,14 @@ type NetworkLayer struct {
 	packetLayer  *packet_layer.PacketLayer
 	requestTable RequestTable
 	sessionTable SessionTable
+	labelTable   LabelTable
+	cover        coverTraffic
+	rreqLoad     rreqLoad
+	reputations  map[device.DeviceAddress]*reputation
+	policies     []Policy
+	relay        relayScheduler
+	// forgedRouteErrors counts the route errors that did not reveal the teardown token of the neighbour.
+	forgedRouteErrors int
 }
 
 type NetworkLayerEvents interface {
@@ -31,7 +40,13 @@ func NewNetworkLayer(dev device.Device, events NetworkLayerEvents, options devic
 		packetLayer:  packet_layer.NewLinkLayer(dev, options),
 		requestTable: make(RequestTable),
 		sessionTable: make(SessionTable),
+		labelTable:   make(LabelTable),
+		cover:        newCoverTraffic(),
+		reputations:  make(map[device.DeviceAddress]*reputation),
+		relay:        newRelayScheduler(),
 	}
+
+	layer.startCoverTraffic()
 	return layer
 }
 
@@ -45,6 +60,7 @@ func (network *NetworkLayer) logf(msg string, args ...any) {
 
 func (network *NetworkLayer) OnConnection(address device.DeviceAddress) {
 	network.packetLayer.OnConnection(address)
+	network.announceCapabilities(address)
 
 	if !network.options.DisableAutoRREQOnConnection {
 		network.SendRouteRequest(address, 1)
@@ -64,6 +80,9 @@ func (network *NetworkLayer) ReceivePacket(sender device.DeviceAddress, packet [
 		packet, err := DecodeRoutingPacket(packet)
 		if err != nil {
 			network.logf("packet:receive:error '%v'", err)
+			if !errors.Is(err, errUnknownPacketType) {
+				network.ReportMisbehaviour(sender, MisbehaviourDecodeError)
+			}
 			continue
 		}
 
@@ -90,6 +109,9 @@ func (network *NetworkLayer) handlePacket(sender device.DeviceAddress, packet Pa
 	case RERR:
 		rerr := packet.(*RERRPacket)
 		network.handleRouteErrorPacket(*rerr, sender)
+	case CAPS:
+		caps := packet.(*CAPSPacket)
+		network.updateNeighbourCapabilities(sender, caps.Capabilities)
 	default:
 		network.logf("packet:handle:error 'unknown network packet type %v'", packet.PacketType())
 	}
@@ -106,7 +128,7 @@ func (network *NetworkLayer) DeleteContact(contact device.ContactID) {
 		if session.Contact != nil && *session.Contact == contact {
 			network.SessionBroken(sessionID, nil)
 			delete(network.requestTable, session.RequestID)
-			delete(network.sessionTable, session.SessionID)
+			network.removeSession(session.SessionID)
 
 		}
 	}
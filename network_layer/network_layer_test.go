@@ -2,11 +2,20 @@ package network_layer_test
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"encoding/binary"
+	"fmt"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/starling-protocol/starling/device"
 	"github.com/starling-protocol/starling/network_layer"
+	"github.com/starling-protocol/starling/network_layer/contact_bitmap"
+	"github.com/starling-protocol/starling/packet_layer"
 	"github.com/starling-protocol/starling/testutils"
 
 	"github.com/stretchr/testify/assert"
@@ -60,7 +69,11 @@ func NewTestNode(address device.DeviceAddress, networkLayer *network_layer.Netwo
 }
 
 func setupNodes(t *testing.T, random *rand.Rand, addressA device.DeviceAddress, addressB device.DeviceAddress) (*TestNode, *TestNode) {
-	protoOptions := *device.DefaultProtocolOptions()
+	return setupNodesWithOptions(t, random, addressA, addressB, device.DefaultProtocolOptions())
+}
+
+func setupNodesWithOptions(t *testing.T, random *rand.Rand, addressA device.DeviceAddress, addressB device.DeviceAddress, options *device.ProtocolOptions) (*TestNode, *TestNode) {
+	protoOptions := *options
 	protoOptions.DisableAutoRREQOnConnection = true
 
 	devA := testutils.NewDeviceMock(t, random)
@@ -134,6 +147,13 @@ func TestRouteReplyAuthentication(t *testing.T) {
 	// attempt to alter route reply
 	rrep := nodeB.dev.PopLastPacket()
 	for i := 0; i < len(rrep); i++ {
+		// The session label follows the 2 byte link header, the packet type and the request id,
+		// and the teardown commitment is the only extension, which takes up the last 36 bytes.
+		// Both are rewritten by every relay, and are therefore not authenticated.
+		if (i >= 11 && i < 19) || i >= len(rrep)-36 {
+			continue
+		}
+
 		alteredRREP := bytes.Clone(rrep)
 		alteredRREP[i] += 1
 
@@ -143,3 +163,1457 @@ func TestRouteReplyAuthentication(t *testing.T) {
 
 	assert.Empty(t, nodeA.networkLayer.AllSessions(nodeA.contact))
 }
+
+func TestSESSReplayProtection(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+	establishSession(t, nodeA, nodeB)
+
+	session := nodeA.networkLayer.AllSessions(nodeA.contact)[0]
+
+	assert.NoError(t, nodeA.networkLayer.SendData(session, []byte("first")))
+	first := nodeA.dev.PopLastPacket()
+	assert.NoError(t, nodeA.networkLayer.SendData(session, []byte("second")))
+	second := nodeA.dev.PopLastPacket()
+
+	// Packets are accepted out of order
+	messages := nodeB.networkLayer.ReceivePacket(addressA, second)
+	assert.Len(t, messages, 1)
+	messages = nodeB.networkLayer.ReceivePacket(addressA, first)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, []byte("first"), messages[0].Data())
+
+	// Replayed packets are dropped
+	assert.Empty(t, nodeB.networkLayer.ReceivePacket(addressA, first))
+	assert.Empty(t, nodeB.networkLayer.ReceivePacket(addressA, second))
+
+	// Packets are not accepted when reflected back to the sender
+	assert.NoError(t, nodeB.networkLayer.SendData(session, []byte("reply")))
+	reply := nodeB.dev.PopLastPacket()
+	assert.Empty(t, nodeB.networkLayer.ReceivePacket(addressA, reply))
+	assert.Len(t, nodeA.networkLayer.ReceivePacket(addressB, reply), 1)
+}
+
+func TestSessionRekeying(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := device.DefaultProtocolOptions()
+	options.RekeyAfterMessages = 2
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, options)
+	establishSession(t, nodeA, nodeB)
+
+	session := nodeA.networkLayer.AllSessions(nodeA.contact)[0]
+
+	packets := [][]byte{}
+	for i := 0; i < 12; i++ {
+		assert.NoError(t, nodeA.networkLayer.SendData(session, []byte{byte(i)}))
+		packets = append(packets, nodeA.dev.PopLastPacket())
+	}
+
+	// Packets spanning several epochs are received in order
+	for i := 0; i < 3; i++ {
+		assert.Len(t, nodeB.networkLayer.ReceivePacket(addressA, packets[i]), 1)
+	}
+
+	// A packet of the next epoch arrives before one of the current epoch
+	assert.Len(t, nodeB.networkLayer.ReceivePacket(addressA, packets[6]), 1)
+	assert.Len(t, nodeB.networkLayer.ReceivePacket(addressA, packets[5]), 1)
+
+	// The keys of older epochs have been erased
+	assert.Empty(t, nodeB.networkLayer.ReceivePacket(addressA, packets[3]))
+
+	// The receiver catches up when the packets of whole epochs were lost
+	assert.Len(t, nodeB.networkLayer.ReceivePacket(addressA, packets[11]), 1)
+
+	// Both directions are rekeyed independently
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, nodeB.networkLayer.SendData(session, []byte{byte(i)}))
+		assert.Len(t, nodeA.networkLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket()), 1)
+	}
+}
+
+func TestSESSPadding(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := device.DefaultProtocolOptions()
+	options.PaddingBuckets = []int{32, 128}
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, options)
+	establishSession(t, nodeA, nodeB)
+
+	session := nodeA.networkLayer.AllSessions(nodeA.contact)[0]
+
+	sizes := []int{}
+	for _, size := range []int{1, 10, 31, 32, 127, 200} {
+		message := bytes.Repeat([]byte{0x00}, size)
+		assert.NoError(t, nodeA.networkLayer.SendData(session, message))
+		packet := nodeA.dev.PopLastPacket()
+		sizes = append(sizes, len(packet))
+
+		messages := nodeB.networkLayer.ReceivePacket(addressA, packet)
+		assert.Len(t, messages, 1)
+		assert.Equal(t, message, messages[0].Data())
+	}
+
+	// Messages are indistinguishable by size within a bucket
+	assert.Equal(t, sizes[0], sizes[1])
+	assert.Equal(t, sizes[0], sizes[2])
+	assert.Equal(t, sizes[3], sizes[4])
+	assert.Less(t, sizes[2], sizes[3])
+	assert.Less(t, sizes[4], sizes[5])
+}
+
+func TestCoverTraffic(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := device.DefaultProtocolOptions()
+	options.CoverTrafficInterval = time.Minute
+	options.CoverTrafficBudget = 5
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, options)
+	establishSession(t, nodeA, nodeB)
+
+	for i := 0; i < options.CoverTrafficBudget; i++ {
+		nodeA.dev.ExecuteNextDelayAction()
+		packets := nodeA.dev.PacketsSent
+		nodeA.dev.PacketsSent = [][]byte{}
+		assert.NotEmpty(t, packets)
+
+		// Cover packets are discarded by the receiver
+		for _, packet := range packets {
+			messages := nodeB.networkLayer.ReceivePacket(addressA, packet)
+			assert.Empty(t, messages)
+		}
+		assert.Equal(t, 1, nodeB.netEvents.sessionsEstablished)
+
+		// Cover packets which come back to the sender are not sent on again
+		for _, packet := range packets {
+			nodeA.networkLayer.ReceivePacket(addressB, packet)
+		}
+		assert.Empty(t, nodeA.dev.PacketsSent)
+	}
+
+	// The budget has been spent
+	nodeA.dev.ExecuteNextDelayAction()
+	assert.Empty(t, nodeA.dev.PacketsSent)
+	assert.Len(t, nodeA.dev.DelayActions, 1)
+}
+
+// Cover requests carry a KEM key whenever real requests do
+func TestCoverRequestKEMKey(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := device.DefaultProtocolOptions()
+	options.CoverTrafficInterval = time.Minute
+	options.RequireHybridKeyExchange = true
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, _ := setupNodesWithOptions(t, random, addressA, addressB, options)
+	nodeA.networkLayer.OnConnection(addressB)
+	nodeA.dev.PacketsSent = [][]byte{}
+
+	nodeA.dev.ExecuteNextDelayAction()
+	packets := networkPackets(t, nodeA.dev.PacketsSent)
+	assert.Len(t, packets, 1)
+	rreq, err := network_layer.DecodeRREQ(packets[0])
+	assert.NoError(t, err)
+	assert.Len(t, rreq.KEMKey, mlkem.EncapsulationKeySize768)
+}
+
+// Relays send cover packets on the sessions they relay, which the endpoints discard
+func TestRelayCoverTraffic(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressR := device.DeviceAddress("3000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+
+	options := *device.DefaultProtocolOptions()
+	options.DisableAutoRREQOnConnection = true
+	options.CoverTrafficInterval = time.Minute
+	options.CoverTrafficBudget = 20
+	devR := testutils.NewDeviceMock(t, random)
+	relay := network_layer.NewNetworkLayer(devR, newMockNetEvents(devR), options)
+
+	nodeA.networkLayer.OnConnection(addressR)
+	relay.OnConnection(addressA)
+	relay.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressR)
+
+	nodeA.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	relay.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	nodeA.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	assert.Len(t, nodeA.networkLayer.AllSessions(nodeA.contact), 1)
+
+	session := nodeA.networkLayer.AllSessions(nodeA.contact)[0]
+	assert.NoError(t, nodeA.networkLayer.SendData(session, []byte("first")))
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket()), 1)
+
+	// The nonces of cover packets continue the counters of the packets relayed in each direction
+	nextCounter := map[*TestNode]uint64{nodeA: 1, nodeB: 2}
+
+	coverSESS := 0
+	for i := 0; i < options.CoverTrafficBudget; i++ {
+		sentToA := devR.PacketsSentTo[addressA]
+		sentToB := devR.PacketsSentTo[addressB]
+		devR.ExecuteNextDelayAction()
+		packets := devR.PacketsSent
+		devR.PacketsSent = [][]byte{}
+		assert.NotEmpty(t, packets)
+
+		// Cover route requests are broadcast, while cover SESS packets are sent towards one end of the session
+		if devR.PacketsSentTo[addressA] > sentToA && devR.PacketsSentTo[addressB] > sentToB {
+			continue
+		}
+		coverSESS++
+
+		endpoint := nodeA
+		if devR.PacketsSentTo[addressB] > sentToB {
+			endpoint = nodeB
+		}
+		for _, packet := range networkPackets(t, packets) {
+			sess, err := network_layer.DecodeSESS(packet)
+			assert.NoError(t, err)
+			direction := uint32(0)
+			if endpoint == nodeA {
+				direction = 1
+			}
+			assert.Equal(t, direction<<31, binary.BigEndian.Uint32(sess.Nonce[:4]))
+			assert.Equal(t, nextCounter[endpoint], binary.BigEndian.Uint64(sess.Nonce[4:]))
+			nextCounter[endpoint]++
+		}
+		for _, packet := range packets {
+			messages := endpoint.networkLayer.ReceivePacket(addressR, packet)
+			assert.Empty(t, messages)
+		}
+		assert.Empty(t, endpoint.dev.PacketsSent)
+	}
+	assert.NotZero(t, coverSESS)
+
+	// The session is still intact
+	assert.NoError(t, nodeA.networkLayer.SendData(session, []byte("hello")))
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	messages := nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	assert.Len(t, messages, 1)
+	assert.Equal(t, []byte("hello"), messages[0].Data())
+}
+
+func TestSessionLabelRewriting(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressR := device.DeviceAddress("3000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+
+	options := *device.DefaultProtocolOptions()
+	options.DisableAutoRREQOnConnection = true
+	devR := testutils.NewDeviceMock(t, random)
+	netEventsR := newMockNetEvents(devR)
+	relay := network_layer.NewNetworkLayer(devR, netEventsR, options)
+
+	// A and B are only connected through the relay
+	nodeA.networkLayer.OnConnection(addressR)
+	relay.OnConnection(addressA)
+	relay.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressR)
+
+	nodeA.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	relay.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	nodeA.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+
+	sessions := nodeA.networkLayer.AllSessions(nodeA.contact)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, sessions, nodeB.networkLayer.AllSessions(nodeB.contact))
+	session := sessions[0]
+
+	assert.NoError(t, nodeA.networkLayer.SendData(session, []byte("hello")))
+	firstHop := nodeA.dev.PopLastPacket()
+	relay.ReceivePacket(addressA, firstHop)
+	secondHop := devR.PopLastPacket()
+
+	messages := nodeB.networkLayer.ReceivePacket(addressR, secondHop)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, session, messages[0].SessionID())
+	assert.Equal(t, []byte("hello"), messages[0].Data())
+
+	// The session is labelled differently on each hop, and the end-to-end session ID is never sent
+	endToEnd := network_layer.EncodeSessionID(session, []byte{})
+	assert.NotEqual(t, firstHop[3:11], secondHop[3:11])
+	assert.NotContains(t, string(firstHop), string(endToEnd))
+	assert.NotContains(t, string(secondHop), string(endToEnd))
+
+	// Route errors are relabelled as well
+	relay.OnDisconnection(addressB)
+	nodeA.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	assert.Equal(t, 1, nodeA.netEvents.sessionsBroken)
+	assert.Empty(t, nodeA.networkLayer.AllSessions(nodeA.contact))
+}
+
+func TestForgedRouteError(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressR := device.DeviceAddress("3000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+
+	options := *device.DefaultProtocolOptions()
+	options.DisableAutoRREQOnConnection = true
+	devR := testutils.NewDeviceMock(t, random)
+	netEventsR := newMockNetEvents(devR)
+	relay := network_layer.NewNetworkLayer(devR, netEventsR, options)
+
+	nodeA.networkLayer.OnConnection(addressR)
+	relay.OnConnection(addressA)
+	relay.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressR)
+
+	nodeA.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	relay.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	nodeA.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	assert.Len(t, nodeA.networkLayer.AllSessions(nodeA.contact), 1)
+
+	relay.OnDisconnection(addressB)
+	rerr := devR.PopLastPacket()
+
+	// The token follows the 2 byte link header, the packet type, the session label and the extension header
+	for i := 15; i < 79; i++ {
+		forged := bytes.Clone(rerr)
+		forged[i] += 1
+
+		nodeA.networkLayer.ReceivePacket(addressR, forged)
+		assert.Equalf(t, 0, nodeA.netEvents.sessionsBroken, "forged route error should be ignored, byte %d", i)
+	}
+	assert.Equal(t, 64, nodeA.networkLayer.ForgedRouteErrors())
+	assert.Len(t, nodeA.networkLayer.AllSessions(nodeA.contact), 1)
+
+	// The token cannot be left out once the neighbour has committed to one
+	decoded, err := network_layer.DecodeRERR(rerr[2:])
+	assert.NoError(t, err)
+	nodeA.networkLayer.ReceivePacket(addressR, reframePacket(rerr, network_layer.NewRERR(decoded.SessionID, nil).EncodePacket()))
+	assert.Equal(t, 0, nodeA.netEvents.sessionsBroken)
+	assert.Equal(t, 65, nodeA.networkLayer.ForgedRouteErrors())
+
+	// The token is only valid on the link it was committed to
+	nodeA.networkLayer.OnConnection(addressB)
+	nodeA.networkLayer.ReceivePacket(addressB, rerr)
+	assert.Equal(t, 0, nodeA.netEvents.sessionsBroken)
+
+	nodeA.networkLayer.ReceivePacket(addressR, rerr)
+	assert.Equal(t, 1, nodeA.netEvents.sessionsBroken)
+	assert.Empty(t, nodeA.networkLayer.AllSessions(nodeA.contact))
+}
+
+func TestGroupRouteError(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := *device.DefaultProtocolOptions()
+	options.DisableAutoRREQOnConnection = true
+
+	var groupSecret [32]byte
+	random.Read(groupSecret[:])
+
+	addresses := []device.DeviceAddress{"1000", "2000", "3000"}
+	nodes := []*TestNode{}
+	for _, address := range addresses {
+		dev := testutils.NewDeviceMock(t, random)
+		netEvents := newMockNetEvents(dev)
+		group, err := dev.Contacts.JoinGroup(groupSecret[:])
+		assert.NoError(t, err)
+		nodes = append(nodes, NewTestNode(address, network_layer.NewNetworkLayer(dev, netEvents, options), dev, netEvents, group))
+	}
+	initiator, members := nodes[0], nodes[1:]
+
+	addressR := device.DeviceAddress("4000")
+	devR := testutils.NewDeviceMock(t, random)
+	relay := network_layer.NewNetworkLayer(devR, newMockNetEvents(devR), options)
+
+	initiator.networkLayer.OnConnection(addressR)
+	relay.OnConnection(initiator.address)
+	for _, member := range members {
+		relay.OnConnection(member.address)
+		member.networkLayer.OnConnection(addressR)
+	}
+
+	// The relay forwards the group request to both members, which each set up a session through it
+	initiator.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(initiator.address, initiator.dev.PopLastPacket())
+	rreq := devR.PopLastPacket()
+	for _, member := range members {
+		member.networkLayer.ReceivePacket(addressR, rreq)
+		relay.ReceivePacket(member.address, member.dev.PopLastPacket())
+		assert.Len(t, member.networkLayer.AllSessions(member.contact), 1)
+	}
+
+	// The relay tears down both sessions with the teardown key of its request, signing a different label for each
+	devR.PacketsSent = [][]byte{}
+	relay.OnDisconnection(initiator.address)
+	assert.Len(t, devR.PacketsSent, 2)
+	rerrs := []*network_layer.RERRPacket{}
+	for _, packet := range devR.PacketsSent {
+		rerr, err := network_layer.DecodeRERR(packet[2:])
+		assert.NoError(t, err)
+		rerrs = append(rerrs, rerr)
+	}
+
+	// The route error of one session cannot be replayed against the other
+	forged := network_layer.NewRERR(rerrs[1].SessionID, rerrs[0].Token).EncodePacket()
+	for _, member := range members {
+		member.networkLayer.ReceivePacket(addressR, reframePacket(devR.PacketsSent[0], forged))
+		assert.Equal(t, 0, member.netEvents.sessionsBroken)
+	}
+	assert.Equal(t, 1, members[0].networkLayer.ForgedRouteErrors()+members[1].networkLayer.ForgedRouteErrors())
+
+	for _, member := range members {
+		for _, packet := range devR.PacketsSent {
+			member.networkLayer.ReceivePacket(addressR, packet)
+		}
+		assert.Equal(t, 1, member.netEvents.sessionsBroken)
+		assert.Empty(t, member.networkLayer.AllSessions(member.contact))
+	}
+}
+
+func TestLegacyRouteError(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressR := device.DeviceAddress("3000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+
+	options := *device.DefaultProtocolOptions()
+	options.DisableAutoRREQOnConnection = true
+	devR := testutils.NewDeviceMock(t, random)
+	relay := network_layer.NewNetworkLayer(devR, newMockNetEvents(devR), options)
+
+	nodeA.networkLayer.OnConnection(addressR)
+	relay.OnConnection(addressA)
+	relay.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressR)
+
+	// The relay is an older node, which does not commit to a teardown token towards B
+	nodeA.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	nodeB.networkLayer.ReceivePacket(addressR, legacyRouteRequest(t, devR.PopLastPacket()))
+	relay.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	nodeA.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	assert.Len(t, nodeB.networkLayer.AllSessions(nodeB.contact), 1)
+
+	relay.OnDisconnection(addressA)
+	rerr := devR.PopLastPacket()
+	decoded, err := network_layer.DecodeRERR(rerr[2:])
+	assert.NoError(t, err)
+
+	nodeB.networkLayer.ReceivePacket(addressR, reframePacket(rerr, network_layer.NewRERR(decoded.SessionID, nil).EncodePacket()))
+	assert.Equal(t, 0, nodeB.networkLayer.ForgedRouteErrors())
+	assert.Equal(t, 1, nodeB.netEvents.sessionsBroken)
+	assert.Empty(t, nodeB.networkLayer.AllSessions(nodeB.contact))
+}
+
+// deliverPackets delivers all the link packets sent by one node to the other, in the order they were sent.
+func deliverPackets(from *TestNode, to *TestNode) {
+	packets := from.dev.PacketsSent
+	from.dev.PacketsSent = [][]byte{}
+	for _, packet := range packets {
+		to.networkLayer.ReceivePacket(from.address, packet)
+	}
+}
+
+func TestHybridKeyExchange(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+
+	classic := device.DefaultProtocolOptions()
+	hybrid := device.DefaultProtocolOptions()
+	hybrid.HybridKeyExchange = true
+	required := device.DefaultProtocolOptions()
+	required.RequireHybridKeyExchange = true
+
+	stripKEMKey := func(rreq *network_layer.RREQPacket) *network_layer.RREQPacket {
+		rreq.KEMKey = nil
+		return rreq
+	}
+	legacyRREQ := func(rreq *network_layer.RREQPacket) *network_layer.RREQPacket {
+		return network_layer.NewRREQPacket(rreq.RequestID, rreq.TTL, rreq.EphemeralKey, rreq.ContactMask)
+	}
+
+	testCases := []struct {
+		name             string
+		initiator        *device.ProtocolOptions
+		responder        *device.ProtocolOptions
+		rewriteRREQ      func(*network_layer.RREQPacket) *network_layer.RREQPacket
+		expectKEMKey     bool
+		expectCiphertext bool
+		expectSession    bool
+	}{
+		{"both hybrid", hybrid, hybrid, nil, true, true, true},
+		{"classic responder", hybrid, classic, nil, true, true, true},
+		{"classic initiator", classic, hybrid, nil, false, false, true},
+		{"required by responder", classic, required, nil, false, false, false},
+		{"required by initiator", required, classic, nil, true, true, true},
+		{"stripped encapsulation key", hybrid, hybrid, stripKEMKey, true, false, false},
+		{"legacy responder", hybrid, classic, legacyRREQ, true, false, false},
+		{"legacy responder required", required, classic, legacyRREQ, true, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, tc.initiator)
+			responderOptions := *tc.responder
+			responderOptions.DisableAutoRREQOnConnection = true
+			nodeB.networkLayer = network_layer.NewNetworkLayer(nodeB.dev, nodeB.netEvents, responderOptions)
+
+			nodeA.networkLayer.OnConnection(addressB)
+			nodeB.networkLayer.OnConnection(addressA)
+
+			nodeA.networkLayer.BroadcastRouteRequest()
+			rreqSize := totalSize(nodeA.dev.PacketsSent)
+			if tc.rewriteRREQ != nil {
+				nodeA.dev.PacketsSent = rewritePackets(t, nodeA.dev.PacketsSent, func(packet []byte) []byte {
+					rreq, err := network_layer.DecodeRREQ(packet)
+					assert.NoError(t, err)
+					return tc.rewriteRREQ(rreq).EncodePacket()
+				})
+			}
+			deliverPackets(nodeA, nodeB)
+
+			rrepSize := totalSize(nodeB.dev.PacketsSent)
+			deliverPackets(nodeB, nodeA)
+
+			assert.Equal(t, tc.expectKEMKey, rreqSize > mlkem.EncapsulationKeySize768)
+			assert.Equal(t, tc.expectCiphertext, rrepSize > mlkem.CiphertextSize768)
+
+			sessions := nodeA.networkLayer.AllSessions(nodeA.contact)
+			if !tc.expectSession {
+				assert.Empty(t, sessions)
+				return
+			}
+			assert.Len(t, sessions, 1)
+			assert.Equal(t, sessions, nodeB.networkLayer.AllSessions(nodeB.contact))
+
+			// Both ends derived the same session secret
+			assert.NoError(t, nodeA.networkLayer.SendData(sessions[0], []byte("hello")))
+			messages := nodeB.networkLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+			assert.Len(t, messages, 1)
+			assert.Equal(t, []byte("hello"), messages[0].Data())
+		})
+	}
+}
+
+// rewritePackets rewrites each network packet carried by the link packets, and encodes them into new link packets.
+func rewritePackets(t *testing.T, packets [][]byte, rewrite func([]byte) []byte) [][]byte {
+	decoder := packet_layer.NewPacketDecoder()
+	encoder := packet_layer.NewPacketEncoder(len(packets[0]))
+	for _, packet := range packets {
+		assert.NoError(t, decoder.AppendPacket(packet))
+		for {
+			hasMessage, err := decoder.HasMessage()
+			assert.NoError(t, err)
+			if !hasMessage {
+				break
+			}
+			message, err := decoder.ReadMessage()
+			assert.NoError(t, err)
+			assert.NoError(t, encoder.EncodeMessage(rewrite(message)))
+		}
+	}
+
+	rewritten := [][]byte{}
+	for encoder.PacketCount() > 0 {
+		rewritten = append(rewritten, encoder.PopPacket())
+	}
+	return rewritten
+}
+
+func totalSize(packets [][]byte) int {
+	size := 0
+	for _, packet := range packets {
+		size += len(packet)
+	}
+	return size
+}
+
+// legacyRouteRequest strips the extensions from a RREQ sent in a single link packet, as older nodes leave them out.
+func legacyRouteRequest(t *testing.T, packet []byte) []byte {
+	rreq, err := network_layer.DecodeRREQ(packet[2:])
+	assert.NoError(t, err)
+
+	legacy := network_layer.NewRREQPacket(rreq.RequestID, rreq.TTL, rreq.EphemeralKey, rreq.ContactMask)
+	return reframePacket(packet, legacy.EncodePacket())
+}
+
+// linkPackets encodes a network packet into link packets.
+func linkPackets(t *testing.T, packet []byte) [][]byte {
+	encoder := packet_layer.NewPacketEncoder(512)
+	assert.NoError(t, encoder.EncodeMessage(packet))
+
+	packets := [][]byte{}
+	for encoder.PacketCount() > 0 {
+		packets = append(packets, encoder.PopPacket())
+	}
+	return packets
+}
+
+// networkPackets decodes the network packets carried by the link packets.
+func networkPackets(t *testing.T, packets [][]byte) [][]byte {
+	decoder := packet_layer.NewPacketDecoder()
+	decoded := [][]byte{}
+	for _, packet := range packets {
+		assert.NoError(t, decoder.AppendPacket(packet))
+		for {
+			hasMessage, err := decoder.HasMessage()
+			assert.NoError(t, err)
+			if !hasMessage {
+				break
+			}
+			message, err := decoder.ReadMessage()
+			assert.NoError(t, err)
+			decoded = append(decoded, message)
+		}
+	}
+	return decoded
+}
+
+// receivePackets delivers the link packets to the network layer, and returns the session messages it received.
+func receivePackets(network *network_layer.NetworkLayer, sender device.DeviceAddress, packets [][]byte) []network_layer.SessionMessage {
+	messages := []network_layer.SessionMessage{}
+	for _, packet := range packets {
+		messages = append(messages, network.ReceivePacket(sender, packet)...)
+	}
+	return messages
+}
+
+// popPackets removes and returns all the link packets sent by the device.
+func popPackets(dev *testutils.DeviceMock) [][]byte {
+	packets := dev.PacketsSent
+	dev.PacketsSent = [][]byte{}
+	return packets
+}
+
+// reframePacket replaces the content of a link packet holding a single network packet.
+func reframePacket(packet []byte, encoded []byte) []byte {
+	header := []byte{packet[0]&^0b11 | byte(len(encoded)>>8), byte(len(encoded))}
+	return append(header, encoded...)
+}
+
+func TestKeyDerivationVersions(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+
+	strict := device.DefaultProtocolOptions()
+	strict.AllowLegacyKeyDerivation = false
+
+	// The RREQ of a legacy initiator is simulated by stripping the extensions,
+	// so the initiator rejects the legacy reply as it offered the newer version.
+	testCases := []struct {
+		name          string
+		options       *device.ProtocolOptions
+		legacyRREQ    bool
+		expectReply   bool
+		expectSession bool
+	}{
+		{"latest", device.DefaultProtocolOptions(), false, true, true},
+		{"latest without legacy", strict, false, true, true},
+		{"legacy initiator", device.DefaultProtocolOptions(), true, true, false},
+		{"legacy initiator rejected", strict, true, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, tc.options)
+			nodeA.networkLayer.OnConnection(addressB)
+			nodeB.networkLayer.OnConnection(addressA)
+
+			nodeA.networkLayer.BroadcastRouteRequest()
+			rreq := nodeA.dev.PopLastPacket()
+			if tc.legacyRREQ {
+				rreq = legacyRouteRequest(t, rreq)
+			}
+			nodeB.networkLayer.ReceivePacket(addressA, rreq)
+
+			if !tc.expectReply {
+				assert.Empty(t, nodeB.dev.PacketsSent)
+				assert.Empty(t, nodeB.networkLayer.AllSessions(nodeB.contact))
+				return
+			}
+
+			nodeA.networkLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+			sessions := nodeA.networkLayer.AllSessions(nodeA.contact)
+			if !tc.expectSession {
+				assert.Len(t, nodeB.networkLayer.AllSessions(nodeB.contact), 1)
+				assert.Empty(t, sessions)
+				return
+			}
+			assert.Len(t, sessions, 1)
+			assert.Equal(t, sessions, nodeB.networkLayer.AllSessions(nodeB.contact))
+
+			// Both directions use matching keys
+			assert.NoError(t, nodeA.networkLayer.SendData(sessions[0], []byte("from A")))
+			messages := nodeB.networkLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+			assert.Len(t, messages, 1)
+			assert.Equal(t, []byte("from A"), messages[0].Data())
+
+			assert.NoError(t, nodeB.networkLayer.SendData(sessions[0], []byte("from B")))
+			messages = nodeA.networkLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+			assert.Len(t, messages, 1)
+			assert.Equal(t, []byte("from B"), messages[0].Data())
+		})
+	}
+}
+
+func TestLegacyInitiator(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressR := device.DeviceAddress("3000")
+
+	for _, relayed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("relayed=%v", relayed), func(t *testing.T) {
+			// Node A is a node of the original protocol, whose packets are encoded by hand
+			nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+			nodeB.netEvents.replyPayload = []byte("reply payload")
+
+			var relay *network_layer.NetworkLayer
+			devR := testutils.NewDeviceMock(t, random)
+			if relayed {
+				options := *device.DefaultProtocolOptions()
+				options.DisableAutoRREQOnConnection = true
+				relay = network_layer.NewNetworkLayer(devR, newMockNetEvents(devR), options)
+				relay.OnConnection(addressA)
+				relay.OnConnection(addressB)
+				nodeB.networkLayer.OnConnection(addressR)
+			} else {
+				nodeB.networkLayer.OnConnection(addressA)
+			}
+			popPackets(devR)
+			popPackets(nodeB.dev)
+
+			// sendToB delivers a packet of A to B, and returns the session messages B received
+			sendToB := func(packet []byte) []network_layer.SessionMessage {
+				if relay == nil {
+					return receivePackets(nodeB.networkLayer, addressA, linkPackets(t, packet))
+				}
+				receivePackets(relay, addressA, linkPackets(t, packet))
+				return receivePackets(nodeB.networkLayer, addressR, popPackets(devR))
+			}
+			// receiveFromB returns the packets of B which reach A
+			receiveFromB := func() [][]byte {
+				if relay == nil {
+					return networkPackets(t, popPackets(nodeB.dev))
+				}
+				receivePackets(relay, addressB, popPackets(nodeB.dev))
+				return networkPackets(t, popPackets(devR))
+			}
+
+			ephemeral, err := ecdh.X25519().GenerateKey(random)
+			assert.NoError(t, err)
+			bitmap, err := contact_bitmap.EncodeContactBitmap(random, []device.ContactID{nodeA.contact}, nodeA.dev.Contacts, 5)
+			assert.NoError(t, err)
+			reqID := network_layer.RequestID(bitmap.Seed)
+
+			rreq := network_layer.NewRREQPacket(reqID, 5, *ephemeral.PublicKey(), bitmap.Bitmap)
+			sendToB(rreq.EncodePacket())
+			assert.Len(t, nodeB.networkLayer.AllSessions(nodeB.contact), 1)
+
+			// The reply authenticates the original header with the session secret, and its payload is not padded
+			reply := receiveFromB()
+			assert.Len(t, reply, 1)
+			rrep, err := network_layer.DecodeRREP(reply[0])
+			assert.NoError(t, err)
+
+			sessionSecret, err := network_layer.SessionSecret(nodeA.dev.Contacts, nodeA.contact, ephemeral.Bytes(), rrep.EphemeralKey.Bytes(), nil)
+			assert.NoError(t, err)
+			block, err := aes.NewCipher(sessionSecret)
+			assert.NoError(t, err)
+			aead, err := cipher.NewGCM(block)
+			assert.NoError(t, err)
+
+			payload, err := aead.Open(nil, rrep.Nonce, rrep.Cipher, network_layer.EncodeRREPHeader(reqID, rrep.SessionID, rrep.EphemeralKey))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("reply payload"), payload)
+
+			// The session ID of the reply identifies the session at both ends
+			sessionID := rrep.SessionID
+			if !relayed {
+				assert.Equal(t, []device.SessionID{sessionID}, nodeB.networkLayer.AllSessions(nodeB.contact))
+			}
+			headers := []byte(fmt.Sprintf("%d", sessionID))
+
+			// SESS packets have random nonces and are not padded in either direction
+			nonce := make([]byte, 12)
+			random.Read(nonce)
+			sess := network_layer.SESSPacket{SessionID: sessionID, Nonce: nonce, Cipher: aead.Seal(nil, nonce, []byte("from A"), headers)}
+			messages := sendToB(sess.EncodePacket())
+			assert.Len(t, messages, 1)
+			assert.Equal(t, []byte("from A"), messages[0].Data())
+
+			sessions := nodeB.networkLayer.AllSessions(nodeB.contact)
+			assert.NoError(t, nodeB.networkLayer.SendData(sessions[0], []byte("from B")))
+			packets := receiveFromB()
+			assert.Len(t, packets, 1)
+			decoded, err := network_layer.DecodeSESS(packets[0])
+			assert.NoError(t, err)
+			assert.Equal(t, sessionID, decoded.SessionID)
+
+			data, err := aead.Open(nil, decoded.Nonce, decoded.Cipher, headers)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("from B"), data)
+		})
+	}
+}
+
+func TestCipherSuiteNegotiation(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+
+	aes := device.CipherSuiteAESGCM
+	chacha := device.CipherSuiteXChaCha20Poly1305
+
+	testCases := []struct {
+		name       string
+		initiator  device.CipherSuite
+		responder  device.CipherSuite
+		legacyRREQ bool
+		expected   device.CipherSuite
+	}{
+		{"both AES-GCM", aes, aes, false, aes},
+		{"initiator prefers XChaCha20", chacha, aes, false, chacha},
+		{"responder prefers XChaCha20", aes, chacha, false, chacha},
+		{"both XChaCha20", chacha, chacha, false, chacha},
+		{"legacy initiator", aes, chacha, true, aes},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := device.DefaultProtocolOptions()
+			options.CipherSuite = tc.initiator
+			nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, options)
+
+			responderOptions := *device.DefaultProtocolOptions()
+			responderOptions.DisableAutoRREQOnConnection = true
+			responderOptions.CipherSuite = tc.responder
+			nodeB.networkLayer = network_layer.NewNetworkLayer(nodeB.dev, nodeB.netEvents, responderOptions)
+
+			nodeA.networkLayer.OnConnection(addressB)
+			nodeB.networkLayer.OnConnection(addressA)
+
+			nodeA.networkLayer.BroadcastRouteRequest()
+			rreq := nodeA.dev.PopLastPacket()
+			if tc.legacyRREQ {
+				rreq = legacyRouteRequest(t, rreq)
+			}
+			nodeB.networkLayer.ReceivePacket(addressA, rreq)
+
+			packet := nodeB.dev.PopLastPacket()
+			rrep, err := network_layer.DecodeRREP(packet[2:])
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, rrep.CipherSuite)
+
+			nodeA.networkLayer.ReceivePacket(addressB, packet)
+			sessions := nodeA.networkLayer.AllSessions(nodeA.contact)
+			if tc.legacyRREQ {
+				// The initiator offered the newer key derivation, so it rejects the legacy reply
+				assert.Empty(t, sessions)
+				return
+			}
+			assert.Len(t, sessions, 1)
+
+			assert.NoError(t, nodeA.networkLayer.SendData(sessions[0], []byte("from A")))
+			messages := nodeB.networkLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+			assert.Len(t, messages, 1)
+			assert.Equal(t, []byte("from A"), messages[0].Data())
+
+			assert.NoError(t, nodeB.networkLayer.SendData(sessions[0], []byte("from B")))
+			messages = nodeA.networkLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+			assert.Len(t, messages, 1)
+			assert.Equal(t, []byte("from B"), messages[0].Data())
+		})
+	}
+}
+
+func TestCipherSuiteDowngrade(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+
+	options := device.DefaultProtocolOptions()
+	options.CipherSuite = device.CipherSuiteXChaCha20Poly1305
+	nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, options)
+
+	responderOptions := *device.DefaultProtocolOptions()
+	responderOptions.DisableAutoRREQOnConnection = true
+	nodeB.networkLayer = network_layer.NewNetworkLayer(nodeB.dev, nodeB.netEvents, responderOptions)
+
+	nodeA.networkLayer.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressA)
+
+	// A relay strips the preferred cipher suite from the RREQ
+	nodeA.networkLayer.BroadcastRouteRequest()
+	nodeA.dev.PacketsSent = rewritePackets(t, nodeA.dev.PacketsSent, func(packet []byte) []byte {
+		rreq, err := network_layer.DecodeRREQ(packet)
+		assert.NoError(t, err)
+		rreq.CipherSuite = 0
+		return rreq.EncodePacket()
+	})
+	deliverPackets(nodeA, nodeB)
+	assert.Len(t, nodeB.networkLayer.AllSessions(nodeB.contact), 1)
+
+	// The suites are part of the transcript, so the initiator derives different keys
+	deliverPackets(nodeB, nodeA)
+	assert.Empty(t, nodeA.networkLayer.AllSessions(nodeA.contact))
+}
+
+func TestRequestEphemeralKeysExpire(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+
+	nodeA.networkLayer.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressA)
+
+	nodeA.networkLayer.BroadcastRouteRequest()
+	nodeB.networkLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	rrep := nodeB.dev.PopLastPacket()
+
+	// The reply arrives after the ephemeral keys of the request have been discarded
+	nodeA.dev.TimeOffset = 2 * time.Minute
+	nodeA.networkLayer.ReceivePacket(addressB, rrep)
+	assert.Equal(t, 0, nodeA.netEvents.sessionsEstablished)
+	assert.Empty(t, nodeA.networkLayer.AllSessions(nodeA.contact))
+
+	// A new request is answered as usual
+	nodeA.networkLayer.BroadcastRouteRequest()
+	nodeB.networkLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	nodeA.networkLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	assert.Equal(t, 1, nodeA.netEvents.sessionsEstablished)
+	assert.Len(t, nodeA.networkLayer.AllSessions(nodeA.contact), 1)
+}
+
+func TestGroupRequestEphemeralKeys(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := *device.DefaultProtocolOptions()
+	options.DisableAutoRREQOnConnection = true
+	options.EphemeralKeyLifetime = 30 * time.Second
+
+	var groupSecret [32]byte
+	random.Read(groupSecret[:])
+
+	addresses := []device.DeviceAddress{"1000", "2000", "3000", "4000"}
+	nodes := []*TestNode{}
+	for _, address := range addresses {
+		dev := testutils.NewDeviceMock(t, random)
+		netEvents := newMockNetEvents(dev)
+		group, err := dev.Contacts.JoinGroup(groupSecret[:])
+		assert.NoError(t, err)
+		nodes = append(nodes, NewTestNode(address, network_layer.NewNetworkLayer(dev, netEvents, options), dev, netEvents, group))
+	}
+	initiator, members := nodes[0], nodes[1:]
+
+	for _, member := range members {
+		initiator.networkLayer.OnConnection(member.address)
+		member.networkLayer.OnConnection(initiator.address)
+	}
+
+	replies := [][]byte{}
+	initiator.networkLayer.BroadcastRouteRequest()
+	rreq := initiator.dev.PopLastPacket()
+	for _, member := range members {
+		member.networkLayer.ReceivePacket(initiator.address, rreq)
+		replies = append(replies, member.dev.PopLastPacket())
+	}
+
+	// Every member that replies in time gets a session, not only the first one
+	initiator.networkLayer.ReceivePacket(members[0].address, replies[0])
+	initiator.networkLayer.ReceivePacket(members[1].address, replies[1])
+	assert.Equal(t, 2, initiator.netEvents.sessionsEstablished)
+	assert.Len(t, initiator.networkLayer.AllSessions(initiator.contact), 2)
+
+	// The keys are discarded once the lifetime has passed
+	initiator.dev.TimeOffset = 45 * time.Second
+	initiator.networkLayer.ReceivePacket(members[2].address, replies[2])
+	assert.Equal(t, 2, initiator.netEvents.sessionsEstablished)
+	assert.Len(t, initiator.networkLayer.AllSessions(initiator.contact), 2)
+}
+
+func TestRouteRequestStamps(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+
+	options := device.DefaultProtocolOptions()
+	options.RREQStampDifficulty = 8
+	nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, options)
+
+	nodeA.networkLayer.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressA)
+
+	nodeA.networkLayer.BroadcastRouteRequest()
+	rreq := nodeA.dev.PopLastPacket()
+
+	rewriteStamp := func(rewrite func(stamp []byte) []byte) []byte {
+		return rewritePackets(t, [][]byte{rreq}, func(packet []byte) []byte {
+			decoded, err := network_layer.DecodeRREQ(packet)
+			assert.NoError(t, err)
+			decoded.Stamp = rewrite(bytes.Clone(decoded.Stamp))
+			return decoded.EncodePacket()
+		})[0]
+	}
+
+	// Requests without a stamp, or with a stamp of a lower difficulty than required, are dropped
+	unstamped := rewriteStamp(func(stamp []byte) []byte { return nil })
+	easier := rewriteStamp(func(stamp []byte) []byte {
+		stamp[0] = 7
+		return stamp
+	})
+	for _, packet := range [][]byte{unstamped, easier} {
+		nodeB.networkLayer.ReceivePacket(addressA, packet)
+		assert.Empty(t, nodeB.dev.PacketsSent)
+		assert.Empty(t, nodeB.networkLayer.AllSessions(nodeB.contact))
+	}
+
+	// The request with the invalid stamp does not prevent the valid one from being handled
+	nodeB.networkLayer.ReceivePacket(addressA, rreq)
+	nodeA.networkLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	assert.Len(t, nodeA.networkLayer.AllSessions(nodeA.contact), 1)
+}
+
+func TestRouteRequestStampDifficultyUnderLoad(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressR := device.DeviceAddress("3000")
+
+	options := device.DefaultProtocolOptions()
+	options.RREQStampDifficulty = 4
+	options.RREQStampLoadThreshold = 2
+	nodeA, _ := setupNodesWithOptions(t, random, addressA, addressB, options)
+
+	relayOptions := *options
+	relayOptions.DisableAutoRREQOnConnection = true
+	devR := testutils.NewDeviceMock(t, random)
+	relay := network_layer.NewNetworkLayer(devR, newMockNetEvents(devR), relayOptions)
+
+	nodeA.networkLayer.OnConnection(addressR)
+	relay.OnConnection(addressA)
+	relay.OnConnection(addressB)
+
+	// The relay forwards the requests, which are stamped with the base difficulty, until its load rises
+	expected := []int{4, 4, 5, 6, 6, 6, 6, 7}
+	for i, difficulty := range expected {
+		nodeA.networkLayer.BroadcastRouteRequest()
+		relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+		assert.Equalf(t, difficulty, relay.StampDifficulty(), "difficulty after %d route requests", i+1)
+		assert.Equalf(t, min(i+1, 2), devR.PacketsSentTo[addressB], "forwarded after %d route requests", i+1)
+	}
+
+	// Requests with an invalid stamp do not count towards the load
+	nodeA.networkLayer.BroadcastRouteRequest()
+	unstamped := rewritePackets(t, [][]byte{nodeA.dev.PopLastPacket()}, func(packet []byte) []byte {
+		rreq, err := network_layer.DecodeRREQ(packet)
+		assert.NoError(t, err)
+		rreq.Stamp = nil
+		return rreq.EncodePacket()
+	})
+	for range 8 {
+		relay.ReceivePacket(addressA, unstamped[0])
+	}
+	assert.Equal(t, 7, relay.StampDifficulty())
+
+	// The load estimate falls back once the rate drops
+	devR.TimeOffset = 3 * time.Minute
+	nodeA.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Equal(t, 4, relay.StampDifficulty())
+	assert.Equal(t, 3, devR.PacketsSentTo[addressB])
+}
+
+func TestRouteRequestStampDifficultyCap(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressC := device.DeviceAddress("3000")
+
+	options := device.DefaultProtocolOptions()
+	options.RREQStampDifficulty = 15
+	options.RREQStampLoadThreshold = 1
+	nodeA, _ := setupNodesWithOptions(t, random, addressA, addressB, options)
+	nodeC, _ := setupNodesWithOptions(t, random, addressC, addressB, options)
+
+	nodeA.networkLayer.OnConnection(addressC)
+	nodeC.networkLayer.OnConnection(addressA)
+
+	// Node A relays the requests of C, which raises its difficulty
+	for range 2 {
+		nodeC.networkLayer.BroadcastRouteRequest()
+		nodeA.networkLayer.ReceivePacket(addressC, nodeC.dev.PopLastPacket())
+	}
+	assert.Equal(t, 17, nodeA.networkLayer.StampDifficulty())
+
+	// Requests sent by this node are stamped with at most 16 bits, such that minting does not block for long
+	nodeA.dev.PacketsSent = [][]byte{}
+	nodeA.networkLayer.BroadcastRouteRequest()
+	packets := networkPackets(t, nodeA.dev.PacketsSent)
+	assert.Len(t, packets, 1)
+	rreq, err := network_layer.DecodeRREQ(packets[0])
+	assert.NoError(t, err)
+	assert.Equal(t, byte(16), rreq.Stamp[0])
+}
+
+func TestNeighbourQuarantine(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+
+	options := device.DefaultProtocolOptions()
+	options.ReputationThreshold = 30
+	nodeA, nodeB := setupNodesWithOptions(t, random, addressA, addressB, options)
+
+	nodeA.networkLayer.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressA)
+
+	nodeA.networkLayer.BroadcastRouteRequest()
+	rreq := nodeA.dev.PopLastPacket()
+	nodeB.networkLayer.ReceivePacket(addressA, rreq)
+	nodeB.dev.PopLastPacket()
+	assert.Zero(t, nodeB.networkLayer.Reputation(addressA))
+
+	// Packet types of newer protocol versions are not misbehaviour
+	nodeB.networkLayer.ReceivePacket(addressA, reframePacket(rreq, []byte{0xF0, 0x01, 0x02}))
+	assert.Zero(t, nodeB.networkLayer.Reputation(addressA))
+
+	// Sending the same route request again is misbehaviour
+	for i := 0; i < 5; i++ {
+		nodeB.networkLayer.ReceivePacket(addressA, rreq)
+	}
+	assert.InDelta(t, 25, nodeB.networkLayer.Reputation(addressA), 0.01)
+	assert.False(t, nodeB.networkLayer.Quarantined(addressA))
+
+	// Scores decay over time
+	nodeB.dev.TimeOffset = 10 * time.Minute
+	assert.InDelta(t, 12.5, nodeB.networkLayer.Reputation(addressA), 0.01)
+
+	for i := 0; i < 4; i++ {
+		nodeB.networkLayer.ReceivePacket(addressA, rreq)
+	}
+	assert.True(t, nodeB.networkLayer.Quarantined(addressA))
+	assert.Equal(t, []device.DeviceAddress{addressA}, nodeB.dev.QuarantinedPeers)
+
+	// Route requests from a quarantined neighbour are ignored
+	nodeA.networkLayer.BroadcastRouteRequest()
+	rreq = nodeA.dev.PopLastPacket()
+	nodeB.networkLayer.ReceivePacket(addressA, rreq)
+	assert.Empty(t, nodeB.dev.PacketsSent)
+
+	// The quarantine ends after QuarantineDuration
+	nodeB.dev.TimeOffset += options.QuarantineDuration
+	assert.False(t, nodeB.networkLayer.Quarantined(addressA))
+	nodeB.networkLayer.ReceivePacket(addressA, rreq)
+	assert.NotEmpty(t, nodeB.dev.PacketsSent)
+}
+
+func TestReputationsForgotten(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := device.DefaultProtocolOptions()
+	options.ReputationThreshold = 30
+	node, _ := setupNodesWithOptions(t, random, "1000", "2000", options)
+
+	node.networkLayer.ReportMisbehaviour("3000", network_layer.MisbehaviourDuplicateRREQ)
+	node.networkLayer.ReportMisbehaviour("4000", network_layer.MisbehaviourForgedRERR)
+	node.networkLayer.ReportMisbehaviour("4000", network_layer.MisbehaviourForgedRERR)
+	assert.True(t, node.networkLayer.Quarantined("4000"))
+	assert.Equal(t, 2, node.networkLayer.ReputationEntries())
+
+	// Neighbours are forgotten once their score has decayed, but not while they are quarantined
+	node.dev.TimeOffset = 50 * time.Minute
+	node.networkLayer.ReportMisbehaviour("5000", network_layer.MisbehaviourDuplicateRREQ)
+	assert.Equal(t, 2, node.networkLayer.ReputationEntries())
+	assert.True(t, node.networkLayer.Quarantined("4000"))
+
+	node.dev.TimeOffset = 2 * time.Hour
+	node.networkLayer.ReportMisbehaviour("6000", network_layer.MisbehaviourDuplicateRREQ)
+	assert.Equal(t, 1, node.networkLayer.ReputationEntries())
+	assert.Zero(t, node.networkLayer.Reputation("4000"))
+}
+
+func TestRelayPolicies(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressR := device.DeviceAddress("3000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+
+	options := *device.DefaultProtocolOptions()
+	options.DisableAutoRREQOnConnection = true
+	devR := testutils.NewDeviceMock(t, random)
+	netEventsR := newMockNetEvents(devR)
+	relay := network_layer.NewNetworkLayer(devR, netEventsR, options)
+
+	nodeA.networkLayer.OnConnection(addressR)
+	relay.OnConnection(addressA)
+	relay.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressR)
+
+	// Route requests are not forwarded when the TTL is rewritten to zero
+	maxTTL := network_layer.NewMaxTTLPolicy(0)
+	relay.AddPolicy(maxTTL)
+	nodeA.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Empty(t, devR.PacketsSent)
+	relay.RemovePolicy(maxTTL)
+
+	// Route replies are not relayed to or from unknown neighbours
+	known := network_layer.NewKnownNeighboursPolicy(func(address device.DeviceAddress) bool { return address == addressA })
+	relay.AddPolicy(known)
+	nodeA.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	relay.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	assert.Empty(t, devR.PacketsSent)
+	relay.RemovePolicy(known)
+
+	nodeA.networkLayer.BroadcastRouteRequest()
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	relay.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	nodeA.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+
+	sessions := nodeA.networkLayer.AllSessions(nodeA.contact)
+	assert.Len(t, sessions, 1)
+
+	// relayHello sends a SESS packet of 47 bytes through the relay, and reports whether it was relayed
+	relayHello := func() bool {
+		assert.NoError(t, nodeA.networkLayer.SendData(sessions[0], []byte("hello")))
+		relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+		if len(devR.PacketsSent) == 0 {
+			return false
+		}
+		assert.Len(t, nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket()), 1)
+		return true
+	}
+
+	// Relayed SESS packets are dropped above the rate limit, once the bucket has gone into debt
+	rateLimit := network_layer.NewRelayRateLimitPolicy(50)
+	relay.AddPolicy(rateLimit)
+	assert.True(t, relayHello())
+	assert.True(t, relayHello())
+	assert.False(t, relayHello())
+
+	devR.TimeOffset = time.Second
+	assert.True(t, relayHello())
+	relay.RemovePolicy(rateLimit)
+
+	// Packets larger than the rate are relayed whenever the bucket is not empty
+	relay.AddPolicy(network_layer.NewRelayRateLimitPolicy(20))
+	assert.True(t, relayHello())
+	assert.False(t, relayHello())
+
+	devR.TimeOffset += 2 * time.Second
+	assert.True(t, relayHello())
+}
+
+func TestLeafOnly(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressL := device.DeviceAddress("3000")
+	addressP := device.DeviceAddress("4000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+
+	options := device.DefaultProtocolOptions()
+	options.LeafOnly = true
+	leaf, peer := setupNodesWithOptions(t, random, addressL, addressP, options)
+
+	// A and B are only connected through the leaf
+	nodeA.networkLayer.OnConnection(addressL)
+	leaf.networkLayer.OnConnection(addressA)
+	leaf.networkLayer.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressL)
+
+	// The leaf announces that it does not relay when connecting, since it may never send a route request
+	assert.Empty(t, nodeA.dev.PacketsSent)
+	for _, packet := range leaf.dev.PacketsSent {
+		caps, err := network_layer.DecodeRoutingPacket(packet[2:])
+		assert.NoError(t, err)
+		assert.Equal(t, network_layer.CapabilityLeafOnly, caps.(*network_layer.CAPSPacket).Capabilities)
+	}
+	assert.Len(t, leaf.dev.PacketsSent, 2)
+	nodeA.networkLayer.ReceivePacket(addressL, leaf.dev.PopLastPacket())
+	nodeB.networkLayer.ReceivePacket(addressL, leaf.dev.PopLastPacket())
+
+	nodeA.networkLayer.BroadcastRouteRequest()
+	leaf.networkLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Empty(t, leaf.dev.PacketsSent)
+
+	// The leaf announces that it does not relay in its own route requests
+	leaf.networkLayer.OnConnection(addressP)
+	peer.networkLayer.OnConnection(addressL)
+	peer.networkLayer.ReceivePacket(addressL, leaf.dev.PopLastPacket())
+	leaf.networkLayer.BroadcastRouteRequest()
+	rreqBytes := leaf.dev.PopLastPacket()
+	rreq, err := network_layer.DecodeRoutingPacket(rreqBytes[2:])
+	assert.NoError(t, err)
+	assert.Equal(t, network_layer.CapabilityLeafOnly, rreq.(*network_layer.RREQPacket).Capabilities)
+
+	// The capabilities are replaced by those of the node forwarding the request
+	nodeA.networkLayer.OnConnection(addressB)
+	nodeA.networkLayer.ReceivePacket(addressL, rreqBytes)
+	forwarded, err := network_layer.DecodeRoutingPacket(nodeA.dev.PopLastPacket()[2:])
+	assert.NoError(t, err)
+	assert.Zero(t, forwarded.(*network_layer.RREQPacket).Capabilities)
+
+	// The leaf still establishes its own sessions
+	peer.networkLayer.ReceivePacket(addressL, rreqBytes)
+	leaf.networkLayer.ReceivePacket(addressP, peer.dev.PopLastPacket())
+	assert.Len(t, leaf.networkLayer.AllSessions(leaf.contact), 1)
+}
+
+func TestRelaySessionRate(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	addressR := device.DeviceAddress("3000")
+	nodeA, nodeB := setupNodes(t, random, addressA, addressB)
+
+	options := *device.DefaultProtocolOptions()
+	options.DisableAutoRREQOnConnection = true
+	options.RelaySessionRate = 100
+	options.RelayQueueSize = 2
+	devR := testutils.NewDeviceMock(t, random)
+	netEventsR := newMockNetEvents(devR)
+	relay := network_layer.NewNetworkLayer(devR, netEventsR, options)
+
+	nodeA.networkLayer.OnConnection(addressR)
+	relay.OnConnection(addressA)
+	relay.OnConnection(addressB)
+	nodeB.networkLayer.OnConnection(addressR)
+
+	// Two sessions between A and B, both relayed by R
+	for range 2 {
+		nodeA.networkLayer.BroadcastRouteRequest()
+		relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+		nodeB.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	}
+	for range 2 {
+		relay.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+		nodeA.networkLayer.ReceivePacket(addressR, devR.PopLastPacket())
+	}
+	sessions := nodeA.networkLayer.AllSessions(nodeA.contact)
+	assert.Len(t, sessions, 2)
+
+	// The heavy session sends 6 packets of 47 bytes, of which 3 fit in its bucket, 2 are queued and 1 is dropped
+	for range 6 {
+		assert.NoError(t, nodeA.networkLayer.SendData(sessions[0], []byte("hello")))
+		packet := nodeA.dev.PopLastPacket()
+		assert.Len(t, packet, 2+47)
+		relay.ReceivePacket(addressA, packet)
+	}
+	assert.Len(t, devR.PacketsSent, 3)
+
+	// The other session is not affected
+	assert.NoError(t, nodeA.networkLayer.SendData(sessions[1], []byte("hello")))
+	relay.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, devR.PacketsSent, 4)
+
+	// The queue is drained once the bucket has been refilled
+	devR.ExecuteNextDelayAction()
+	assert.Len(t, devR.PacketsSent, 4)
+	devR.TimeOffset = time.Second
+	devR.ExecuteNextDelayAction()
+	assert.Len(t, devR.PacketsSent, 6)
+	assert.Empty(t, devR.DelayActions)
+
+	messages := 0
+	for _, packet := range devR.PacketsSent {
+		messages += len(nodeB.networkLayer.ReceivePacket(addressR, packet))
+	}
+	assert.Equal(t, 6, messages)
+}
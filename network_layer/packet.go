@@ -9,6 +9,7 @@ const (
 	RREP PacketType = 0x02
 	SESS PacketType = 0x03
 	RERR PacketType = 0x04
+	CAPS PacketType = 0x05
 )
 
 type Packet interface {
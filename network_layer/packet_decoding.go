@@ -4,6 +4,9 @@ import (
 	"errors"
 )
 
+// errUnknownPacketType is returned for packets of types which may have been introduced by a newer version of the protocol.
+var errUnknownPacketType = errors.New("invalid network packet type")
+
 func DecodeRoutingPacket(data []byte) (Packet, error) {
 	var packet_type = PacketType(data[0])
 
@@ -16,7 +19,9 @@ func DecodeRoutingPacket(data []byte) (Packet, error) {
 		return DecodeRERR(data)
 	case SESS:
 		return DecodeSESS(data)
+	case CAPS:
+		return DecodeCAPS(data)
 	default:
-		return nil, errors.New("invalid network packet type")
+		return nil, errUnknownPacketType
 	}
 }
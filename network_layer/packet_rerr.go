@@ -1,6 +1,7 @@
 package network_layer
 
 import (
+	"crypto/ed25519"
 	"fmt"
 
 	"github.com/starling-protocol/starling/device"
@@ -8,12 +9,17 @@ import (
 )
 
 type RERRPacket struct {
+	// SessionID is the label of the session on the link the packet is sent on.
 	SessionID device.SessionID
+	// Token is the signature of the label with the teardown key of the sender on the link, see teardownToken.
+	// It is left out by older nodes, which did not commit to a token.
+	Token []byte
 }
 
-func NewRERR(sessionID device.SessionID) *RERRPacket {
+func NewRERR(sessionID device.SessionID, token []byte) *RERRPacket {
 	return &RERRPacket{
 		SessionID: sessionID,
+		Token:     token,
 	}
 }
 
@@ -26,6 +32,7 @@ func (p *RERRPacket) EncodePacket() []byte {
 	buf = append(buf, byte(RERR))
 
 	buf = EncodeSessionID(p.SessionID, buf)
+	buf = appendExtensions(buf, extension{typ: extensionTeardown, value: p.Token})
 	return buf
 }
 
@@ -38,14 +45,35 @@ func DecodeRERR(buf []byte) (*RERRPacket, error) {
 		return nil, fmt.Errorf("wrong packet header when decoding RERR packet: %d", buf[0])
 	}
 
-	return NewRERR(DecodeSessionID(buf[1:])), nil
+	extensions, err := decodeExtensions(buf[9:])
+	if err != nil {
+		return nil, fmt.Errorf("decoding RERR extensions: %w", err)
+	}
+	token, err := fixedExtension(extensions, extensionTeardown, ed25519.SignatureSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRERR(DecodeSessionID(buf[1:]), token), nil
 }
 
 func (network *NetworkLayer) handleRouteErrorPacket(rerr RERRPacket, sender device.DeviceAddress) {
-	sessID := rerr.SessionID
-	entry, found := network.sessionTable[sessID]
+	if allowed, _ := network.evaluatePolicies(PolicyPacket{Type: RERR, Sender: sender, Size: len(rerr.EncodePacket())}); !allowed {
+		return
+	}
+
+	entry, found := network.sessionByLabel(sender, rerr.SessionID)
 	if !found {
-		network.logf("packet:rerr:receive:session_not_found:error:%d", sessID)
+		network.logf("packet:rerr:receive:session_not_found:error:%d", rerr.SessionID)
+		return
+	}
+	sessID := entry.SessionID
+
+	// Older nodes do not commit to a teardown token, so their route errors cannot be authenticated
+	if commitment := entry.commitment(sender); commitment != nil && !verifyTeardownToken(commitment, rerr.SessionID, rerr.Token) {
+		network.logf("packet:rerr:forged:%s 'teardown token does not match commitment'", sender)
+		network.forgedRouteErrors++
+		network.ReportMisbehaviour(sender, MisbehaviourForgedRERR)
 		return
 	}
 
@@ -57,17 +85,30 @@ func (network *NetworkLayer) handleRouteErrorPacket(rerr RERRPacket, sender devi
 		network.SessionBroken(sessID, &sender)
 	} else {
 		if sender == *entry.SourceNeighbour {
-			network.sendRouteError(*entry.TargetNeighbour, sessID)
+			network.sendRouteError(entry, *entry.TargetNeighbour)
 		} else if sender == *entry.TargetNeighbour {
-			network.sendRouteError(*entry.SourceNeighbour, sessID)
+			network.sendRouteError(entry, *entry.SourceNeighbour)
 		}
 
-		delete(network.sessionTable, sessID)
+		network.removeSession(sessID)
 	}
 }
 
-func (network *NetworkLayer) sendRouteError(targetAddr device.DeviceAddress, sessID device.SessionID) {
-	packet := NewRERR(sessID)
+// sendRouteError tells the neighbour that the session is broken, using the label of the session on its link.
+func (network *NetworkLayer) sendRouteError(session *SessionTableEntry, targetAddr device.DeviceAddress) {
+	label, found := session.label(targetAddr)
+	if !found {
+		network.logf("packet:rerr:send:error:%s 'neighbour is not part of the session'", targetAddr)
+		return
+	}
+
+	teardownKey := session.teardownKey(targetAddr)
+	if teardownKey == nil {
+		network.logf("packet:rerr:send:error:%s 'no teardown key for neighbour'", targetAddr)
+		return
+	}
+
+	packet := NewRERR(label, teardownToken(teardownKey, label))
 	network.logf("packet:rerr:send:%s", targetAddr)
 	network.packetLayer.SendBytes(targetAddr, packet.EncodePacket())
 }
@@ -87,11 +128,11 @@ func (network *NetworkLayer) handleDisconnect(failedNode device.DeviceAddress) {
 
 			// Make sure to send error packet the correct direction if applicable
 			if source == failedNode {
-				network.sendRouteError(target, entry.SessionID)
-				delete(network.sessionTable, sessID)
+				network.sendRouteError(entry, target)
+				network.removeSession(sessID)
 			} else if target == failedNode {
-				network.sendRouteError(source, entry.SessionID)
-				delete(network.sessionTable, sessID)
+				network.sendRouteError(entry, source)
+				network.removeSession(sessID)
 			}
 		}
 	}
@@ -1,9 +1,9 @@
 package network_layer
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/mlkem"
 	"encoding/binary"
 	"fmt"
 
@@ -11,12 +11,20 @@ import (
 )
 
 type RREPPacket struct {
-	RequestID    RequestID
+	RequestID RequestID
+	// SessionID is the label of the session on the link the packet is sent on.
 	SessionID    device.SessionID
 	EphemeralKey ecdh.PublicKey
-	Nonce        []byte
+	// TeardownCommitment is set by every node sending the RREP, see newTeardownKey.
+	// It is nil for older nodes, whose route errors are then accepted without a token.
+	TeardownCommitment []byte
+	Nonce              []byte
 	// Cipher contains the authentication tag as well as some optional payload
 	Cipher []byte
+	// KEMCiphertext is the optional ML-KEM ciphertext of the responder, see encapsulateKEMSecret.
+	KEMCiphertext []byte
+	// CipherSuite is the cipher suite chosen by the responder. It is left out of the packet for AES-GCM.
+	CipherSuite device.CipherSuite
 }
 
 func EncodeRREPHeader(reqID RequestID, sessID device.SessionID, ephemeralKey ecdh.PublicKey) []byte {
@@ -27,7 +35,23 @@ func EncodeRREPHeader(reqID RequestID, sessID device.SessionID, ephemeralKey ecd
 	return buf
 }
 
-func (network *NetworkLayer) NewRREP(reqID RequestID, sessID device.SessionID, sessionSecret []byte, ownEphemeralPublicKey ecdh.PublicKey, payload []byte) (*RREPPacket, error) {
+// rrepAssociatedData is authenticated along with the RREP payload.
+// It leaves out the session label, since it is rewritten by every intermediary node.
+// Nodes of the original protocol authenticate the RREP header including the session ID instead,
+// so intermediary nodes leave the label of a KeyDerivationV1 session unchanged.
+func rrepAssociatedData(version KeyDerivationVersion, reqID RequestID, sessID device.SessionID, ephemeralKey ecdh.PublicKey, kemCiphertext []byte) []byte {
+	if version < KeyDerivationV2 {
+		return EncodeRREPHeader(reqID, sessID, ephemeralKey)
+	}
+
+	buf := []byte{byte(RREP)}
+	buf = reqID.Encode(buf)
+	buf = append(buf, ephemeralKey.Bytes()...)
+	buf = append(buf, kemCiphertext...)
+	return buf
+}
+
+func (network *NetworkLayer) NewRREP(reqID RequestID, sessID device.SessionID, sessionSecret []byte, ownEphemeralPublicKey ecdh.PublicKey, kemCiphertext []byte, suite device.CipherSuite, version KeyDerivationVersion, payload []byte) (*RREPPacket, error) {
 	cryptoRand := network.dev.CryptoRand()
 
 	nonce := make([]byte, 12)
@@ -35,25 +59,26 @@ func (network *NetworkLayer) NewRREP(reqID RequestID, sessID device.SessionID, s
 		return nil, err
 	}
 
-	aesCipher, err := aes.NewCipher(sessionSecret)
+	aead, err := newSessionAEAD(suite, sessionSecret)
 	if err != nil {
 		return nil, err
 	}
 
-	aesgcm, err := cipher.NewGCM(aesCipher)
-	if err != nil {
-		return nil, err
+	if paddingNegotiated(version) {
+		payload = padPayload(payload, network.options.PaddingBuckets)
 	}
 
-	headers := EncodeRREPHeader(reqID, sessID, ownEphemeralPublicKey)
-	cipher := aesgcm.Seal(nil, nonce, payload, headers)
+	headers := rrepAssociatedData(version, reqID, sessID, ownEphemeralPublicKey, kemCiphertext)
+	cipher := aead.Seal(nonce, payload, headers)
 
 	return &RREPPacket{
-		RequestID:    reqID,
-		SessionID:    sessID,
-		EphemeralKey: ownEphemeralPublicKey,
-		Nonce:        nonce,
-		Cipher:       cipher,
+		RequestID:     reqID,
+		SessionID:     sessID,
+		EphemeralKey:  ownEphemeralPublicKey,
+		Nonce:         nonce,
+		Cipher:        cipher,
+		KEMCiphertext: kemCiphertext,
+		CipherSuite:   suite,
 	}, nil
 }
 
@@ -94,6 +119,15 @@ func (p *RREPPacket) EncodePacket() []byte {
 	buf = append(buf, p.Nonce...)
 	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.Cipher)-16))
 	buf = append(buf, p.Cipher...)
+	suite := extension{typ: extensionCipherSuite}
+	if p.CipherSuite != device.CipherSuiteAESGCM {
+		suite.value = []byte{byte(p.CipherSuite)}
+	}
+	buf = appendExtensions(buf,
+		extension{typ: extensionTeardown, value: p.TeardownCommitment},
+		extension{typ: extensionKEM, value: p.KEMCiphertext},
+		suite,
+	)
 
 	return buf
 }
@@ -121,12 +155,35 @@ func DecodeRREP(buf []byte) (*RREPPacket, error) {
 
 	cipher := buf[65 : 65+payloadSize+16]
 
+	extensions, err := decodeExtensions(buf[65+payloadSize+16:])
+	if err != nil {
+		return nil, fmt.Errorf("decoding RREP extensions: %w", err)
+	}
+	commitment, err := fixedExtension(extensions, extensionTeardown, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	kemCiphertext, err := fixedExtension(extensions, extensionKEM, mlkem.CiphertextSize768)
+	if err != nil {
+		return nil, err
+	}
+
+	suite := device.CipherSuiteAESGCM
+	if suiteExtension, err := fixedExtension(extensions, extensionCipherSuite, 1); err != nil {
+		return nil, err
+	} else if suiteExtension != nil {
+		suite = device.CipherSuite(suiteExtension[0])
+	}
+
 	return &RREPPacket{
-		RequestID:    reqID,
-		SessionID:    sessID,
-		EphemeralKey: *ephemeralKey,
-		Nonce:        nonce,
-		Cipher:       cipher,
+		RequestID:          reqID,
+		SessionID:          sessID,
+		EphemeralKey:       *ephemeralKey,
+		TeardownCommitment: commitment,
+		Nonce:              nonce,
+		Cipher:             cipher,
+		KEMCiphertext:      kemCiphertext,
+		CipherSuite:        suite,
 	}, nil
 }
 
@@ -135,15 +192,13 @@ func (network *NetworkLayer) forwardRouteReply(rrep RREPPacket, session *Session
 	successful := network.packetLayer.SendBytes(*session.SourceNeighbour, rrep.EncodePacket())
 	if !successful {
 		if session.TargetNeighbour != nil {
-			network.sendRouteError(*session.TargetNeighbour, session.SessionID)
+			network.sendRouteError(session, *session.TargetNeighbour)
 		}
 		network.SessionBroken(session.SessionID, session.SourceNeighbour)
 	}
 }
 
 func (network *NetworkLayer) handleRouteReply(rrep RREPPacket, sender device.DeviceAddress) {
-	random := network.dev.Rand()
-
 	request, reqFound := network.requestTable[rrep.RequestID]
 	if !reqFound {
 		network.logf("Received unknown route reply with request id: %v", rrep.RequestID)
@@ -153,8 +208,27 @@ func (network *NetworkLayer) handleRouteReply(rrep RREPPacket, sender device.Dev
 	network.logf("packet:rrep:receive:%s", sender)
 
 	if request.SourceNeighbour == nil {
+		if request.EphemeralPrivateKey != nil && network.dev.Now().Sub(request.created) >= network.options.EphemeralKeyLifetime {
+			request.discardEphemeralKeys()
+		}
+		if request.EphemeralPrivateKey == nil {
+			network.logf("packet:rrep:request_completed:%d 'ephemeral keys have been discarded'", rrep.RequestID)
+			return
+		}
+
+		var kemSecret []byte
+		if rrep.KEMCiphertext != nil {
+			var err error
+			kemSecret, err = decapsulateKEMSecret(request.kemKey, rrep.KEMCiphertext)
+			if err != nil {
+				network.logf("packet:rrep:kem:error '%v'", err)
+				return
+			}
+			defer clear(kemSecret)
+		}
 
-		headers := EncodeRREPHeader(rrep.RequestID, rrep.SessionID, rrep.EphemeralKey)
+		ephemeral := request.EphemeralPrivateKey.Bytes()
+		defer clear(ephemeral)
 
 		// Precompute ephemeral secret
 		// ephemeralSecret, err := request.EphemeralPrivateKey.ECDH(&rrep.EphemeralKey)
@@ -163,44 +237,118 @@ func (network *NetworkLayer) handleRouteReply(rrep RREPPacket, sender device.Dev
 		// 	return
 		// }
 
+		if request.kemKey != nil && rrep.KEMCiphertext == nil {
+			// Responders always reply with a ciphertext, so the encapsulation key was stripped or the responder is an older node
+			network.logf("packet:rrep:kem:missing:%d 'route reply without KEM ciphertext'", rrep.RequestID)
+			return
+		}
+		var kemKey []byte
+		if rrep.KEMCiphertext != nil {
+			kemKey = request.kemKey.EncapsulationKey().Bytes()
+		}
+
+		// Only the version offered in the RREQ is accepted, since a relay could otherwise
+		// strip it from the RREQ to make the responder fall back to an older version
+		version := request.keyDerivation
+		transcript := SessionTranscript(version, rrep.RequestID, request.cipherSuite, rrep.CipherSuite, *request.EphemeralPrivateKey.PublicKey(), rrep.EphemeralKey, kemKey, rrep.KEMCiphertext)
+		headers := rrepAssociatedData(version, rrep.RequestID, rrep.SessionID, rrep.EphemeralKey, rrep.KEMCiphertext)
+
 		contacts := network.dev.ContactsContainer().AllLinks()
 		contacts = append(contacts, network.dev.ContactsContainer().AllGroups()...)
 
 		for _, contact := range contacts {
-			sessionSecret, err := SessionSecret(network.dev.ContactsContainer(), contact, request.EphemeralPrivateKey.Bytes(), rrep.EphemeralKey.Bytes())
+			keys, err := DeriveSessionKeys(version, network.dev.ContactsContainer(), contact, ephemeral, rrep.EphemeralKey.Bytes(), kemSecret, transcript)
 			if err != nil {
 				network.logf("packet:rrep:compute_session_secret:error '%v'", err)
 				return
 			}
 
-			aesCipher, err := aes.NewCipher(sessionSecret)
+			aead, err := newSessionAEAD(rrep.CipherSuite, keys.ReplyKey)
 			if err != nil {
 				network.logf("packet:rrep:cipher:error '%v'", err)
 				return
 			}
 
-			aesgcm, err := cipher.NewGCM(aesCipher)
+			payload, err := aead.Open(rrep.Nonce, rrep.Cipher, headers)
 			if err != nil {
-				network.logf("packet:rrep:cipher:error '%v'", err)
-				return
+				keys.wipe()
+				continue
 			}
 
-			payload, err := aesgcm.Open(nil, rrep.Nonce, rrep.Cipher, headers)
-			if err != nil {
-				continue
+			if paddingNegotiated(version) {
+				payload, err = unpadPayload(payload)
+				if err != nil {
+					keys.wipe()
+					network.logf("packet:rrep:padding:error '%v'", err)
+					return
+				}
 			}
 
-			session := SessionEntryFromRREP(random, &contact, *request, rrep, &sender, sessionSecret)
-			network.sessionTable[rrep.SessionID] = &session
+			sessionID := keys.SessionID
+			if version < KeyDerivationV2 {
+				sessionID = rrep.SessionID
+			}
+
+			session := SessionEntryFromRREP(&contact, *request, rrep, &sender, sessionID, 0, keys)
+			session.cipherSuite = rrep.CipherSuite
+			keys.wipe()
+			if err := network.addSession(&session); err != nil {
+				session.keys.wipe()
+				network.logf("packet:rrep:add_session:error '%v'", err)
+				return
+			}
+			request.replyProcessed()
 
-			network.logf("packet:rrep:session_established:%s:%d", contact, session.SessionID)
+			network.logf("packet:rrep:session_established:%s:%d:%d", contact, session.SessionID, keys.Version)
 			network.SessionEstablished(contact, session.SessionID, sender, payload, true)
-			break
+			return
 		}
 	} else {
-		session := SessionEntryFromRREP(random, nil, *request, rrep, &sender, nil)
-		network.sessionTable[rrep.SessionID] = &session
+		if network.options.LeafOnly {
+			network.logf("packet:rrep:leaf_only:%d 'not relaying route reply'", rrep.RequestID)
+			return
+		}
+
+		// Refuse to relay sessions through quarantined neighbours
+		if network.Quarantined(sender) || network.Quarantined(*request.SourceNeighbour) {
+			network.logf("packet:rrep:quarantined:%s:%d 'not relaying route reply'", sender, rrep.RequestID)
+			return
+		}
+
+		if allowed, _ := network.evaluatePolicies(PolicyPacket{Type: RREP, Sender: sender, Target: *request.SourceNeighbour, Size: len(rrep.EncodePacket())}); !allowed {
+			return
+		}
+
+		sessionID, err := newSessionLabel(network.dev.CryptoRand())
+		if err != nil {
+			network.logf("packet:rrep:forward:error '%v'", err)
+			return
+		}
+		label := rrep.SessionID
+		if request.keyDerivation >= KeyDerivationV2 {
+			label, err = newSessionLabel(network.dev.CryptoRand())
+			if err != nil {
+				network.logf("packet:rrep:forward:error '%v'", err)
+				return
+			}
+		}
 
+		session := SessionEntryFromRREP(nil, *request, rrep, &sender, sessionID, label, nil)
+		if err := network.addSession(&session); err != nil {
+			network.logf("packet:rrep:add_session:error '%v'", err)
+			return
+		}
+
+		// Forward the reply with the label and teardown commitment of the link towards the source
+		teardownKey, commitment, err := newTeardownKey(network.dev.CryptoRand())
+		if err != nil {
+			network.logf("packet:rrep:forward:error '%v'", err)
+			network.removeSession(session.SessionID)
+			return
+		}
+		session.sourceTeardownKey = teardownKey
+		rrep.SessionID = session.SourceLabel
+		rrep.TeardownCommitment = commitment
 		network.forwardRouteReply(rrep, &session)
 	}
 }
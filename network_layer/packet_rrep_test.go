@@ -26,10 +26,10 @@ func newRREP(t testing.TB, random *rand.Rand, reqID network_layer.RequestID, ses
 	otherEphemeralPrivateKey, err := ecdh.X25519().GenerateKey(dev.CryptoRand())
 	assert.NoError(t, err)
 
-	sessionSecret, err := network_layer.SessionSecret(dev.Contacts, contact, ownEphemeralPrivateKey.Bytes(), otherEphemeralPrivateKey.PublicKey().Bytes())
+	sessionSecret, err := network_layer.SessionSecret(dev.Contacts, contact, ownEphemeralPrivateKey.Bytes(), otherEphemeralPrivateKey.PublicKey().Bytes(), nil)
 	assert.NoError(t, err)
 
-	rrep, err := network.NewRREP(reqID, sessID, sessionSecret, *ownEphemeralPrivateKey.PublicKey(), payload)
+	rrep, err := network.NewRREP(reqID, sessID, sessionSecret, *ownEphemeralPrivateKey.PublicKey(), nil, device.CipherSuiteAESGCM, network_layer.LatestKeyDerivation, payload)
 	assert.NoError(t, err)
 
 	return rrep
@@ -52,11 +52,12 @@ func FuzzCodingRREP(f *testing.F) {
 		assert.Equal(t, reqID, rrep.RequestID)
 		assert.Equal(t, sessID, rrep.SessionID)
 		assert.Equal(t, *ephemeralPrivate.PublicKey(), rrep.EphemeralKey)
-		assert.Len(t, rrep.Cipher, 16+len(payload))
+		// The payload is followed by the padding marker
+		assert.Len(t, rrep.Cipher, 16+len(payload)+1)
 		assert.Len(t, rrep.Nonce, 12)
 
 		encoded := rrep.EncodePacket()
-		assert.Len(t, encoded, 65+len(payload)+16)
+		assert.Len(t, encoded, 65+len(payload)+1+16)
 
 		decoded, err := network_layer.DecodeRREP(encoded)
 		assert.NoError(t, err, "failed to decode RREP packet")
@@ -1,10 +1,14 @@
 package network_layer
 
 import (
+	"bytes"
 	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/mlkem"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/starling-protocol/starling/device"
 	"github.com/starling-protocol/starling/network_layer/contact_bitmap"
@@ -27,6 +31,20 @@ type RREQPacket struct {
 	TTL          TTL
 	EphemeralKey ecdh.PublicKey
 	ContactMask  contact_bitmap.ContactBitmap
+	// TeardownCommitment is set by every node sending the RREQ, see newTeardownKey.
+	// It is nil for older nodes, whose route errors are then accepted without a token.
+	TeardownCommitment []byte
+	// KEMKey is the optional ML-KEM encapsulation key of the initiator, see newKEMKey.
+	KEMKey []byte
+	// KeyDerivation is the highest key derivation version supported by the initiator.
+	// It is left out of the packet for KeyDerivationV1, which older nodes assume.
+	KeyDerivation KeyDerivationVersion
+	// CipherSuite is the cipher suite preferred by the initiator, or zero for older nodes which only support AES-GCM.
+	CipherSuite device.CipherSuite
+	// Stamp is the optional proof-of-work stamp of the initiator, which states its difficulty, see mintStamp.
+	Stamp []byte
+	// Capabilities are the capabilities of the node sending the RREQ, which are set by every node sending it.
+	Capabilities Capabilities
 }
 
 func NewRREQPacket(reqID RequestID, ttl TTL, ephemeralKey ecdh.PublicKey, contactMap contact_bitmap.ContactBitmap) *RREQPacket {
@@ -35,10 +53,11 @@ func NewRREQPacket(reqID RequestID, ttl TTL, ephemeralKey ecdh.PublicKey, contac
 	}
 
 	return &RREQPacket{
-		RequestID:    reqID,
-		TTL:          ttl,
-		EphemeralKey: ephemeralKey,
-		ContactMask:  contactMap,
+		RequestID:     reqID,
+		TTL:           ttl,
+		EphemeralKey:  ephemeralKey,
+		ContactMask:   contactMap,
+		KeyDerivation: KeyDerivationV1,
 	}
 }
 
@@ -53,6 +72,18 @@ func (packet *RREQPacket) EncodePacket() []byte {
 	buf = packet.TTL.Encode(buf)
 	buf = append(buf, packet.EphemeralKey.Bytes()...)
 	buf = append(buf, packet.ContactMask...)
+	keyDerivation := extension{typ: extensionKeyDerivation}
+	if packet.KeyDerivation > KeyDerivationV1 {
+		keyDerivation.value = []byte{byte(packet.KeyDerivation)}
+	}
+	buf = appendExtensions(buf,
+		extension{typ: extensionTeardown, value: packet.TeardownCommitment},
+		extension{typ: extensionKEM, value: packet.KEMKey},
+		keyDerivation,
+		byteExtension(extensionCipherSuite, byte(packet.CipherSuite)),
+		extension{typ: extensionStamp, value: packet.Stamp},
+		byteExtension(extensionCapabilities, byte(packet.Capabilities)),
+	)
 	return buf
 }
 
@@ -74,8 +105,37 @@ func DecodeRREQ(buf []byte) (*RREQPacket, error) {
 	}
 
 	contactMap := buf[43 : 43+contact_bitmap.BITMAP_SIZE]
+	rreq := NewRREQPacket(reqID, ttl, *ephemeralKey, contactMap)
 
-	return NewRREQPacket(reqID, ttl, *ephemeralKey, contactMap), nil
+	extensions, err := decodeExtensions(buf[43+contact_bitmap.BITMAP_SIZE:])
+	if err != nil {
+		return nil, fmt.Errorf("decoding RREQ extensions: %w", err)
+	}
+	if rreq.TeardownCommitment, err = fixedExtension(extensions, extensionTeardown, ed25519.PublicKeySize); err != nil {
+		return nil, err
+	}
+	if rreq.KEMKey, err = fixedExtension(extensions, extensionKEM, mlkem.EncapsulationKeySize768); err != nil {
+		return nil, err
+	}
+	if rreq.Stamp, err = fixedExtension(extensions, extensionStamp, rreqStampSize); err != nil {
+		return nil, err
+	}
+	if keyDerivation, err := fixedExtension(extensions, extensionKeyDerivation, 1); err != nil {
+		return nil, err
+	} else if keyDerivation != nil && KeyDerivationVersion(keyDerivation[0]) > KeyDerivationV1 {
+		rreq.KeyDerivation = KeyDerivationVersion(keyDerivation[0])
+	}
+	if suite, err := fixedExtension(extensions, extensionCipherSuite, 1); err != nil {
+		return nil, err
+	} else if suite != nil {
+		rreq.CipherSuite = device.CipherSuite(suite[0])
+	}
+	if capabilities, err := fixedExtension(extensions, extensionCapabilities, 1); err != nil {
+		return nil, err
+	} else if capabilities != nil {
+		rreq.Capabilities = Capabilities(capabilities[0])
+	}
+	return rreq, nil
 }
 
 func (network *NetworkLayer) BroadcastRouteRequest() {
@@ -102,21 +162,45 @@ func (network *NetworkLayer) SendRouteRequest(address device.DeviceAddress, ttl
 }
 
 func (network *NetworkLayer) handleRouteRequest(rreq RREQPacket, sender device.DeviceAddress) {
-	// TODO: Check if we are receiving too many RREQs, and should throttle
+	if network.Quarantined(sender) {
+		network.logf("packet:rreq:quarantined:%s:%d", sender, rreq.RequestID)
+		return
+	}
+
+	network.updateNeighbourCapabilities(sender, rreq.Capabilities)
 
 	// Check if we have seen this RREQ before
-	_, hasSeenRequestID := network.requestTable[rreq.RequestID]
+	request, hasSeenRequestID := network.requestTable[rreq.RequestID]
 	if hasSeenRequestID {
 		network.logf("packet:rreq:duplicate:%s:%d", sender, rreq.RequestID)
+		// Other neighbours may forward the same request, but a neighbour should only send it once
+		if request.SourceNeighbour != nil && *request.SourceNeighbour == sender {
+			network.ReportMisbehaviour(sender, MisbehaviourDuplicateRREQ)
+		}
+		return
+	}
+	if network.isCoverRequest(rreq.RequestID) {
+		network.logf("packet:rreq:duplicate:%s:%d", sender, rreq.RequestID)
+		return
+	}
+
+	// Check the stamp before doing any expensive work, and without remembering the request ID,
+	// such that a request with an invalid stamp cannot block a valid request with the same ID
+	if difficulty := network.options.RREQStampDifficulty; !verifyStamp(&rreq, difficulty) {
+		network.logf("packet:rreq:stamp:invalid:%s:%d:%d", sender, rreq.RequestID, difficulty)
+		network.ReportMisbehaviour(sender, MisbehaviourInvalidStamp)
 		return
 	}
+	network.countRouteRequest()
 
 	network.logf("packet:rreq:receive:%s:%d", sender, rreq.RequestID)
 
 	// Create table entry
 	networkTableEntry := &RequestTableEntry{
-		RequestID:       rreq.RequestID,
-		SourceNeighbour: &sender,
+		RequestID:        rreq.RequestID,
+		SourceNeighbour:  &sender,
+		keyDerivation:    rreq.KeyDerivation,
+		sourceCommitment: bytes.Clone(rreq.TeardownCommitment),
 	}
 	network.requestTable[rreq.RequestID] = networkTableEntry
 
@@ -132,11 +216,20 @@ func (network *NetworkLayer) handleRouteRequest(rreq RREQPacket, sender device.D
 		return
 	}
 
-	// We are a recipient and thus reply with a RREP
+	// We are a recipient and thus reply with a RREP, using the highest key derivation supported by both
+	version := min(rreq.KeyDerivation, LatestKeyDerivation)
+	if version < KeyDerivationV2 && !network.options.AllowLegacyKeyDerivation {
+		network.logf("packet:rreq:legacy_key_derivation:%d 'not replying to route request'", rreq.RequestID)
+		return
+	}
+
+	if network.options.RequireHybridKeyExchange && rreq.KEMKey == nil {
+		network.logf("packet:rreq:kem_required:%d 'not replying to route request'", rreq.RequestID)
+		return
+	}
+
 	for _, contactID := range decodedContacts {
 		// Create session
-		random := network.dev.Rand()
-
 		request := network.requestTable[rreq.RequestID]
 
 		ephemeralPrivate, err := ecdh.X25519().GenerateKey(network.dev.CryptoRand())
@@ -145,15 +238,47 @@ func (network *NetworkLayer) handleRouteRequest(rreq RREQPacket, sender device.D
 			return
 		}
 
-		sessionSecret, err := SessionSecret(network.dev.ContactsContainer(), contactID, ephemeralPrivate.Bytes(), rreq.EphemeralKey.Bytes())
+		var kemSecret, kemCiphertext []byte
+		if rreq.KEMKey != nil {
+			kemSecret, kemCiphertext, err = encapsulateKEMSecret(rreq.KEMKey)
+			if err != nil {
+				network.logf("packet:rreq:build_reply:error '%v'", err)
+				return
+			}
+		}
+
+		suite := negotiateCipherSuite(rreq.CipherSuite, network.options.CipherSuite)
+		transcript := SessionTranscript(version, rreq.RequestID, rreq.CipherSuite, suite, rreq.EphemeralKey, *ephemeralPrivate.PublicKey(), rreq.KEMKey, kemCiphertext)
+
+		ephemeral := ephemeralPrivate.Bytes()
+		keys, err := DeriveSessionKeys(version, network.dev.ContactsContainer(), contactID, ephemeral, rreq.EphemeralKey.Bytes(), kemSecret, transcript)
+		clear(ephemeral)
+		clear(kemSecret)
+		if err != nil {
+			network.logf("packet:rreq:build_reply:error '%v'", err)
+			return
+		}
+		label, err := newSessionLabel(network.dev.CryptoRand())
 		if err != nil {
+			keys.wipe()
 			network.logf("packet:rreq:build_reply:error '%v'", err)
 			return
 		}
 
-		sessionEntry := SessionEntryFromRREQ(random, &contactID, *request, &sender, sessionSecret)
-		sessionID := sessionEntry.SessionID
-		network.sessionTable[sessionID] = &sessionEntry
+		// Nodes of the original protocol use the label sent in the RREP as the session ID on every link
+		sessionID := keys.SessionID
+		if version < KeyDerivationV2 {
+			sessionID = label
+		}
+
+		sessionEntry := SessionEntryFromRREQ(&contactID, *request, &sender, sessionID, label, keys)
+		sessionEntry.cipherSuite = suite
+		if err := network.addSession(&sessionEntry); err != nil {
+			keys.wipe()
+			sessionEntry.keys.wipe()
+			network.logf("packet:rreq:build_reply:error '%v'", err)
+			continue
+		}
 
 		network.SessionEstablished(contactID, sessionID, sender, nil, false)
 
@@ -161,15 +286,27 @@ func (network *NetworkLayer) handleRouteRequest(rreq RREQPacket, sender device.D
 
 		rrep, err := network.NewRREP(
 			rreq.RequestID,
-			sessionID,
-			sessionSecret,
+			sessionEntry.SourceLabel,
+			keys.ReplyKey,
 			*ephemeralPrivate.PublicKey(),
+			kemCiphertext,
+			suite,
+			version,
 			payload,
 		)
+		keys.wipe()
+		if err != nil {
+			network.logf("packet:rreq:build_reply:error '%v'", err)
+			continue
+		}
+
+		teardownKey, commitment, err := newTeardownKey(network.dev.CryptoRand())
 		if err != nil {
 			network.logf("packet:rreq:build_reply:error '%v'", err)
 			continue
 		}
+		sessionEntry.sourceTeardownKey = teardownKey
+		rrep.TeardownCommitment = commitment
 
 		network.logf("packet:rreq:contact_match:%s:%d 'found known contact in rreq'", contactID, rreq.TTL)
 
@@ -182,6 +319,17 @@ func (network *NetworkLayer) handleRouteRequest(rreq RREQPacket, sender device.D
 }
 
 func (network *NetworkLayer) forwardRouteRequest(rreq RREQPacket, sender device.DeviceAddress) {
+	if network.options.LeafOnly {
+		network.logf("packet:rreq:leaf_only:%d 'not forwarding route request'", rreq.RequestID)
+		return
+	}
+
+	// Under load, only requests with a stamp of the current difficulty are forwarded
+	if difficulty := network.StampDifficulty(); !verifyStamp(&rreq, difficulty) {
+		network.logf("packet:rreq:stamp:below_load:%d:%d 'not forwarding route request'", rreq.RequestID, difficulty)
+		return
+	}
+
 	if rreq.TTL > TTL(network.options.MaxRREQTTL) {
 		rreq.TTL = TTL(network.options.MaxRREQTTL)
 	}
@@ -193,6 +341,27 @@ func (network *NetworkLayer) forwardRouteRequest(rreq RREQPacket, sender device.
 		return
 	}
 
+	allowed, ttl := network.evaluatePolicies(PolicyPacket{Type: RREQ, Sender: sender, TTL: rreq.TTL, Size: len(rreq.EncodePacket())})
+	if !allowed {
+		return
+	}
+	rreq.TTL = ttl
+	if rreq.TTL <= 0 {
+		network.log("packet:rreq:ttl_expired")
+		return
+	}
+
+	teardownKey, commitment, err := newTeardownKey(network.dev.CryptoRand())
+	if err != nil {
+		network.logf("packet:rreq:forward:error '%v'", err)
+		return
+	}
+	if request, found := network.requestTable[rreq.RequestID]; found {
+		request.teardownKey = teardownKey
+	}
+	rreq.TeardownCommitment = commitment
+	rreq.Capabilities = network.capabilities()
+
 	network.logf("packet:rreq:forward:%d:%d", rreq.RequestID, rreq.TTL)
 	network.BroadcastPacketExcept(&rreq, sender)
 }
@@ -239,11 +408,64 @@ func (network *NetworkLayer) buildRouteRequest(ttl TTL) (*RREQPacket, error) {
 		return nil, err
 	}
 
+	teardownKey, commitment, err := newTeardownKey(cryptoRand)
+	if err != nil {
+		return nil, err
+	}
+
+	network.expireEphemeralKeys()
+
 	requestTableEntry := NewRequestTableEntry(requestID, nil, ephemeralPrivate)
+	requestTableEntry.teardownKey = teardownKey
+	requestTableEntry.created = network.dev.Now()
+	requestTableEntry.pendingReplies = bitmapResult.ContactCount
+	requestTableEntry.groupRequest, err = network.bitmapContainsGroup(bitmapResult)
+	if err != nil {
+		return nil, err
+	}
+
+	rreq := NewRREQPacket(requestID, ttl, *ephemeralPrivate.PublicKey(), bitmapResult.Bitmap)
+	rreq.TeardownCommitment = commitment
+	rreq.KeyDerivation = LatestKeyDerivation
+	rreq.CipherSuite = network.options.CipherSuite
+	rreq.Capabilities = network.capabilities()
+	requestTableEntry.keyDerivation = rreq.KeyDerivation
+	requestTableEntry.cipherSuite = rreq.CipherSuite
+
+	if network.options.HybridKeyExchange || network.options.RequireHybridKeyExchange {
+		kemKey, err := newKEMKey(cryptoRand)
+		if err != nil {
+			return nil, err
+		}
+		requestTableEntry.kemKey = kemKey
+		rreq.KEMKey = kemKey.EncapsulationKey().Bytes()
+	}
+
+	if err := network.stampRouteRequest(rreq); err != nil {
+		return nil, err
+	}
+
 	network.requestTable[requestID] = &requestTableEntry
 
 	network.logf("packet:rreq:build:%d:%d:%d:%d", bitmapResult.ContactCount, len(allContacts), ttl, requestID)
-
-	rreq := NewRREQPacket(requestID, ttl, *ephemeralPrivate.PublicKey(), bitmapResult.Bitmap)
 	return rreq, nil
 }
+
+// bitmapContainsGroup reports whether any of the contacts encoded in the bitmap of a route request is a group.
+func (network *NetworkLayer) bitmapContainsGroup(bitmapResult *contact_bitmap.ContactBitmapEncoding) (bool, error) {
+	groups := network.dev.ContactsContainer().AllGroups()
+	if len(groups) == 0 {
+		return false, nil
+	}
+
+	contacts, err := contact_bitmap.DecodeContactBitmap(network.dev.Rand(), network.dev.ContactsContainer(), bitmapResult.Seed, bitmapResult.Bitmap)
+	if err != nil {
+		return false, err
+	}
+	for _, contact := range contacts {
+		if slices.Contains(groups, contact) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
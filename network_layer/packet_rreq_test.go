@@ -73,3 +73,46 @@ func FuzzDecodingRREQ(f *testing.F) {
 		})
 	})
 }
+
+func TestCodingRREQExtensions(t *testing.T) {
+	random := rand.New(rand.NewSource(1234))
+
+	bitmapResult, err := contact_bitmap.EncodeContactBitmap(random, []device.ContactID{}, device.NewMemoryContactsContainer(), 1)
+	assert.NoError(t, err)
+	ephemeralPrivate, err := ecdh.X25519().GenerateKey(random)
+	assert.NoError(t, err)
+	rreq := network_layer.NewRREQPacket(network_layer.RequestID(bitmapResult.Seed), network_layer.TTL(10), *ephemeralPrivate.PublicKey(), bitmapResult.Bitmap)
+	legacyLength := len(rreq.EncodePacket())
+
+	// Capabilities are kept without the newer key derivation version
+	rreq.Capabilities = network_layer.CapabilityLeafOnly
+	decoded, err := network_layer.DecodeRREQ(rreq.EncodePacket())
+	assert.NoError(t, err)
+	assert.Equal(t, rreq, decoded)
+
+	rreq.KeyDerivation = network_layer.KeyDerivationV2
+	rreq.CipherSuite = device.CipherSuiteXChaCha20Poly1305
+	rreq.Stamp = make([]byte, 9)
+	encoded := rreq.EncodePacket()
+	decoded, err = network_layer.DecodeRREQ(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, rreq, decoded)
+
+	// Extensions of unknown types are skipped
+	decoded, err = network_layer.DecodeRREQ(append(encoded, 0xff, 0x00, 0x02, 0xaa, 0xbb))
+	assert.NoError(t, err)
+	assert.Equal(t, rreq, decoded)
+
+	// Extensions of unknown versions are ignored
+	unknownVersion := append([]byte{}, encoded...)
+	unknownVersion[legacyLength] = 0xff
+	decoded, err = network_layer.DecodeRREQ(unknownVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, network_layer.KeyDerivationV1, decoded.KeyDerivation)
+	assert.Zero(t, decoded.Capabilities)
+	assert.Nil(t, decoded.Stamp)
+
+	// Truncated extensions are rejected
+	_, err = network_layer.DecodeRREQ(encoded[:len(encoded)-1])
+	assert.Error(t, err)
+}
@@ -1,17 +1,17 @@
 package network_layer
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 
 	"github.com/starling-protocol/starling/device"
 )
 
 type SESSPacket struct {
+	// SessionID is the label of the session on the link the packet is sent on.
 	SessionID device.SessionID
 	Nonce     []byte
 	Cipher    []byte
@@ -37,14 +37,51 @@ func newSessionMessage(sessionID device.SessionID, data []byte) *SessionMessage
 	}
 }
 
-func (network *NetworkLayer) NewSESSPacket(sessionID device.SessionID, data []byte) (*SESSPacket, error) {
-	cryptoRand := network.dev.CryptoRand()
+// SESS nonces consist of a direction bit and the key epoch followed by a counter,
+// such that the receiver knows which key to use and can drop replayed packets.
+// The nonce is authenticated by the cipher, so no part of it can be altered in transit.
+// Sessions with nodes of the original protocol use random nonces instead, see SessionTableEntry.legacy.
+const (
+	directionFromInitiator uint32 = 0
+	directionFromResponder uint32 = 1
+)
 
-	nonce := make([]byte, 12)
-	if _, err := cryptoRand.Read(nonce); err != nil {
-		return nil, err
+// sessionNonce returns the nonce of the SESS packet with the given counter sent in the direction.
+func sessionNonce(direction uint32, epoch uint32, counter uint64) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = binary.BigEndian.AppendUint32(nonce, direction<<31|epoch)
+	nonce = binary.BigEndian.AppendUint64(nonce, counter)
+	return nonce
+}
+
+// parseSessionNonce returns the direction, key epoch and counter of a SESS nonce.
+func parseSessionNonce(nonce []byte) (uint32, uint32, uint64) {
+	prefix := binary.BigEndian.Uint32(nonce[:4])
+	return prefix >> 31, prefix & maxEpoch, binary.BigEndian.Uint64(nonce[4:])
+}
+
+// sendDirection returns the direction of the SESS packets sent from this end of the session.
+func (s *SessionTableEntry) sendDirection() uint32 {
+	if s.initiator() {
+		return directionFromInitiator
 	}
+	return directionFromResponder
+}
+
+// receiveDirection returns the direction of the SESS packets received at this end of the session.
+func (s *SessionTableEntry) receiveDirection() uint32 {
+	if s.initiator() {
+		return directionFromResponder
+	}
+	return directionFromInitiator
+}
+
+func (network *NetworkLayer) NewSESSPacket(sessionID device.SessionID, data []byte) (*SESSPacket, error) {
+	return network.newPaddedSESSPacket(sessionID, data, network.options.PaddingBuckets)
+}
 
+// newPaddedSESSPacket encrypts the data for the session after padding it to the given buckets.
+func (network *NetworkLayer) newPaddedSESSPacket(sessionID device.SessionID, data []byte, buckets []int) (*SESSPacket, error) {
 	session, found := network.sessionTable[sessionID]
 	if !found {
 		return nil, errors.New("session not found")
@@ -54,31 +91,58 @@ func (network *NetworkLayer) NewSESSPacket(sessionID device.SessionID, data []by
 		return nil, errors.New("intermediary session id")
 	}
 
-	if session.SessionSecret == nil {
+	if session.keys == nil {
 		return nil, errors.New("invalid session, no session secret")
 	}
 
-	aesCipher, err := aes.NewCipher(session.SessionSecret)
-	if err != nil {
-		return nil, err
+	var nonce, key []byte
+	if session.legacy() {
+		nonce = make([]byte, 12)
+		if _, err := io.ReadFull(network.dev.CryptoRand(), nonce); err != nil {
+			return nil, err
+		}
+		key = session.keys.sendKey
+	} else {
+		epoch, epochKey, err := session.keys.nextSendKey(network.dev.Now(), network.options.RekeyAfterMessages, network.options.RekeyInterval)
+		if err != nil {
+			return nil, err
+		}
+		key = epochKey
+
+		session.sendCounter++
+		nonce = sessionNonce(session.sendDirection(), epoch, session.sendCounter)
 	}
 
-	aesgcm, err := cipher.NewGCM(aesCipher)
+	aead, err := newSessionAEAD(session.cipherSuite, key)
 	if err != nil {
 		return nil, err
 	}
 
+	if paddingNegotiated(session.keyDerivation) {
+		data = padPayload(data, buckets)
+	}
+
 	headers := []byte(fmt.Sprintf("%d", sessionID))
-	cipher := aesgcm.Seal(nil, nonce, data, headers)
+	cipher := aead.Seal(nonce, data, headers)
+
+	label := session.SourceLabel
+	if session.initiator() {
+		label = session.TargetLabel
+	}
 
 	return &SESSPacket{
-		SessionID: sessionID,
+		SessionID: label,
 		Nonce:     nonce,
 		Cipher:    cipher,
 	}, nil
 }
 
 func (network *NetworkLayer) SendData(session device.SessionID, data []byte) error {
+	return network.sendPaddedData(session, data, network.options.PaddingBuckets)
+}
+
+// sendPaddedData sends the data on the session after padding it to the given buckets.
+func (network *NetworkLayer) sendPaddedData(session device.SessionID, data []byte, buckets []int) error {
 	sessionEntry, found := network.sessionTable[session]
 	if !found {
 		err := errors.New("session not found in session table")
@@ -91,7 +155,7 @@ func (network *NetworkLayer) SendData(session device.SessionID, data []byte) err
 		neighbour = sessionEntry.SourceNeighbour
 	}
 
-	packet, err := network.NewSESSPacket(sessionEntry.SessionID, data)
+	packet, err := network.newPaddedSESSPacket(sessionEntry.SessionID, data, buckets)
 	if err != nil {
 		network.logf("send:sess:error '%v'", err)
 		return err
@@ -117,7 +181,7 @@ func (network *NetworkLayer) SendData(session device.SessionID, data []byte) err
 
 func (network *NetworkLayer) handleSESSPacket(packet *SESSPacket, sender device.DeviceAddress) *SessionMessage {
 
-	session, found := network.sessionTable[packet.SessionID]
+	session, found := network.sessionByLabel(sender, packet.SessionID)
 	if !found {
 		network.log("packet:sess:session:not_found")
 		return nil
@@ -132,24 +196,38 @@ func (network *NetworkLayer) handleSESSPacket(packet *SESSPacket, sender device.
 			return nil
 		}
 
+		if len(decrypted.Data()) == 0 {
+			network.logf("packet:sess:cover:%s 'discarding cover packet'", sender)
+			return nil
+		}
+
 		network.logf("packet:sess:decrypted:%s:%s", sender, base64.StdEncoding.EncodeToString(decrypted.Data()))
 
 		return decrypted
 	}
 
-	fromAddr := *session.SourceNeighbour
+	if network.options.LeafOnly {
+		network.logf("packet:sess:leaf_only:%s 'not relaying session packet'", sender)
+		return nil
+	}
+
 	toAddr := *session.TargetNeighbour
-	if fromAddr != sender {
-		fromAddr, toAddr = toAddr, fromAddr
-		if fromAddr != sender {
-			network.log("packet:sess:session:wrong_sender")
-			return nil
-		}
+	if *session.TargetNeighbour == sender {
+		toAddr = *session.SourceNeighbour
+	}
+
+	// Forward packet with the label of the next link
+	label, _ := session.label(toAddr)
+	forwarded := *packet
+	forwarded.SessionID = label
+	encoded := forwarded.EncodePacket()
+
+	if allowed, _ := network.evaluatePolicies(PolicyPacket{Type: SESS, Sender: sender, Target: toAddr, Size: len(encoded)}); !allowed {
+		return nil
 	}
 
-	// Forward packet
-	network.logf("packet:sess:forward:%s", toAddr)
-	network.packetLayer.SendBytes(toAddr, packet.EncodePacket())
+	session.relayedNonce(toAddr, packet.Nonce)
+	network.relaySESSPacket(session.SessionID, toAddr, encoded)
 	return nil
 }
 
@@ -172,27 +250,67 @@ func (network *NetworkLayer) decryptSESSPacket(packet *SESSPacket, sender device
 	}
 	contact := *session.Contact
 
-	aesCipher, err := aes.NewCipher(session.SessionSecret)
-	if err != nil {
-		network.logf("packet:sess:cipher:error '%v'", err)
-		return nil, err
+	if session.keys == nil {
+		return nil, errors.New("invalid session, no session secret")
 	}
 
-	aesgcm, err := cipher.NewGCM(aesCipher)
+	key := session.keys.recvKey
+	var epoch uint32
+	var counter uint64
+	if !session.legacy() {
+		var direction uint32
+		direction, epoch, counter = parseSessionNonce(packet.Nonce)
+		if direction != session.receiveDirection() {
+			network.logf("packet:sess:replay:%d 'wrong direction %d'", packet.SessionID, direction)
+			return nil, errors.New("packet was sent in the wrong direction")
+		}
+		if !session.replay.check(counter) {
+			network.logf("packet:sess:replay:%d 'counter %d was already received'", packet.SessionID, counter)
+			return nil, errors.New("replayed packet")
+		}
+
+		var err error
+		key, err = session.keys.receiveKey(epoch)
+		if err != nil {
+			network.logf("packet:sess:rekey:error:%d:%d '%v'", packet.SessionID, epoch, err)
+			return nil, err
+		}
+	}
+
+	aead, err := newSessionAEAD(session.cipherSuite, key)
 	if err != nil {
 		network.logf("packet:sess:cipher:error '%v'", err)
 		return nil, err
 	}
 
-	headers := []byte(fmt.Sprintf("%d", packet.SessionID))
-	data, err := aesgcm.Open(nil, packet.Nonce, packet.Cipher, headers)
+	headers := []byte(fmt.Sprintf("%d", session.SessionID))
+	data, err := aead.Open(packet.Nonce, packet.Cipher, headers)
 	if err != nil {
 		network.logf("packet:sess:cipher:error '%v'", err)
 		return nil, err
 	}
 
+	if paddingNegotiated(session.keyDerivation) {
+		data, err = unpadPayload(data)
+		if err != nil {
+			network.logf("packet:sess:padding:error '%v'", err)
+			return nil, err
+		}
+	}
+
+	if !session.legacy() {
+		if epoch > session.keys.recvEpoch {
+			network.logf("packet:sess:rekey:%d 'advancing to epoch %d'", packet.SessionID, epoch)
+			if err := session.keys.advanceReceive(epoch); err != nil {
+				network.logf("packet:sess:rekey:error:%d:%d '%v'", packet.SessionID, epoch, err)
+				return nil, err
+			}
+		}
+		session.replay.update(counter)
+	}
+
 	network.logf("packet:sess:receive:%s 'data receive %d bytes'", contact, len(data))
-	return newSessionMessage(packet.SessionID, data), nil
+	return newSessionMessage(session.SessionID, data), nil
 }
 
 func (packet *SESSPacket) EncodePacket() []byte {
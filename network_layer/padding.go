@@ -0,0 +1,50 @@
+package network_layer
+
+import "errors"
+
+// paddingMarker separates the payload from the padding (ISO/IEC 7816-4),
+// it is always present such that peers with different padding options can communicate.
+// Nodes of the original protocol neither add nor strip it, see paddingNegotiated.
+const paddingMarker = 0x80
+
+// paddingNegotiated reports whether payloads encrypted with keys of the given key derivation version are padded.
+func paddingNegotiated(version KeyDerivationVersion) bool {
+	return version >= KeyDerivationV2
+}
+
+// padPayload appends the padding marker and rounds the payload up to the smallest bucket it fits in.
+// Payloads larger than the largest bucket are rounded up to a multiple of it.
+// The buckets must be in ascending order, the payload is not padded further when there are none.
+func padPayload(payload []byte, buckets []int) []byte {
+	size := len(payload) + 1
+
+	padded := size
+	if len(buckets) > 0 {
+		largest := buckets[len(buckets)-1]
+		padded = (size + largest - 1) / largest * largest
+		for _, bucket := range buckets {
+			if size <= bucket {
+				padded = bucket
+				break
+			}
+		}
+	}
+
+	buf := make([]byte, padded)
+	copy(buf, payload)
+	buf[len(payload)] = paddingMarker
+	return buf
+}
+
+// unpadPayload removes the padding added by padPayload.
+func unpadPayload(padded []byte) ([]byte, error) {
+	end := len(padded) - 1
+	for end >= 0 && padded[end] == 0 {
+		end--
+	}
+
+	if end < 0 || padded[end] != paddingMarker {
+		return nil, errors.New("invalid padding")
+	}
+	return padded[:end], nil
+}
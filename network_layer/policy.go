@@ -0,0 +1,153 @@
+package network_layer
+
+import (
+	"slices"
+	"time"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// Policies enforce local rules on the packets this node relays for others.
+// They are consulted in the order they were added, before a RREQ is forwarded, before a RREP or a SESS packet
+// is relayed and before a RERR is handled. Apart from RERRs, packets sent or received by this node as an endpoint
+// are not affected.
+
+// PolicyAction is what a policy decides to do with a packet.
+type PolicyAction int
+
+const (
+	// PolicyAllow lets the packet through unchanged.
+	PolicyAllow PolicyAction = iota
+	// PolicyDrop discards the packet, and no further policies are consulted.
+	PolicyDrop
+	// PolicyRewriteTTL forwards a RREQ with the TTL of the decision.
+	// The TTL can only be lowered, and the RREQ is dropped when it reaches zero.
+	PolicyRewriteTTL
+)
+
+// PolicyPacket describes a packet which a policy is consulted about.
+type PolicyPacket struct {
+	Type PacketType
+	// Sender is the neighbour the packet was received from.
+	Sender device.DeviceAddress
+	// Target is the neighbour the packet is relayed to. It is empty for RREQs, which are broadcast,
+	// and for RERRs, which are handled before it is known where they go.
+	Target device.DeviceAddress
+	// TTL is the time to live a RREQ is forwarded with, as rewritten by earlier policies. It is zero for other packets.
+	TTL TTL
+	// Size is the size of the encoded packet in bytes.
+	Size int
+	// Now is the current time of the device.
+	Now time.Time
+}
+
+// PolicyDecision is the result of consulting a policy.
+type PolicyDecision struct {
+	Action PolicyAction
+	// TTL is the new time to live when the action is PolicyRewriteTTL.
+	TTL TTL
+}
+
+// A Policy decides what to do with packets relayed by this node.
+type Policy interface {
+	Evaluate(packet PolicyPacket) PolicyDecision
+}
+
+// AddPolicy adds a policy, which is consulted after the policies added before it.
+func (network *NetworkLayer) AddPolicy(policy Policy) {
+	network.policies = append(network.policies, policy)
+}
+
+// RemovePolicy removes a policy which was added before.
+func (network *NetworkLayer) RemovePolicy(policy Policy) {
+	network.policies = slices.DeleteFunc(network.policies, func(p Policy) bool { return p == policy })
+}
+
+// evaluatePolicies consults all policies about the packet. It returns whether the packet is allowed,
+// and the TTL it should be forwarded with.
+func (network *NetworkLayer) evaluatePolicies(packet PolicyPacket) (bool, TTL) {
+	packet.Now = network.dev.Now()
+	for _, policy := range network.policies {
+		decision := policy.Evaluate(packet)
+		switch decision.Action {
+		case PolicyDrop:
+			network.logf("policy:drop:%v:%s", packet.Type, packet.Sender)
+			return false, packet.TTL
+		case PolicyRewriteTTL:
+			if decision.TTL < packet.TTL {
+				network.logf("policy:rewrite_ttl:%v:%s:%d", packet.Type, packet.Sender, decision.TTL)
+				packet.TTL = decision.TTL
+			}
+		}
+	}
+	return true, packet.TTL
+}
+
+// KnownNeighboursPolicy only relays packets between neighbours which the host recognizes.
+type KnownNeighboursPolicy struct {
+	known func(address device.DeviceAddress) bool
+}
+
+// NewKnownNeighboursPolicy returns a policy which drops relayed packets from or to neighbours for which known returns false.
+// Route errors are always let through, such that sessions through unknown neighbours can still be torn down.
+func NewKnownNeighboursPolicy(known func(address device.DeviceAddress) bool) *KnownNeighboursPolicy {
+	return &KnownNeighboursPolicy{known: known}
+}
+
+// Evaluate implements Policy.
+func (p *KnownNeighboursPolicy) Evaluate(packet PolicyPacket) PolicyDecision {
+	if packet.Type == RERR {
+		return PolicyDecision{Action: PolicyAllow}
+	}
+	if !p.known(packet.Sender) || (packet.Target != "" && !p.known(packet.Target)) {
+		return PolicyDecision{Action: PolicyDrop}
+	}
+	return PolicyDecision{Action: PolicyAllow}
+}
+
+// MaxTTLPolicy limits how far route requests are forwarded, e.g. to save battery.
+type MaxTTLPolicy struct {
+	MaxTTL TTL
+}
+
+// NewMaxTTLPolicy returns a policy which lowers the TTL of forwarded route requests to at most maxTTL.
+func NewMaxTTLPolicy(maxTTL TTL) *MaxTTLPolicy {
+	return &MaxTTLPolicy{MaxTTL: maxTTL}
+}
+
+// Evaluate implements Policy.
+func (p *MaxTTLPolicy) Evaluate(packet PolicyPacket) PolicyDecision {
+	if packet.Type == RREQ && packet.TTL > p.MaxTTL {
+		return PolicyDecision{Action: PolicyRewriteTTL, TTL: p.MaxTTL}
+	}
+	return PolicyDecision{Action: PolicyAllow}
+}
+
+// RelayRateLimitPolicy limits the rate of SESS packets relayed by this node.
+type RelayRateLimitPolicy struct {
+	bytesPerSecond int
+	bucket         tokenBucket
+}
+
+// NewRelayRateLimitPolicy returns a policy which drops relayed SESS packets above the given rate.
+// Bursts of up to one second worth of traffic are allowed. Like the relay limits, a packet is relayed
+// whenever the bucket is not empty, such that packets larger than the rate still get through.
+func NewRelayRateLimitPolicy(bytesPerSecond int) *RelayRateLimitPolicy {
+	return &RelayRateLimitPolicy{
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+// Evaluate implements Policy.
+func (p *RelayRateLimitPolicy) Evaluate(packet PolicyPacket) PolicyDecision {
+	if packet.Type != SESS {
+		return PolicyDecision{Action: PolicyAllow}
+	}
+
+	p.bucket.refill(packet.Now, p.bytesPerSecond)
+	if !p.bucket.available(p.bytesPerSecond) {
+		return PolicyDecision{Action: PolicyDrop}
+	}
+	p.bucket.take(p.bytesPerSecond, packet.Size)
+	return PolicyDecision{Action: PolicyAllow}
+}
@@ -0,0 +1,131 @@
+package network_layer
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxEpoch is the highest key epoch, since the epoch shares the first nonce word with the direction.
+const maxEpoch = 1<<31 - 1
+
+// maxEpochSkip bounds how many epochs the receiver ratchets forward for a single packet,
+// in case all packets of the epochs in between were lost.
+const maxEpochSkip = 16
+
+// ratchetKey derives the key of the next epoch from the current key.
+// The previous key cannot be computed from the new one, so erasing old keys gives forward secrecy.
+func ratchetKey(key []byte) ([]byte, error) {
+	reader := hkdf.Expand(sha256.New, key, []byte("starling session rekey"))
+
+	next := make([]byte, 32)
+	if _, err := io.ReadFull(reader, next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// sessionKeys holds the keys of an endpoint session.
+// Each direction ratchets its own chain of keys, starting from the key derived during route setup in epoch 0.
+type sessionKeys struct {
+	sendEpoch    uint32
+	sendKey      []byte
+	sendMessages int
+	sendStarted  time.Time
+
+	recvEpoch uint32
+	recvKey   []byte
+	// prevRecvKey is the key of the epoch before recvEpoch, kept for packets that were reordered.
+	prevRecvKey []byte
+}
+
+func newSessionKeys(material *SessionKeyMaterial, initiator bool) *sessionKeys {
+	if material == nil {
+		return nil
+	}
+
+	sendKey, recvKey := material.ResponderKey, material.InitiatorKey
+	if initiator {
+		sendKey, recvKey = material.InitiatorKey, material.ResponderKey
+	}
+
+	return &sessionKeys{
+		sendEpoch:   0,
+		sendKey:     append([]byte{}, sendKey...),
+		recvEpoch:   0,
+		recvKey:     append([]byte{}, recvKey...),
+		prevRecvKey: nil,
+	}
+}
+
+// nextSendKey returns the epoch and key to encrypt the next packet with.
+// The send chain is ratcheted once the current key has been used for rekeyAfter packets or for rekeyInterval.
+func (keys *sessionKeys) nextSendKey(now time.Time, rekeyAfter int, rekeyInterval time.Duration) (uint32, []byte, error) {
+	if keys.sendStarted.IsZero() {
+		keys.sendStarted = now
+	}
+
+	expired := (rekeyAfter > 0 && keys.sendMessages >= rekeyAfter) ||
+		(rekeyInterval > 0 && now.Sub(keys.sendStarted) >= rekeyInterval)
+
+	if expired && keys.sendEpoch < maxEpoch {
+		next, err := ratchetKey(keys.sendKey)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		clear(keys.sendKey)
+		keys.sendKey = next
+		keys.sendEpoch++
+		keys.sendMessages = 0
+		keys.sendStarted = now
+	}
+
+	keys.sendMessages++
+	return keys.sendEpoch, keys.sendKey, nil
+}
+
+// receiveKey returns the key of the given epoch without changing the receive chain,
+// since the packet has not been authenticated yet.
+func (keys *sessionKeys) receiveKey(epoch uint32) ([]byte, error) {
+	switch {
+	case epoch == keys.recvEpoch:
+		return keys.recvKey, nil
+	case epoch+1 == keys.recvEpoch && keys.prevRecvKey != nil:
+		return keys.prevRecvKey, nil
+	case epoch < keys.recvEpoch:
+		return nil, errors.New("key of epoch has been erased")
+	case epoch-keys.recvEpoch > maxEpochSkip:
+		return nil, errors.New("epoch is too far ahead")
+	}
+
+	key := keys.recvKey
+	for e := keys.recvEpoch; e < epoch; e++ {
+		next, err := ratchetKey(key)
+		if err != nil {
+			return nil, err
+		}
+		key = next
+	}
+	return key, nil
+}
+
+// advanceReceive moves the receive chain to the epoch of an authenticated packet and erases the older keys.
+// The key of the previous epoch is kept to decrypt packets that arrive out of order.
+func (keys *sessionKeys) advanceReceive(epoch uint32) error {
+	for keys.recvEpoch < epoch {
+		next, err := ratchetKey(keys.recvKey)
+		if err != nil {
+			return err
+		}
+
+		clear(keys.prevRecvKey)
+		keys.prevRecvKey = keys.recvKey
+		keys.recvKey = next
+		keys.recvEpoch++
+	}
+	return nil
+}
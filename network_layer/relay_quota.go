@@ -0,0 +1,215 @@
+package network_layer
+
+import (
+	"time"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// SESS packets relayed for other nodes are limited to RelaySessionRate per session and RelayBandwidth in total.
+// Packets above the limits are queued per session, and the queues are served in turn, such that a single heavy
+// session cannot starve the other relayed sessions. Packets sent by this node as an endpoint bypass the limits.
+//
+// The limits are token buckets which hold up to one second worth of traffic. A packet may be sent
+// while the bucket is not empty, and the bucket can go into debt, such that large packets are not stuck.
+
+// relayDrainInterval is how often queued packets are sent while the relay is over its limits.
+const relayDrainInterval = 50 * time.Millisecond
+
+// tokenBucket limits a rate in bytes per second.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens gained since the last refill, up to one second worth of traffic.
+func (bucket *tokenBucket) refill(now time.Time, rate int) {
+	if bucket.updated.IsZero() {
+		bucket.tokens = float64(rate)
+	} else if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens = min(bucket.tokens+elapsed*float64(rate), float64(rate))
+	}
+	bucket.updated = now
+}
+
+// available reports whether a packet can be sent, which is always the case when the rate is unlimited.
+func (bucket *tokenBucket) available(rate int) bool {
+	return rate <= 0 || bucket.tokens > 0
+}
+
+// take spends the tokens of a packet of the given size.
+func (bucket *tokenBucket) take(rate int, size int) {
+	if rate > 0 {
+		bucket.tokens -= float64(size)
+	}
+}
+
+type queuedRelayPacket struct {
+	target device.DeviceAddress
+	packet []byte
+}
+
+// relaySession is the accounting of a single session relayed by this node.
+type relaySession struct {
+	bucket tokenBucket
+	queue  []queuedRelayPacket
+	stats  RelaySessionStats
+}
+
+// RelaySessionStats counts the SESS packets of a session relayed by this node.
+type RelaySessionStats struct {
+	// Forwarded is the number of packets forwarded, and ForwardedBytes their size.
+	Forwarded      int
+	ForwardedBytes int
+	// Delayed is the number of packets which were queued because the session was over its limits.
+	Delayed int
+	// Dropped is the number of packets dropped because the queue of the session was full.
+	Dropped int
+	// Queued is the number of packets currently waiting in the queue.
+	Queued int
+}
+
+// relayScheduler serves the queues of the relayed sessions in turn.
+type relayScheduler struct {
+	sessions map[device.SessionID]*relaySession
+	// order is the order in which sessions with queued packets are served, starting from the front.
+	order     []device.SessionID
+	bucket    tokenBucket
+	scheduled bool
+}
+
+func newRelayScheduler() relayScheduler {
+	return relayScheduler{
+		sessions: make(map[device.SessionID]*relaySession),
+		order:    []device.SessionID{},
+	}
+}
+
+// relayLimited reports whether relayed SESS packets are subject to any limit.
+func (network *NetworkLayer) relayLimited() bool {
+	return network.options.RelaySessionRate > 0 || network.options.RelayBandwidth > 0
+}
+
+// refillRelayBuckets refills the total bucket and the bucket of the relayed session.
+func (network *NetworkLayer) refillRelayBuckets(relay *relaySession) {
+	now := network.dev.Now()
+	network.relay.bucket.refill(now, network.options.RelayBandwidth)
+	relay.bucket.refill(now, network.options.RelaySessionRate)
+}
+
+// canRelay reports whether the session can send a packet now.
+func (network *NetworkLayer) canRelay(relay *relaySession) bool {
+	return network.relay.bucket.available(network.options.RelayBandwidth) &&
+		relay.bucket.available(network.options.RelaySessionRate)
+}
+
+// sendRelayPacket forwards a SESS packet of a relayed session, and accounts for it.
+func (network *NetworkLayer) sendRelayPacket(relay *relaySession, target device.DeviceAddress, packet []byte) {
+	network.relay.bucket.take(network.options.RelayBandwidth, len(packet))
+	relay.bucket.take(network.options.RelaySessionRate, len(packet))
+	relay.stats.Forwarded++
+	relay.stats.ForwardedBytes += len(packet)
+
+	network.logf("packet:sess:forward:%s", target)
+	network.packetLayer.SendBytes(target, packet)
+}
+
+// relaySESSPacket forwards a SESS packet of a relayed session, or queues it if the session is over its limits.
+func (network *NetworkLayer) relaySESSPacket(sessionID device.SessionID, target device.DeviceAddress, packet []byte) {
+	relay, found := network.relay.sessions[sessionID]
+	if !found {
+		relay = &relaySession{}
+		network.relay.sessions[sessionID] = relay
+	}
+
+	if !network.relayLimited() {
+		network.sendRelayPacket(relay, target, packet)
+		return
+	}
+
+	network.refillRelayBuckets(relay)
+	if len(relay.queue) == 0 && network.canRelay(relay) {
+		network.sendRelayPacket(relay, target, packet)
+		return
+	}
+
+	if len(relay.queue) >= network.options.RelayQueueSize {
+		network.logf("packet:sess:relay:drop:%d 'relay queue is full'", sessionID)
+		relay.stats.Dropped++
+		return
+	}
+
+	network.logf("packet:sess:relay:delay:%d", sessionID)
+	if len(relay.queue) == 0 {
+		network.relay.order = append(network.relay.order, sessionID)
+	}
+	relay.queue = append(relay.queue, queuedRelayPacket{target: target, packet: packet})
+	relay.stats.Delayed++
+	relay.stats.Queued = len(relay.queue)
+	network.scheduleRelayDrain()
+}
+
+// scheduleRelayDrain schedules the queues to be served, unless it is already scheduled.
+func (network *NetworkLayer) scheduleRelayDrain() {
+	if network.relay.scheduled {
+		return
+	}
+	network.relay.scheduled = true
+	network.dev.Delay(network.drainRelayQueues, relayDrainInterval)
+}
+
+// drainRelayQueues sends queued packets in turn, one from each session at a time,
+// until the queues are empty or no session can send more.
+func (network *NetworkLayer) drainRelayQueues() {
+	network.relay.scheduled = false
+
+	waiting := []device.SessionID{}
+	for len(network.relay.order) > 0 {
+		sessionID := network.relay.order[0]
+		network.relay.order = network.relay.order[1:]
+
+		relay, found := network.relay.sessions[sessionID]
+		if !found || len(relay.queue) == 0 {
+			continue
+		}
+
+		network.refillRelayBuckets(relay)
+		if !network.relay.bucket.available(network.options.RelayBandwidth) {
+			// No session can send until the total bucket has been refilled
+			waiting = append(waiting, sessionID)
+			break
+		}
+		if !relay.bucket.available(network.options.RelaySessionRate) {
+			waiting = append(waiting, sessionID)
+			continue
+		}
+
+		next := relay.queue[0]
+		relay.queue = relay.queue[1:]
+		relay.stats.Queued = len(relay.queue)
+		network.sendRelayPacket(relay, next.target, next.packet)
+
+		if len(relay.queue) > 0 {
+			network.relay.order = append(network.relay.order, sessionID)
+		}
+	}
+	network.relay.order = append(waiting, network.relay.order...)
+
+	if len(network.relay.order) > 0 {
+		network.scheduleRelayDrain()
+	}
+}
+
+// removeRelaySession drops the accounting and the queued packets of a relayed session.
+func (network *NetworkLayer) removeRelaySession(sessionID device.SessionID) {
+	delete(network.relay.sessions, sessionID)
+}
+
+// RelayStats returns the accounting of a session relayed by this node.
+func (network *NetworkLayer) RelayStats(sessionID device.SessionID) (RelaySessionStats, bool) {
+	relay, found := network.relay.sessions[sessionID]
+	if !found {
+		return RelaySessionStats{}, false
+	}
+	return relay.stats, true
+}
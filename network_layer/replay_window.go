@@ -0,0 +1,48 @@
+package network_layer
+
+// replayWindowSize is the number of counters below the highest seen counter that are still accepted.
+const replayWindowSize = 64
+
+// replayWindow is a sliding window over the counters of received SESS packets (RFC 4303, section 3.4.3).
+// Packets may arrive out of order within the window, but every counter is only accepted once.
+type replayWindow struct {
+	highest uint64
+	// bitmap has bit i set when the counter highest-i has been received.
+	bitmap uint64
+}
+
+// check reports whether a packet with the given counter would be accepted.
+// The window is not updated, since the packet has not been authenticated yet.
+func (w *replayWindow) check(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+
+	if counter > w.highest {
+		return true
+	}
+
+	offset := w.highest - counter
+	if offset >= replayWindowSize {
+		return false
+	}
+
+	return w.bitmap&(1<<offset) == 0
+}
+
+// update marks the counter as received, it must only be called for authenticated packets.
+func (w *replayWindow) update(counter uint64) {
+	if counter > w.highest {
+		shift := counter - w.highest
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.highest = counter
+		return
+	}
+
+	w.bitmap |= 1 << (w.highest - counter)
+}
@@ -0,0 +1,138 @@
+package network_layer
+
+import (
+	"math"
+	"time"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// Every neighbour has a reputation score, which grows when it sends packets that an honest node would not send.
+// The score decays over time, such that occasional errors caused by lossy links or outdated state are forgiven.
+// A neighbour whose score exceeds ReputationThreshold is quarantined: its route requests are ignored,
+// sessions are no longer relayed through it, and the host is asked to disconnect it.
+
+// Misbehaviour is a kind of event which lowers the reputation of the neighbour that caused it.
+type Misbehaviour int
+
+const (
+	// MisbehaviourDecodeError is a packet which could not be decoded.
+	// Packets of types introduced by newer versions of the protocol are not counted.
+	MisbehaviourDecodeError Misbehaviour = iota
+	// MisbehaviourDuplicateRREQ is a route request which the same neighbour has sent before.
+	MisbehaviourDuplicateRREQ
+	// MisbehaviourInvalidStamp is a route request without a valid proof-of-work stamp.
+	MisbehaviourInvalidStamp
+	// MisbehaviourForgedRERR is a route error which does not reveal the teardown token of the link.
+	MisbehaviourForgedRERR
+)
+
+// misbehaviourWeights are the scores of each kind of misbehaviour.
+// Events which can happen to honest nodes weigh less than events which require forging a packet.
+var misbehaviourWeights = map[Misbehaviour]float64{
+	MisbehaviourDecodeError:   10,
+	MisbehaviourDuplicateRREQ: 5,
+	MisbehaviourInvalidStamp:  20,
+	MisbehaviourForgedRERR:    25,
+}
+
+func (m Misbehaviour) String() string {
+	switch m {
+	case MisbehaviourDecodeError:
+		return "decode_error"
+	case MisbehaviourDuplicateRREQ:
+		return "duplicate_rreq"
+	case MisbehaviourInvalidStamp:
+		return "invalid_stamp"
+	case MisbehaviourForgedRERR:
+		return "forged_rerr"
+	default:
+		return "unknown"
+	}
+}
+
+// reputationHalfLife is the time after which the score of a neighbour has halved.
+const reputationHalfLife = 10 * time.Minute
+
+// neutralScore is the score below which a neighbour is considered well-behaved again.
+// Its reputation is then forgotten, unless it is still quarantined.
+const neutralScore = 0.5
+
+type reputation struct {
+	score float64
+	// updated is when the score was last decayed.
+	updated time.Time
+	// quarantinedUntil is the end of the quarantine, or the zero time if the neighbour is not quarantined.
+	quarantinedUntil time.Time
+}
+
+// decay lowers the score according to the time passed since it was last updated.
+func (r *reputation) decay(now time.Time) {
+	if elapsed := now.Sub(r.updated); elapsed > 0 {
+		r.score *= math.Exp2(-float64(elapsed) / float64(reputationHalfLife))
+	}
+	r.updated = now
+}
+
+// neutral reports whether the reputation can be forgotten, as it has decayed and any quarantine has lapsed.
+func (r *reputation) neutral(now time.Time) bool {
+	return r.score < neutralScore && !now.Before(r.quarantinedUntil)
+}
+
+// pruneReputations forgets the reputations of neighbours which are back to neutral,
+// such that the reputations of past neighbours are not kept forever.
+func (network *NetworkLayer) pruneReputations(now time.Time) {
+	for address, rep := range network.reputations {
+		rep.decay(now)
+		if rep.neutral(now) {
+			delete(network.reputations, address)
+		}
+	}
+}
+
+// ReportMisbehaviour lowers the reputation of the neighbour, and quarantines it once its score exceeds the threshold.
+// It does nothing when ReputationThreshold is zero.
+func (network *NetworkLayer) ReportMisbehaviour(address device.DeviceAddress, misbehaviour Misbehaviour) {
+	if network.options.ReputationThreshold <= 0 {
+		return
+	}
+
+	now := network.dev.Now()
+	rep, found := network.reputations[address]
+	if !found {
+		network.pruneReputations(now)
+		rep = &reputation{updated: now}
+		network.reputations[address] = rep
+	}
+	rep.decay(now)
+	rep.score += misbehaviourWeights[misbehaviour]
+
+	network.logf("reputation:misbehaviour:%s:%s:%.1f", address, misbehaviour, rep.score)
+
+	if rep.score < float64(network.options.ReputationThreshold) || now.Before(rep.quarantinedUntil) {
+		return
+	}
+
+	rep.quarantinedUntil = now.Add(network.options.QuarantineDuration)
+	network.logf("reputation:quarantine:%s 'score %.1f exceeds threshold'", address, rep.score)
+	network.dev.PeerQuarantined(address)
+}
+
+// Reputation returns the current misbehaviour score of the neighbour, which is zero for well-behaved neighbours.
+func (network *NetworkLayer) Reputation(address device.DeviceAddress) float64 {
+	rep, found := network.reputations[address]
+	if !found {
+		return 0
+	}
+	rep.decay(network.dev.Now())
+	return rep.score
+}
+
+// Quarantined reports whether the neighbour is currently quarantined.
+func (network *NetworkLayer) Quarantined(address device.DeviceAddress) bool {
+	rep, found := network.reputations[address]
+	if !found {
+		return false
+	}
+	return network.dev.Now().Before(rep.quarantinedUntil)
+}
@@ -1,9 +1,13 @@
 package network_layer
 
 import (
+	"bytes"
 	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/mlkem"
 	"encoding/binary"
-	"math/rand"
+	"io"
+	"time"
 
 	"github.com/starling-protocol/starling/device"
 )
@@ -33,6 +37,20 @@ type RequestTableEntry struct {
 	RequestID           RequestID
 	SourceNeighbour     *device.DeviceAddress
 	EphemeralPrivateKey *ecdh.PrivateKey
+	// kemKey is the decapsulation key of a hybrid key exchange, or nil if the RREQ was sent without one.
+	kemKey *mlkem.DecapsulationKey768
+	// keyDerivation and cipherSuite are the key derivation version and cipher suite offered in a RREQ sent by this node.
+	// Intermediary nodes only keep the key derivation version, which determines how the route reply is relayed.
+	keyDerivation KeyDerivationVersion
+	cipherSuite   device.CipherSuite
+	// teardownKey signs the RERRs tearing down sessions towards the neighbours the RREQ was sent to.
+	teardownKey ed25519.PrivateKey
+	// sourceCommitment is the teardown commitment of the source neighbour.
+	sourceCommitment []byte
+	// created, pendingReplies and groupRequest determine when the ephemeral keys of a request sent by this node are discarded.
+	created        time.Time
+	pendingReplies int
+	groupRequest   bool
 }
 
 func NewRequestTableEntry(reqID RequestID, source *device.DeviceAddress, ephemeral *ecdh.PrivateKey) RequestTableEntry {
@@ -43,37 +61,129 @@ func NewRequestTableEntry(reqID RequestID, source *device.DeviceAddress, ephemer
 	}
 }
 
+// A session label identifies a session on a single link, such that the packets of a session
+// cannot be linked across hops by an observer. Labels are only unique per neighbour.
+type sessionLabel struct {
+	neighbour device.DeviceAddress
+	label     device.SessionID
+}
+
+type LabelTable map[sessionLabel]device.SessionID
+
 type SessionTableEntry struct {
-	RequestID       RequestID
+	RequestID RequestID
+	// SessionID is shared end-to-end by the endpoints of a session and is never sent in the clear.
+	// Intermediary nodes use a random local ID instead.
 	SessionID       device.SessionID
 	Contact         *device.ContactID
 	SourceNeighbour *device.DeviceAddress
 	TargetNeighbour *device.DeviceAddress
-	SessionSecret   []byte
+	// SourceLabel and TargetLabel are the labels of the session on the links to the source and target neighbours.
+	SourceLabel device.SessionID
+	TargetLabel device.SessionID
+	// sourceTeardownKey and targetTeardownKey sign a RERR sent to the source and target neighbours,
+	// while a RERR from a neighbour must be signed with the key of its commitment.
+	sourceTeardownKey ed25519.PrivateKey
+	targetTeardownKey ed25519.PrivateKey
+	sourceCommitment  []byte
+	targetCommitment  []byte
+	// keys are derived from the session secret and are nil for intermediary sessions.
+	keys *sessionKeys
+	// cipherSuite encrypts the SESS packets of the session, as negotiated during route setup.
+	cipherSuite device.CipherSuite
+	// keyDerivation is the key derivation version negotiated during route setup, see legacy.
+	keyDerivation KeyDerivationVersion
+	// sendCounter is the counter of the latest SESS packet sent on the session.
+	sendCounter uint64
+	// sourceNonce and targetNonce are the nonces of the latest SESS packets an intermediary node sent
+	// towards the source and target neighbours, see relayCoverNonce.
+	sourceNonce []byte
+	targetNonce []byte
+	// replay keeps track of the counters of SESS packets received on the session.
+	replay replayWindow
 }
 
 func (s *SessionTableEntry) EndpointSession() bool {
 	return s.Contact != nil
 }
 
-func SessionEntryFromRREQ(random *rand.Rand, contact *device.ContactID, reqEntry RequestTableEntry, sender *device.DeviceAddress, sessionSecret []byte) SessionTableEntry {
+// legacy reports whether the session was set up with KeyDerivationV1 by a node of the original protocol.
+// Its SESS packets have random nonces and are encrypted with a single key, so they cannot be checked
+// for replays, and the session is never rekeyed.
+func (s *SessionTableEntry) legacy() bool {
+	return s.keyDerivation < KeyDerivationV2
+}
+
+// initiator reports whether this end of an endpoint session sent the route request.
+func (s *SessionTableEntry) initiator() bool {
+	return s.SourceNeighbour == nil
+}
+
+// label returns the label of the session on the link to the given neighbour.
+func (s *SessionTableEntry) label(neighbour device.DeviceAddress) (device.SessionID, bool) {
+	if s.SourceNeighbour != nil && *s.SourceNeighbour == neighbour {
+		return s.SourceLabel, true
+	}
+	if s.TargetNeighbour != nil && *s.TargetNeighbour == neighbour {
+		return s.TargetLabel, true
+	}
+	return 0, false
+}
+
+// labels returns the labels of the session on each of its links.
+func (s *SessionTableEntry) labels() []sessionLabel {
+	labels := []sessionLabel{}
+	if s.SourceNeighbour != nil {
+		labels = append(labels, sessionLabel{neighbour: *s.SourceNeighbour, label: s.SourceLabel})
+	}
+	if s.TargetNeighbour != nil {
+		labels = append(labels, sessionLabel{neighbour: *s.TargetNeighbour, label: s.TargetLabel})
+	}
+	return labels
+}
+
+// newSessionLabel returns a random label for a session on a link.
+// Labels are drawn from a cryptographically secure source, such that they cannot be predicted from earlier labels.
+func newSessionLabel(cryptoRand io.Reader) (device.SessionID, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(cryptoRand, buf[:]); err != nil {
+		return 0, err
+	}
+	return device.SessionID(binary.BigEndian.Uint64(buf[:]) >> 1), nil
+}
+
+// SessionEntryFromRREQ creates the session entry of the target, which uses sourceLabel on the link towards the source.
+func SessionEntryFromRREQ(contact *device.ContactID, reqEntry RequestTableEntry, sender *device.DeviceAddress, sessionID device.SessionID, sourceLabel device.SessionID, keys *SessionKeyMaterial) SessionTableEntry {
 	return SessionTableEntry{
-		RequestID:       reqEntry.RequestID,
-		SessionID:       device.SessionID(random.Int63()),
-		Contact:         contact,
-		SourceNeighbour: sender,
-		TargetNeighbour: nil,
-		SessionSecret:   sessionSecret,
+		RequestID:        reqEntry.RequestID,
+		SessionID:        sessionID,
+		Contact:          contact,
+		SourceNeighbour:  sender,
+		TargetNeighbour:  nil,
+		SourceLabel:      sourceLabel,
+		TargetLabel:      0,
+		sourceCommitment: reqEntry.sourceCommitment,
+		keys:             newSessionKeys(keys, false),
+		keyDerivation:    keys.Version,
 	}
 }
 
-func SessionEntryFromRREP(random *rand.Rand, contact *device.ContactID, reqEntry RequestTableEntry, rrep RREPPacket, sender *device.DeviceAddress, sessionSecret []byte) SessionTableEntry {
+// SessionEntryFromRREP creates the session entry of the initiator or of an intermediary node.
+// An intermediary node chooses a new label for the link towards the source of the route request,
+// unless the session uses KeyDerivationV1, the initiator has no such link and passes zero.
+func SessionEntryFromRREP(contact *device.ContactID, reqEntry RequestTableEntry, rrep RREPPacket, sender *device.DeviceAddress, sessionID device.SessionID, sourceLabel device.SessionID, keys *SessionKeyMaterial) SessionTableEntry {
 	return SessionTableEntry{
-		RequestID:       reqEntry.RequestID,
-		SessionID:       rrep.SessionID,
-		Contact:         contact,
-		SourceNeighbour: reqEntry.SourceNeighbour,
-		TargetNeighbour: sender,
-		SessionSecret:   sessionSecret,
+		RequestID:         reqEntry.RequestID,
+		SessionID:         sessionID,
+		Contact:           contact,
+		SourceNeighbour:   reqEntry.SourceNeighbour,
+		TargetNeighbour:   sender,
+		SourceLabel:       sourceLabel,
+		TargetLabel:       rrep.SessionID,
+		targetTeardownKey: reqEntry.teardownKey,
+		sourceCommitment:  reqEntry.sourceCommitment,
+		targetCommitment:  bytes.Clone(rrep.TeardownCommitment),
+		keys:              newSessionKeys(keys, true),
+		keyDerivation:     reqEntry.keyDerivation,
 	}
 }
@@ -0,0 +1,153 @@
+package network_layer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"time"
+
+	"github.com/starling-protocol/starling/network_layer/contact_bitmap"
+)
+
+// Route requests may carry a proof-of-work stamp, such that flooding the network with forged requests
+// is expensive. A stamp is a counter which makes the hash of the request have a number of leading zero bits.
+// The stamp covers the fields that are not changed by relays, so it is only computed by the initiator.
+// Relays check the stamp before decoding the contact bitmap or forwarding the request.
+//
+// Every node requires the same network-wide difficulty, but the initiator states the difficulty of its stamp,
+// such that relays under load can stop forwarding requests with easier stamps, while still answering them.
+
+// rreqStampSize is the size of a stamp, which is the difficulty followed by the counter.
+const rreqStampSize = 9
+
+// maxStampLoadBits bounds how much the difficulty rises under load.
+const maxStampLoadBits = 8
+
+// maxStampDifficulty bounds the difficulty relays require of stamps under load.
+const maxStampDifficulty = 20
+
+// maxMintDifficulty bounds the difficulty of the stamps minted by this node. Stamps are minted on the protocol
+// thread, which is blocked for about 65 thousand hashes at this difficulty.
+const maxMintDifficulty = 16
+
+// rreqLoadPeriod is the period over which the rate of incoming route requests is measured.
+const rreqLoadPeriod = time.Minute
+
+// rreqLoad counts the route requests received in the current and the previous period.
+type rreqLoad struct {
+	periodStart time.Time
+	received    int
+	previous    int
+}
+
+// stampHash returns the number of leading zero bits in the hash of the request with the given stamp.
+func stampHash(reqID RequestID, ephemeralKey []byte, contactMask contact_bitmap.ContactBitmap, stamp []byte) int {
+	hash := sha256.New()
+	hash.Write([]byte("starling rreq stamp"))
+	hash.Write(reqID.Encode([]byte{}))
+	hash.Write(ephemeralKey)
+	hash.Write(contactMask)
+	hash.Write(stamp)
+	sum := hash.Sum(nil)
+
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// mintStamp searches for a stamp with the given difficulty, starting from a random counter.
+// It gives up after 16 times the expected number of attempts, which happens with a probability of about 1e-7.
+func mintStamp(rreq *RREQPacket, difficulty int, start uint64) ([]byte, error) {
+	if difficulty > maxMintDifficulty {
+		return nil, errors.New("stamp difficulty is too high")
+	}
+
+	stamp := make([]byte, rreqStampSize)
+	stamp[0] = byte(difficulty)
+	ephemeralKey := rreq.EphemeralKey.Bytes()
+	attempts := uint64(16) << difficulty
+	for counter := start; counter != start+attempts; counter++ {
+		binary.BigEndian.PutUint64(stamp[1:], counter)
+		if stampHash(rreq.RequestID, ephemeralKey, rreq.ContactMask, stamp[1:]) >= difficulty {
+			return stamp, nil
+		}
+	}
+	return nil, errors.New("no stamp found")
+}
+
+// stampDifficulty returns the difficulty stated by the stamp of the request, or zero if it has none.
+func stampDifficulty(rreq *RREQPacket) int {
+	if len(rreq.Stamp) != rreqStampSize {
+		return 0
+	}
+	return int(rreq.Stamp[0])
+}
+
+// verifyStamp reports whether the request carries a valid stamp of at least the given difficulty.
+func verifyStamp(rreq *RREQPacket, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	}
+	stated := stampDifficulty(rreq)
+	if stated < difficulty {
+		return false
+	}
+	return stampHash(rreq.RequestID, rreq.EphemeralKey.Bytes(), rreq.ContactMask, rreq.Stamp[1:]) >= stated
+}
+
+// countRouteRequest registers a received route request with a valid stamp for the load estimate.
+func (network *NetworkLayer) countRouteRequest() {
+	now := network.dev.Now()
+	if elapsed := now.Sub(network.rreqLoad.periodStart); elapsed >= rreqLoadPeriod {
+		if elapsed >= 2*rreqLoadPeriod {
+			network.rreqLoad.previous = 0
+		} else {
+			network.rreqLoad.previous = network.rreqLoad.received
+		}
+		network.rreqLoad.periodStart = now
+		network.rreqLoad.received = 0
+	}
+	network.rreqLoad.received++
+}
+
+// StampDifficulty returns the number of leading zero bits currently required of route request stamps forwarded
+// by this node. It is RREQStampDifficulty, plus one bit when more than RREQStampLoadThreshold route requests were
+// received within a minute, and another bit every time the rate doubles from there.
+func (network *NetworkLayer) StampDifficulty() int {
+	difficulty := network.options.RREQStampDifficulty
+	if difficulty <= 0 {
+		return 0
+	}
+
+	threshold := network.options.RREQStampLoadThreshold
+	load := max(network.rreqLoad.previous, network.rreqLoad.received)
+	if threshold <= 0 || load <= threshold {
+		return difficulty
+	}
+
+	extra := bits.Len(uint(load / threshold))
+	return min(difficulty+min(extra, maxStampLoadBits), max(difficulty, maxStampDifficulty))
+}
+
+// stampRouteRequest adds a stamp of the current difficulty to a route request sent by this node.
+// Under load the difficulty is capped at maxMintDifficulty, such that minting does not block the protocol thread
+// for long. Relays which require more under load do not forward the request, but still answer it.
+func (network *NetworkLayer) stampRouteRequest(rreq *RREQPacket) error {
+	difficulty := min(network.StampDifficulty(), max(network.options.RREQStampDifficulty, maxMintDifficulty))
+	if difficulty <= 0 {
+		return nil
+	}
+
+	stamp, err := mintStamp(rreq, difficulty, network.dev.Rand().Uint64())
+	if err != nil {
+		return err
+	}
+	rreq.Stamp = stamp
+	return nil
+}
@@ -11,7 +11,32 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
-func SessionSecret(container device.ContactsContainer, contact device.ContactID, ephemeral []byte, remoteEphemeral []byte) (device.SharedSecret, error) {
+// SessionSecret derives the secret of a session from the contact secret and the ephemeral X25519 keys.
+// The kemSecret is the ML-KEM shared secret of a hybrid key exchange, or nil for a classic one.
+// It is the secret of KeyDerivationV1, see DeriveSessionKeys.
+func SessionSecret(container device.ContactsContainer, contact device.ContactID, ephemeral []byte, remoteEphemeral []byte, kemSecret []byte) (device.SharedSecret, error) {
+	secret, err := sessionInputKeyMaterial(container, contact, ephemeral, remoteEphemeral, kemSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	defer clear(secret)
+	reader := hkdf.New(sha256.New, secret, nil, nil)
+
+	var sessionSecret [32]byte
+	n, err := reader.Read(sessionSecret[:])
+	if err != nil {
+		return nil, err
+	}
+	if n != 32 {
+		return nil, errors.New("failed to read 32 bytes session secret")
+	}
+
+	return sessionSecret[:], nil
+}
+
+// sessionInputKeyMaterial concatenates the contact secret with the shared secrets of the key exchange.
+func sessionInputKeyMaterial(container device.ContactsContainer, contact device.ContactID, ephemeral []byte, remoteEphemeral []byte, kemSecret []byte) ([]byte, error) {
 	contactSecret, err := container.ContactSecret(contact)
 	if err != nil {
 		return nil, err
@@ -32,19 +57,55 @@ func SessionSecret(container device.ContactsContainer, contact device.ContactID,
 		return nil, err
 	}
 
-	secret := append(contactSecret, ephemeralSecret...)
-	reader := hkdf.New(sha256.New, secret, nil, nil)
+	secret := append([]byte{}, contactSecret...)
+	secret = append(secret, ephemeralSecret...)
+	secret = append(secret, kemSecret...)
+	clear(ephemeralSecret)
+	return secret, nil
+}
 
-	var sessionSecret [32]byte
-	n, err := reader.Read(sessionSecret[:])
-	if err != nil {
-		return nil, err
+// addSession inserts the session into the session table and registers its labels.
+// It fails if one of the labels is already in use by another session on the same link.
+func (network *NetworkLayer) addSession(session *SessionTableEntry) error {
+	if _, found := network.sessionTable[session.SessionID]; found {
+		return errors.New("session id already in use")
 	}
-	if n != 32 {
-		return nil, errors.New("failed to read 32 bytes session secret")
+
+	for _, label := range session.labels() {
+		if _, found := network.labelTable[label]; found {
+			return errors.New("session label already in use")
+		}
 	}
 
-	return sessionSecret[:], nil
+	network.sessionTable[session.SessionID] = session
+	for _, label := range session.labels() {
+		network.labelTable[label] = session.SessionID
+	}
+	return nil
+}
+
+// removeSession deletes the session from the session table along with its labels.
+func (network *NetworkLayer) removeSession(sessionID device.SessionID) {
+	session, found := network.sessionTable[sessionID]
+	if !found {
+		return
+	}
+
+	for _, label := range session.labels() {
+		delete(network.labelTable, label)
+	}
+	delete(network.sessionTable, sessionID)
+	session.keys.wipe()
+	network.removeRelaySession(sessionID)
+}
+
+// sessionByLabel returns the session with the given label on the link to the neighbour.
+func (network *NetworkLayer) sessionByLabel(neighbour device.DeviceAddress, label device.SessionID) (*SessionTableEntry, bool) {
+	sessionID, found := network.labelTable[sessionLabel{neighbour: neighbour, label: label}]
+	if !found {
+		return nil, false
+	}
+	return network.GetSession(sessionID)
 }
 
 func (network *NetworkLayer) GetSession(sessionID device.SessionID) (*SessionTableEntry, bool) {
@@ -81,15 +142,15 @@ func (network *NetworkLayer) SessionBroken(sessID device.SessionID, address *dev
 		sessionTableEntry := network.sessionTable[sessID]
 		if sessionTableEntry != nil {
 			if sessionTableEntry.SourceNeighbour != nil {
-				network.sendRouteError(*sessionTableEntry.SourceNeighbour, sessID)
+				network.sendRouteError(sessionTableEntry, *sessionTableEntry.SourceNeighbour)
 			} else if sessionTableEntry.TargetNeighbour != nil {
-				network.sendRouteError(*sessionTableEntry.TargetNeighbour, sessID)
+				network.sendRouteError(sessionTableEntry, *sessionTableEntry.TargetNeighbour)
 			}
 		}
 	}
 
 	isEndpointSession := network.sessionTable[sessID].EndpointSession()
-	delete(network.sessionTable, sessID)
+	network.removeSession(sessID)
 
 	if isEndpointSession {
 		network.events.SessionBroken(sessID)
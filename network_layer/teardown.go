@@ -0,0 +1,68 @@
+package network_layer
+
+import (
+	"crypto/ed25519"
+	"io"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// Route errors are authenticated per link using a teardown key.
+// Whenever a node sends a RREQ or a RREP, it includes the public key of a fresh teardown key as its commitment.
+// A neighbour can then only tear down the session by signing the label of the session on the link in a RERR,
+// which no other node can do, even if it has observed the route setup. A single RREQ can set up several sessions,
+// e.g. with the members of a group, but the signature only covers one label, so a RERR tearing down one of them
+// cannot be replayed against the others.
+
+// newTeardownKey returns a random teardown key along with the commitment to it.
+func newTeardownKey(cryptoRand io.Reader) (ed25519.PrivateKey, []byte, error) {
+	commitment, key, err := ed25519.GenerateKey(cryptoRand)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, commitment, nil
+}
+
+// teardownToken returns the token revealed in a RERR for the session with the given label on the link.
+func teardownToken(key ed25519.PrivateKey, label device.SessionID) []byte {
+	return ed25519.Sign(key, teardownMessage(label))
+}
+
+func teardownMessage(label device.SessionID) []byte {
+	return EncodeSessionID(label, []byte{byte(RERR)})
+}
+
+// verifyTeardownToken reports whether the token was made for the label with the key of the commitment.
+func verifyTeardownToken(commitment []byte, label device.SessionID, token []byte) bool {
+	if len(commitment) != ed25519.PublicKeySize || len(token) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(commitment, teardownMessage(label), token)
+}
+
+// teardownKey returns the teardown key to sign a RERR to the neighbour with.
+func (s *SessionTableEntry) teardownKey(neighbour device.DeviceAddress) ed25519.PrivateKey {
+	if s.SourceNeighbour != nil && *s.SourceNeighbour == neighbour {
+		return s.sourceTeardownKey
+	}
+	if s.TargetNeighbour != nil && *s.TargetNeighbour == neighbour {
+		return s.targetTeardownKey
+	}
+	return nil
+}
+
+// commitment returns the commitment to the teardown token of the neighbour.
+func (s *SessionTableEntry) commitment(neighbour device.DeviceAddress) []byte {
+	if s.SourceNeighbour != nil && *s.SourceNeighbour == neighbour {
+		return s.sourceCommitment
+	}
+	if s.TargetNeighbour != nil && *s.TargetNeighbour == neighbour {
+		return s.targetCommitment
+	}
+	return nil
+}
+
+// ForgedRouteErrors returns the number of route errors which were dropped, because they were not sent by the neighbour on the session.
+func (network *NetworkLayer) ForgedRouteErrors() int {
+	return network.forgedRouteErrors
+}
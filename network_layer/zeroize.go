@@ -0,0 +1,62 @@
+package network_layer
+
+// Key material is wiped as soon as it is no longer needed, such that a later compromise of the device
+// memory does not reveal the keys of past sessions. Keys are always copied into buffers owned by their
+// holder, and are cleared when the holder is done with them.
+//
+// The private keys of crypto/ecdh and crypto/mlkem cannot be cleared in place,
+// so the references to them are dropped instead.
+
+// wipe clears all keys of the session.
+func (keys *sessionKeys) wipe() {
+	if keys == nil {
+		return
+	}
+	clear(keys.sendKey)
+	clear(keys.recvKey)
+	clear(keys.prevRecvKey)
+	keys.sendKey = nil
+	keys.recvKey = nil
+	keys.prevRecvKey = nil
+}
+
+// wipe clears the key material once it has been copied into the session and used for the RREP.
+func (material *SessionKeyMaterial) wipe() {
+	if material == nil {
+		return
+	}
+	clear(material.ReplyKey)
+	clear(material.InitiatorKey)
+	clear(material.ResponderKey)
+}
+
+// discardEphemeralKeys drops the ephemeral keys of a request, after which replies to it are ignored.
+func (r *RequestTableEntry) discardEphemeralKeys() {
+	r.EphemeralPrivateKey = nil
+	r.kemKey = nil
+}
+
+// replyProcessed is called when a contact replied to the request,
+// and discards the ephemeral keys once every contact has replied.
+// Any number of members may reply to a group, so those keys are kept until they expire.
+func (r *RequestTableEntry) replyProcessed() {
+	if r.groupRequest {
+		return
+	}
+	r.pendingReplies--
+	if r.pendingReplies <= 0 {
+		r.discardEphemeralKeys()
+	}
+}
+
+// expireEphemeralKeys discards the ephemeral keys of the requests sent by this node
+// which have been waiting for replies for longer than the EphemeralKeyLifetime option.
+func (network *NetworkLayer) expireEphemeralKeys() {
+	now := network.dev.Now()
+	for _, request := range network.requestTable {
+		if request.EphemeralPrivateKey != nil && now.Sub(request.created) >= network.options.EphemeralKeyLifetime {
+			network.logf("request:expire_keys:%d", request.RequestID)
+			request.discardEphemeralKeys()
+		}
+	}
+}
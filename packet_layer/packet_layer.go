@@ -12,6 +12,8 @@ import (
 type connection struct {
 	encoder *PacketEncoder
 	decoder *PacketDecoder
+	// leafOnly is set when the peer has announced that it does not relay for others.
+	leafOnly bool
 }
 
 func newConnection(packetSize int) *connection {
@@ -57,6 +59,13 @@ func (link *PacketLayer) OnDisconnection(address device.DeviceAddress) {
 	delete(link.connections, address)
 }
 
+// SetLeafOnly records whether the peer relays for others, see BroadcastBytesExcept.
+func (link *PacketLayer) SetLeafOnly(address device.DeviceAddress, leafOnly bool) {
+	if conn, found := link.connections[address]; found {
+		conn.leafOnly = leafOnly
+	}
+}
+
 func (link *PacketLayer) ReceivePacket(sender device.DeviceAddress, packet []byte) [][]byte {
 	conn, found := link.connections[sender]
 	if !found {
@@ -104,34 +113,43 @@ func (link *PacketLayer) BroadcastBytes(data []byte) {
 	}
 }
 
-// Broadcasts bytes to some of the neighbours, except for exceptAddress
+// Broadcasts bytes to some of the neighbours, except for exceptAddress.
+// Peers which do not relay are not counted when picking a sample of the neighbours,
+// but are always sent the bytes, since they may be the destination.
 func (link *PacketLayer) BroadcastBytesExcept(data []byte, exceptAddress device.DeviceAddress) {
+	relays := []device.DeviceAddress{}
+	for _, address := range utils.ShuffleMapKeys(link.dev.Rand(), link.connections) {
+		if address == exceptAddress {
+			continue
+		}
+		if link.connections[address].leafOnly {
+			link.SendBytes(address, data)
+		} else {
+			relays = append(relays, address)
+		}
+	}
+
 	switch link.options.RREQBroadcastStrategy {
 	case device.BroadcastLogFunc:
 		count := 0
-		connectionCount := len(link.connections) - 1
-		for _, address := range utils.ShuffleMapKeys(link.dev.Rand(), link.connections) {
-			if address != exceptAddress {
-				if count < min(connectionCount, int(math.Log2(float64(connectionCount))+1)) {
-					link.SendBytes(address, data)
-				}
-				count++
+		connectionCount := len(relays)
+		for _, address := range relays {
+			if count < min(connectionCount, int(math.Log2(float64(connectionCount))+1)) {
+				link.SendBytes(address, data)
 			}
+			count++
 		}
 		link.logf("broadcast 'broadcasting packet to %d peer(s)'", count)
 	case device.BroadcastAll:
-		link.logf("broadcast 'broadcasting packet to %d peer(s)'", len(link.connections)-1)
-		for _, address := range utils.ShuffleMapKeys(link.dev.Rand(), link.connections) {
-			if address != exceptAddress {
-				link.SendBytes(address, data)
-			}
+		link.logf("broadcast 'broadcasting packet to %d peer(s)'", len(relays))
+		for _, address := range relays {
+			link.SendBytes(address, data)
 		}
 	case device.BroadcastTwo:
 		count := 0
-		adresses := utils.ShuffleMapKeys(link.dev.Rand(), link.connections)
 		for i := range 2 {
-			if len(adresses) > i {
-				link.SendBytes(adresses[i], data)
+			if len(relays) > i {
+				link.SendBytes(relays[i], data)
 				count++
 			}
 		}
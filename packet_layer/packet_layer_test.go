@@ -0,0 +1,71 @@
+package packet_layer_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/starling-protocol/starling/device"
+	"github.com/starling-protocol/starling/packet_layer"
+	"github.com/starling-protocol/starling/testutils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcastSkipsLeafOnlyPeersWhenSampling(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := device.DefaultProtocolOptions()
+	options.RREQBroadcastStrategy = device.BroadcastLogFunc
+
+	dev := testutils.NewDeviceMock(t, random)
+	link := packet_layer.NewLinkLayer(dev, *options)
+
+	sender := device.DeviceAddress("sender")
+	relays := []device.DeviceAddress{"relay1", "relay2"}
+	leaves := []device.DeviceAddress{"leaf1", "leaf2", "leaf3", "leaf4"}
+
+	link.OnConnection(sender)
+	for _, address := range append(relays, leaves...) {
+		link.OnConnection(address)
+	}
+	for _, address := range leaves {
+		link.SetLeafOnly(address, true)
+	}
+
+	// Without the leaves, both relays are picked, and the leaves are sent the packet as well
+	link.BroadcastBytesExcept([]byte("hello"), sender)
+	assert.Zero(t, dev.PacketsSentTo[sender])
+	for _, address := range append(relays, leaves...) {
+		assert.Equalf(t, 1, dev.PacketsSentTo[address], "packets sent to %s", address)
+	}
+}
+
+func TestBroadcastFromLeafOnlyPeer(t *testing.T) {
+	seed := rand.NewSource(rand.Int63())
+	random := rand.New(seed)
+	t.Logf("Testing with seed: %d", seed.Int63())
+
+	options := device.DefaultProtocolOptions()
+	options.RREQBroadcastStrategy = device.BroadcastLogFunc
+
+	dev := testutils.NewDeviceMock(t, random)
+	link := packet_layer.NewLinkLayer(dev, *options)
+
+	sender := device.DeviceAddress("leaf")
+	relays := []device.DeviceAddress{"relay1", "relay2"}
+
+	link.OnConnection(sender)
+	link.SetLeafOnly(sender, true)
+	for _, address := range relays {
+		link.OnConnection(address)
+	}
+
+	// The sender is not one of the relays, so both relays are picked
+	link.BroadcastBytesExcept([]byte("hello"), sender)
+	assert.Zero(t, dev.PacketsSentTo[sender])
+	for _, address := range relays {
+		assert.Equalf(t, 1, dev.PacketsSentTo[address], "packets sent to %s", address)
+	}
+}
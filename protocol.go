@@ -9,6 +9,7 @@ import (
 	"github.com/starling-protocol/starling/application_layer"
 	"github.com/starling-protocol/starling/contacts"
 	"github.com/starling-protocol/starling/device"
+	"github.com/starling-protocol/starling/network_layer"
 	"github.com/starling-protocol/starling/sync"
 )
 
@@ -63,7 +64,59 @@ func (proto *Protocol) OnDisconnection(address device.DeviceAddress) {
 // The SessionID is obtained from the OnSessionEstablished function of the Device.
 func (proto *Protocol) SendMessage(session device.SessionID, message []byte) (device.MessageID, error) {
 	proto.logf("send_message:%d:%s", session, base64.StdEncoding.EncodeToString(message))
-	return proto.application.SendMessage(session, message)
+	return proto.application.SendMessage(session, message, nil)
+}
+
+// SendMessageWithOptions is called to send a message on a session with the given send options.
+// The default send options are used when options is nil.
+func (proto *Protocol) SendMessageWithOptions(session device.SessionID, message []byte, options *device.SendOptions) (device.MessageID, error) {
+	proto.logf("send_message_with_options:%d:%s", session, base64.StdEncoding.EncodeToString(message))
+	return proto.application.SendMessage(session, message, options)
+}
+
+// CancelMessage stops the delivery of a message that has not been delivered yet.
+// An error is returned if the message was already delivered or is unknown.
+func (proto *Protocol) CancelMessage(messageID device.MessageID) error {
+	proto.logf("cancel_message:%d", messageID)
+	return proto.application.CancelMessage(messageID)
+}
+
+// OpenStream opens a new ordered stream on a session.
+// Streams are delivered independently of messages and of each other,
+// the peer is notified through StreamOpened on its Device once data has been written.
+func (proto *Protocol) OpenStream(session device.SessionID) (device.Stream, error) {
+	proto.logf("open_stream:%d", session)
+	stream, err := proto.application.OpenStream(session)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// SessionMetrics returns the transport metrics of an established session,
+// such as the round trip time and the number of unacknowledged messages.
+func (proto *Protocol) SessionMetrics(session device.SessionID) (*device.SessionMetrics, error) {
+	proto.logf("session_metrics:%d", session)
+	return proto.application.SessionMetrics(session)
+}
+
+// AllSessionMetrics returns the transport metrics of all established sessions.
+func (proto *Protocol) AllSessionMetrics() []device.SessionMetrics {
+	proto.log("all_session_metrics")
+	return proto.application.AllSessionMetrics()
+}
+
+// AddPolicy adds a policy which decides whether packets relayed by this device for others are forwarded,
+// such as to only relay for known neighbours or to limit the relayed traffic. See network_layer.Policy.
+func (proto *Protocol) AddPolicy(policy network_layer.Policy) {
+	proto.logf("add_policy:%T", policy)
+	proto.application.AddPolicy(policy)
+}
+
+// RemovePolicy removes a policy which was added with AddPolicy.
+func (proto *Protocol) RemovePolicy(policy network_layer.Policy) {
+	proto.logf("remove_policy:%T", policy)
+	proto.application.RemovePolicy(policy)
 }
 
 // BroadcastRouteRequest is called to send a route request to all connected peers.
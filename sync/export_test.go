@@ -0,0 +1,8 @@
+package sync
+
+import "github.com/starling-protocol/starling/device"
+
+// ContactModel exposes the model of a contact to the tests, such that they can observe it being wiped.
+func (sync *Sync) ContactModel(contact device.ContactID) *Model {
+	return sync.state[contact]
+}
@@ -56,11 +56,12 @@ type Model struct {
 	Type       ModelType          `json:"type"`
 }
 
+// NewMessage creates a message with its own copy of the attached secret, which is wiped along with the model.
 func NewMessage(value []byte, signature Signature, attachedSecret []byte) Message {
 	return Message{
 		Value:          value,
 		Signature:      signature,
-		AttachedSecret: attachedSecret,
+		AttachedSecret: bytes.Clone(attachedSecret),
 	}
 }
 
@@ -77,10 +78,11 @@ func ExtractNodePublicKey(privateKey ed25519.PrivateKey) NodePublicKey {
 	return nodePK
 }
 
+// NewModel creates a model with its own copy of the private key, which is wiped along with the model.
 func NewModel(privateKey ed25519.PrivateKey, modelType ModelType) *Model {
 	return &Model{
 		Digests:    make(map[NodePublicKey]*Digest),
-		PrivateKey: privateKey,
+		PrivateKey: bytes.Clone(privateKey),
 		PublicKey:  ExtractNodePublicKey(privateKey),
 		NodeStates: ModelNodeStates{},
 		Type:       modelType,
@@ -114,6 +116,16 @@ func (s *Model) NewMessage(value []byte, attachedSecret device.SharedSecret) Ver
 	return newVersion
 }
 
+// wipe clears the private key of the model and the secrets attached to its messages.
+func (s *Model) wipe() {
+	clear(s.PrivateKey)
+	for _, nodeState := range s.NodeStates {
+		for _, msg := range nodeState {
+			clear(msg.AttachedSecret)
+		}
+	}
+}
+
 func (s *Model) Digest() *Digest {
 	if _, found := s.Digests[s.PublicKey]; !found {
 		s.Digests[s.PublicKey] = NewDigest()
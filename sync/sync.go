@@ -85,7 +85,16 @@ func (sync *Sync) NewContact(contact device.ContactID, privateKey ed25519.Privat
 
 func (sync *Sync) DeleteContact(contact device.ContactID) {
 	sync.logf("delete_contact:%s", contact)
+	if model, found := sync.state[contact]; found {
+		model.wipe()
+	}
 	delete(sync.state, contact)
+
+	for session, syncSession := range sync.sessions {
+		if syncSession.contact == contact {
+			delete(sync.sessions, session)
+		}
+	}
 }
 
 func (sync *Sync) HasContact(contact device.ContactID) bool {
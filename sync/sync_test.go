@@ -241,3 +241,44 @@ func TestTransitiveSyncPacketExchange(t *testing.T) {
 	eventsC.PopStateChange(t)
 	eventsC.AssertEmpty(t)
 }
+
+func TestSyncDeleteContactWipesKeys(t *testing.T) {
+	random := rand.New(rand.NewSource(1234))
+
+	privateKey := newPrivateKey(t, random)
+	attachedSecret := make([]byte, 32)
+	random.Read(attachedSecret)
+
+	syncState := sync.NewSync(&mockSyncEvents{})
+	syncState.NewContact("CONTACT_ID", privateKey, sync.ModelTypeGroup)
+	assert.NoError(t, syncState.NewMessage("CONTACT_ID", []byte("message"), attachedSecret))
+
+	state, err := syncState.ContactState("CONTACT_ID")
+	assert.NoError(t, err)
+
+	// Hold on to the buffers of the model, which must be cleared when the contact is deleted
+	model := syncState.ContactModel("CONTACT_ID")
+	modelKey := model.PrivateKey
+	modelSecrets := [][]byte{}
+	for _, nodeState := range model.NodeStates {
+		for _, msg := range nodeState {
+			modelSecrets = append(modelSecrets, msg.AttachedSecret)
+		}
+	}
+	assert.Len(t, modelSecrets, 1)
+
+	syncState.DeleteContact("CONTACT_ID")
+	assert.False(t, syncState.HasContact("CONTACT_ID"))
+
+	assert.Equal(t, make([]byte, len(privateKey)), []byte(modelKey))
+	assert.Equal(t, [][]byte{make([]byte, 32)}, modelSecrets)
+
+	// The private key and attached secret are copied into the model, so the caller's buffers are left alone
+	assert.NotEqual(t, make([]byte, len(privateKey)), []byte(privateKey))
+	assert.NotEqual(t, make([]byte, 32), attachedSecret)
+
+	// The state exported before the deletion is a separate copy
+	exported, err := sync.DecodeModelFromJSON(state)
+	assert.NoError(t, err)
+	assert.NotEqual(t, make([]byte, len(privateKey)), []byte(exported.PrivateKey))
+}
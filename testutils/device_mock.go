@@ -11,17 +11,26 @@ import (
 )
 
 type DeviceMock struct {
-	t                   testing.TB
-	random              *rand.Rand
-	Contacts            *device.MemoryContactsContainer
-	PacketsSent         [][]byte
+	t           testing.TB
+	random      *rand.Rand
+	Contacts    *device.MemoryContactsContainer
+	PacketsSent [][]byte
+	// PacketsSentTo counts the packets sent to each address.
+	PacketsSentTo       map[device.DeviceAddress]int
 	PacketsReceived     []device.MessageID
+	ProgressReports     map[device.MessageID][]int
+	MessagesFailed      []device.MessageID
+	StreamsOpened       []device.Stream
+	StreamsReady        []device.Stream
 	MessagesReceived    [][]byte
 	Sessions            []device.SessionID
 	SessionsEstablished int
 	SessionsBroken      int
 	DelayActions        []func()
 	SyncState           map[device.ContactID][]byte
+	QuarantinedPeers    []device.DeviceAddress
+	// TimeOffset is added to the current time, such that tests can move the clock forward.
+	TimeOffset time.Duration
 }
 
 func NewDeviceMock(t testing.TB, random *rand.Rand) *DeviceMock {
@@ -30,12 +39,18 @@ func NewDeviceMock(t testing.TB, random *rand.Rand) *DeviceMock {
 		random:              random,
 		Contacts:            device.NewMemoryContactsContainer(),
 		PacketsSent:         [][]byte{},
+		PacketsSentTo:       map[device.DeviceAddress]int{},
+		ProgressReports:     map[device.MessageID][]int{},
+		MessagesFailed:      []device.MessageID{},
+		StreamsOpened:       []device.Stream{},
+		StreamsReady:        []device.Stream{},
 		MessagesReceived:    [][]byte{},
 		Sessions:            []device.SessionID{},
 		SessionsEstablished: 0,
 		SessionsBroken:      0,
 		DelayActions:        []func(){},
 		SyncState:           map[device.ContactID][]byte{},
+		QuarantinedPeers:    []device.DeviceAddress{},
 	}
 }
 
@@ -68,6 +83,7 @@ func (d *DeviceMock) Rand() *rand.Rand {
 // SendPacket implements device.Device.
 func (d *DeviceMock) SendPacket(address device.DeviceAddress, packet []byte) {
 	d.PacketsSent = append(d.PacketsSent, packet)
+	d.PacketsSentTo[address]++
 }
 
 // PacketReceived implements device.Device.
@@ -75,6 +91,26 @@ func (d *DeviceMock) MessageDelivered(messageID device.MessageID) {
 	d.PacketsReceived = append(d.PacketsReceived, messageID)
 }
 
+// MessageProgress implements device.Device.
+func (d *DeviceMock) MessageProgress(messageID device.MessageID, sent int, total int) {
+	d.ProgressReports[messageID] = append(d.ProgressReports[messageID], sent)
+}
+
+// StreamOpened implements device.Device.
+func (d *DeviceMock) StreamOpened(session device.SessionID, stream device.Stream) {
+	d.StreamsOpened = append(d.StreamsOpened, stream)
+}
+
+// StreamReady implements device.Device.
+func (d *DeviceMock) StreamReady(session device.SessionID, stream device.Stream) {
+	d.StreamsReady = append(d.StreamsReady, stream)
+}
+
+// MessageFailed implements device.Device.
+func (d *DeviceMock) MessageFailed(messageID device.MessageID) {
+	d.MessagesFailed = append(d.MessagesFailed, messageID)
+}
+
 // ReplyPayload implements device.Device.
 func (d *DeviceMock) ReplyPayload(session device.SessionID, contact device.ContactID) []byte {
 	d.Log("Session requested")
@@ -102,6 +138,11 @@ func (d *DeviceMock) SyncStateChanged(contact device.ContactID, stateUpdate []by
 	d.SyncState[contact] = stateUpdate
 }
 
+// PeerQuarantined implements device.Device.
+func (d *DeviceMock) PeerQuarantined(address device.DeviceAddress) {
+	d.QuarantinedPeers = append(d.QuarantinedPeers, address)
+}
+
 // Delay implements device.Device.
 func (d *DeviceMock) Delay(action func(), duration time.Duration) {
 	// d.t.Logf("Delay by %s", duration.String())
@@ -111,7 +152,7 @@ func (d *DeviceMock) Delay(action func(), duration time.Duration) {
 
 // Now implements device.Device.
 func (d *DeviceMock) Now() time.Time {
-	return time.Now()
+	return time.Now().Add(d.TimeOffset)
 }
 
 // ContactsContainer implements device.Device.
@@ -0,0 +1,141 @@
+package transport_layer
+
+import (
+	"errors"
+	"math"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// maxReassemblies bounds the number of partially received messages kept per session.
+const maxReassemblies = 16
+
+type messageProgress struct {
+	total     int
+	sent      int
+	remaining int
+}
+
+type reassembly struct {
+	count uint16
+	next  uint16
+	data  []byte
+}
+
+// QueueMessage adds a message to the outbox of the session.
+// Messages larger than MaxFragmentSize are split into fragments.
+func (state *SessionState) QueueMessage(transport *TransportLayer, messageID device.MessageID, body []byte, priority device.MessagePriority) error {
+	state.sendLock.Lock()
+	defer state.sendLock.Unlock()
+
+	fragmentSize := transport.options.MaxFragmentSize
+	if fragmentSize <= 0 || len(body) <= fragmentSize {
+		state.enqueue(newOutboxMessage(state.sessionID, messageID, priority, nil, body))
+		return nil
+	}
+
+	count := (len(body) + fragmentSize - 1) / fragmentSize
+	if count > math.MaxUint16 {
+		return errors.New("message too large")
+	}
+
+	fragmentID := state.sender.nextFragmentID
+	state.sender.nextFragmentID++
+
+	fragments := make([]outboxMessage, count)
+	for i := 0; i < count; i++ {
+		fragment := &Fragment{
+			ID:    fragmentID,
+			Index: uint16(i),
+			Count: uint16(count),
+		}
+		chunk := body[i*fragmentSize : min((i+1)*fragmentSize, len(body))]
+		fragments[i] = newOutboxMessage(state.sessionID, messageID, priority, fragment, chunk)
+	}
+	state.enqueue(fragments...)
+
+	state.sender.progress[messageID] = &messageProgress{
+		total:     len(body),
+		sent:      0,
+		remaining: count,
+	}
+
+	transport.logf("session:fragment:%d:%d '%d fragment(s)'", state.sessionID, messageID, count)
+	return nil
+}
+
+// messageAcknowledged is called with the send lock held when a message in awaitingACKs has been acknowledged.
+// Fragmented messages report their progress and are only delivered when all fragments have been acknowledged.
+func (state *SessionState) messageAcknowledged(transport *TransportLayer, message outboxMessage) {
+	if message.stream != nil || message.window != nil {
+		// Stream chunks and window announcements are not reported to the device
+		return
+	}
+
+	if message.fragment == nil {
+		transport.events.MessageDelivered(message.messageID)
+		return
+	}
+
+	progress, found := state.sender.progress[message.messageID]
+	if !found {
+		return
+	}
+
+	progress.sent += len(message.body)
+	progress.remaining--
+	transport.events.MessageProgress(message.messageID, progress.sent, progress.total)
+
+	if progress.remaining == 0 {
+		delete(state.sender.progress, message.messageID)
+		transport.events.MessageDelivered(message.messageID)
+	}
+}
+
+// ReassembleFragment appends a delivered fragment to its message.
+// Fragments are delivered in order, so the full message is returned once its last fragment has been added.
+func (state *SessionState) ReassembleFragment(transport *TransportLayer, packet *DATAPacket) ([]byte, bool) {
+	state.receiveLock.Lock()
+	defer state.receiveLock.Unlock()
+
+	fragment := packet.Fragment
+	reassemblies := state.receiver.reassemblies
+
+	entry, found := reassemblies[fragment.ID]
+	if !found {
+		if fragment.Index != 0 {
+			transport.logf("session:reassemble:drop:%d:%d 'missing start of message'", state.sessionID, fragment.ID)
+			return nil, false
+		}
+
+		if len(reassemblies) >= maxReassemblies {
+			oldest := fragment.ID
+			for id := range reassemblies {
+				if int32(id-oldest) < 0 {
+					oldest = id
+				}
+			}
+			transport.logf("session:reassemble:evict:%d:%d", state.sessionID, oldest)
+			delete(reassemblies, oldest)
+		}
+
+		entry = &reassembly{count: fragment.Count}
+		reassemblies[fragment.ID] = entry
+	}
+
+	if fragment.Index != entry.next || fragment.Count != entry.count {
+		transport.logf("session:reassemble:drop:%d:%d 'unexpected fragment %d/%d'", state.sessionID, fragment.ID, fragment.Index, fragment.Count)
+		delete(reassemblies, fragment.ID)
+		return nil, false
+	}
+
+	entry.data = append(entry.data, packet.Data...)
+	entry.next++
+
+	if entry.next < entry.count {
+		return nil, false
+	}
+
+	delete(reassemblies, fragment.ID)
+	return entry.data, true
+}
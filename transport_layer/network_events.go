@@ -12,12 +12,13 @@ type networkEvents struct {
 func (n *networkEvents) SessionBroken(session device.SessionID) {
 	n.transport.events.SessionBroken(session)
 
-	awaitingAcks := 0
+	pendingMessages := 0
 	state, found := n.transport.sessionStates[session]
 	if found {
-		awaitingAcks = len(state.sender.awaitingACKs)
+		pendingMessages = len(state.sender.outbox) + len(state.sender.awaitingACKs)
+		state.closeStreams(errSessionBroken)
 	}
-	if len(n.transport.outbox)+awaitingAcks > 0 {
+	if pendingMessages > 0 {
 		n.transport.networkLayer.BroadcastRouteRequest()
 	}
 }
@@ -26,6 +27,8 @@ func (n *networkEvents) SessionBroken(session device.SessionID) {
 func (n *networkEvents) SessionEstablished(session device.SessionID, contact device.ContactID, address device.DeviceAddress, payload []byte, isInitiator bool) {
 	var applicationPayload []byte = nil
 
+	n.transport.SessionState(session).setInitiator(isInitiator)
+
 	if len(payload) > 0 {
 		payloadMessages := n.transport.handlePacket(session, payload)
 		if len(payloadMessages) > 0 {
@@ -36,6 +39,8 @@ func (n *networkEvents) SessionEstablished(session device.SessionID, contact dev
 		}
 	}
 
+	n.transport.SessionState(session).startHeartbeatTimer(n.transport)
+
 	n.transport.events.SessionEstablished(session, contact, address, applicationPayload, isInitiator)
 }
 
@@ -5,8 +5,15 @@ import "errors"
 type PacketType int64
 
 const (
-	DATA PacketType = 0x01
-	ACK  PacketType = 0x02
+	DATA      PacketType = 0x01
+	ACK       PacketType = 0x02
+	SACK      PacketType = 0x03
+	DATAGRAM  PacketType = 0x04
+	SKIP      PacketType = 0x05
+	HEARTBEAT PacketType = 0x06
+	// EXTDATA is a DATA packet with a flags byte announcing extension headers,
+	// such that nodes which only know plain DATA packets do not mistake the headers for data.
+	EXTDATA PacketType = 0x07
 )
 
 type Packet interface {
@@ -14,16 +21,36 @@ type Packet interface {
 	PacketType() PacketType
 }
 
+// acknowledgement is implemented by the packets which acknowledge received DATA packets.
+type acknowledgement interface {
+	// latest returns the latest sequence ID covered by the acknowledgement.
+	latest() SequenceID
+	// missing returns whether the sequence ID is reported as not received.
+	missing(seq SequenceID) bool
+}
+
 func (transport *TransportLayer) decodeTransportPacket(data []byte) (Packet, error) {
 	transport.logf("decode:packet 'Decoding packet of %d bytes'", len(data))
 
+	if len(data) == 0 {
+		return nil, errors.New("empty transport packet")
+	}
+
 	packet_type := PacketType(data[0])
 
 	switch packet_type {
-	case DATA:
+	case DATA, EXTDATA:
 		return DecodeDataPacket(data)
 	case ACK:
 		return DecodeACKPacket(data)
+	case SACK:
+		return DecodeSACKPacket(data)
+	case DATAGRAM:
+		return DecodeDATAGRAMPacket(data)
+	case SKIP:
+		return DecodeSKIPPacket(data)
+	case HEARTBEAT:
+		return DecodeHEARTBEATPacket(data)
 	default:
 		return nil, errors.New("invalid transport packet type")
 	}
@@ -3,6 +3,7 @@ package transport_layer
 import (
 	"encoding/binary"
 	"fmt"
+	"slices"
 
 	"github.com/starling-protocol/starling/device"
 )
@@ -23,6 +24,14 @@ func (d *ACKPacket) PacketType() PacketType {
 	return ACK
 }
 
+func (d *ACKPacket) latest() SequenceID {
+	return d.LatestSeqID
+}
+
+func (d *ACKPacket) missing(seq SequenceID) bool {
+	return slices.Contains(d.MissingSeqIDs, seq)
+}
+
 func (d *ACKPacket) EncodePacket() []byte {
 	buf := []byte{}
 
@@ -62,8 +71,8 @@ func DecodeACKPacket(buf []byte) (*ACKPacket, error) {
 	return ackPacket, nil
 }
 
-func (transport *TransportLayer) handleACKPacket(sessionID device.SessionID, packet *ACKPacket) {
-	transport.logf("packet:ack:handle:%d:%d", sessionID, packet.LatestSeqID)
+func (transport *TransportLayer) handleACKPacket(sessionID device.SessionID, packet acknowledgement) {
+	transport.logf("packet:ack:handle:%d:%d", sessionID, packet.latest())
 
 	_, found := transport.networkLayer.GetSession(sessionID)
 	if !found {
@@ -76,6 +85,13 @@ func (transport *TransportLayer) handleACKPacket(sessionID device.SessionID, pac
 	resendPackets := state.ReceiveACK(transport, packet)
 
 	for _, packet := range resendPackets {
-		transport.networkLayer.SendData(sessionID, packet.EncodePacket())
+		if dataPacket, ok := packet.(*DATAPacket); ok && dataPacket.ACK == nil {
+			dataPacket.ACK = state.piggybackACK()
+		}
+		transport.sendPacket(sessionID, packet)
+	}
+
+	if err := transport.sendOutbox(state); err != nil {
+		transport.logf("packet:ack:send_outbox:error:%d '%v'", sessionID, err)
 	}
 }
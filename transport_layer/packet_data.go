@@ -1,14 +1,43 @@
 package transport_layer
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/starling-protocol/starling/device"
 )
 
+type dataFlags byte
+
+const (
+	dataFlagFragment dataFlags = 1 << iota
+	dataFlagACK
+	dataFlagStream
+	dataFlagStreamFin
+	dataFlagStreamWindow
+	dataFlagStreamReset
+)
+
+// A Fragment marks a DATA packet as carrying one part of a larger message.
+type Fragment struct {
+	// ID identifies the fragmented message within the session.
+	ID uint32
+	// Index is the position of this fragment within the message.
+	Index uint16
+	// Count is the total number of fragments of the message.
+	Count uint16
+}
+
 type DATAPacket struct {
-	SeqID SequenceID
-	Data  []byte
+	SeqID    SequenceID
+	Fragment *Fragment
+	Stream   *StreamFrame
+	Window   *StreamWindowUpdate
+	// ACK is an optional acknowledgement piggybacked on the packet.
+	ACK  *SACKPacket
+	Data []byte
+	// skipped marks a placeholder for a sequence ID that the sender dropped
+	skipped bool
 }
 
 func NewDATAPacket(seqID SequenceID, data []byte) *DATAPacket {
@@ -18,15 +47,72 @@ func NewDATAPacket(seqID SequenceID, data []byte) *DATAPacket {
 	}
 }
 
+func NewFragmentDATAPacket(seqID SequenceID, fragment Fragment, data []byte) *DATAPacket {
+	return &DATAPacket{
+		SeqID:    seqID,
+		Fragment: &fragment,
+		Data:     data,
+	}
+}
+
 func (d *DATAPacket) PacketType() PacketType {
 	return DATA
 }
 
+func (d *DATAPacket) flags() dataFlags {
+	flags := dataFlags(0)
+	if d.Fragment != nil {
+		flags |= dataFlagFragment
+	}
+	if d.ACK != nil {
+		flags |= dataFlagACK
+	}
+	if d.Window != nil {
+		flags |= dataFlagStreamWindow
+	}
+	if d.Stream != nil {
+		flags |= dataFlagStream
+		if d.Stream.Fin {
+			flags |= dataFlagStreamFin
+		}
+		if d.Stream.Reset {
+			flags |= dataFlagStreamReset
+		}
+	}
+	return flags
+}
+
+// EncodePacket encodes the packet as a plain DATA packet, or as an EXTDATA packet if it has any extension headers.
 func (d *DATAPacket) EncodePacket() []byte {
 	buf := []byte{}
 
-	buf = append(buf, byte(DATA))
+	flags := d.flags()
+	if flags == 0 {
+		buf = append(buf, byte(DATA))
+		buf = d.SeqID.Encode(buf)
+		buf = append(buf, d.Data...)
+		return buf
+	}
+
+	buf = append(buf, byte(EXTDATA))
 	buf = d.SeqID.Encode(buf)
+	buf = append(buf, byte(flags))
+	if d.Fragment != nil {
+		buf = binary.BigEndian.AppendUint32(buf, d.Fragment.ID)
+		buf = binary.BigEndian.AppendUint16(buf, d.Fragment.Index)
+		buf = binary.BigEndian.AppendUint16(buf, d.Fragment.Count)
+	}
+	if d.Stream != nil {
+		buf = binary.BigEndian.AppendUint32(buf, d.Stream.ID)
+		buf = binary.BigEndian.AppendUint32(buf, d.Stream.Seq)
+	}
+	if d.Window != nil {
+		buf = binary.BigEndian.AppendUint32(buf, d.Window.ID)
+		buf = binary.BigEndian.AppendUint32(buf, d.Window.Limit)
+	}
+	if d.ACK != nil {
+		buf = d.ACK.encodeBody(buf)
+	}
 	buf = append(buf, d.Data...)
 
 	return buf
@@ -37,14 +123,79 @@ func DecodeDataPacket(buf []byte) (*DATAPacket, error) {
 		return nil, fmt.Errorf("buffer too small when decoding DATA packet: %d", len(buf))
 	}
 
-	if buf[0] != byte(DATA) {
-		return nil, fmt.Errorf("wrong packet header when decoding ACP packet: %d", buf[0])
+	if buf[0] != byte(DATA) && buf[0] != byte(EXTDATA) {
+		return nil, fmt.Errorf("wrong packet header when decoding DATA packet: %d", buf[0])
 	}
 
 	seqID := DecodeSequenceID(buf[1:])
-	data := buf[5:]
 
-	dataPacket := NewDATAPacket(seqID, data)
+	if buf[0] == byte(DATA) {
+		return NewDATAPacket(seqID, buf[5:]), nil
+	}
+
+	if len(buf) < 6 {
+		return nil, fmt.Errorf("buffer too small when decoding EXTDATA packet: %d", len(buf))
+	}
+	flags := dataFlags(buf[5])
+	buf = buf[6:]
+
+	if flags&^(dataFlagFragment|dataFlagACK|dataFlagStream|dataFlagStreamFin|dataFlagStreamWindow|dataFlagStreamReset) != 0 {
+		return nil, fmt.Errorf("unknown flags when decoding DATA packet: %d", flags)
+	}
+
+	if flags&(dataFlagStreamFin|dataFlagStreamReset) != 0 && flags&dataFlagStream == 0 {
+		return nil, fmt.Errorf("stream fin or reset flag without stream when decoding DATA packet: %d", flags)
+	}
+
+	dataPacket := NewDATAPacket(seqID, nil)
+
+	if flags&dataFlagFragment != 0 {
+		if len(buf) < 8 {
+			return nil, fmt.Errorf("buffer too small when decoding DATA fragment header: %d", len(buf))
+		}
+
+		dataPacket.Fragment = &Fragment{
+			ID:    binary.BigEndian.Uint32(buf[0:]),
+			Index: binary.BigEndian.Uint16(buf[4:]),
+			Count: binary.BigEndian.Uint16(buf[6:]),
+		}
+		buf = buf[8:]
+	}
+
+	if flags&dataFlagStream != 0 {
+		if len(buf) < 8 {
+			return nil, fmt.Errorf("buffer too small when decoding DATA stream header: %d", len(buf))
+		}
+		dataPacket.Stream = &StreamFrame{
+			ID:    binary.BigEndian.Uint32(buf[0:]),
+			Seq:   binary.BigEndian.Uint32(buf[4:]),
+			Fin:   flags&dataFlagStreamFin != 0,
+			Reset: flags&dataFlagStreamReset != 0,
+		}
+		buf = buf[8:]
+	}
+
+	if flags&dataFlagStreamWindow != 0 {
+		if len(buf) < 8 {
+			return nil, fmt.Errorf("buffer too small when decoding DATA stream window: %d", len(buf))
+		}
+		dataPacket.Window = &StreamWindowUpdate{
+			ID:    binary.BigEndian.Uint32(buf[0:]),
+			Limit: binary.BigEndian.Uint32(buf[4:]),
+		}
+		buf = buf[8:]
+	}
+
+	if flags&dataFlagACK != 0 {
+		ack, rest, err := decodeSACKBody(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid piggybacked ACK in DATA packet: %w", err)
+		}
+		dataPacket.ACK = ack
+		buf = rest
+	}
+
+	dataPacket.Data = buf
 
 	return dataPacket, nil
 }
@@ -52,22 +203,62 @@ func DecodeDataPacket(buf []byte) (*DATAPacket, error) {
 func (transport *TransportLayer) handleDataPacket(sessionID device.SessionID, packet *DATAPacket) []TransportMessage {
 	transport.logf("packet:data:handle:%d:%d", sessionID, packet.SeqID)
 
-	session, found := transport.networkLayer.GetSession(sessionID)
-	if !found {
+	if _, found := transport.networkLayer.GetSession(sessionID); !found {
 		transport.logf("packet:data:handle:error:%d 'session was not found, ignoring packet'", sessionID)
 		return nil
 	}
 
 	state := transport.SessionState(sessionID)
 
-	packets := state.ReceiveDATA(transport, packet)
+	messages := transport.deliverDataPackets(sessionID, state.ReceiveDATA(transport, packet))
+
+	// The piggybacked ACK is handled after the data, such that any packets sent in response carry the latest ACK
+	if packet.ACK != nil {
+		transport.handleACKPacket(sessionID, packet.ACK)
+	}
+
+	return messages
+}
+
+// deliverDataPackets turns in-order DATA packets into messages, reassembling fragmented messages
+// and leaving out the placeholders for skipped sequence IDs.
+func (transport *TransportLayer) deliverDataPackets(sessionID device.SessionID, packets []*DATAPacket) []TransportMessage {
+	session, found := transport.networkLayer.GetSession(sessionID)
+	if !found {
+		return nil
+	}
+
+	state := transport.SessionState(sessionID)
 
 	messagesToDeliver := []TransportMessage{}
 	for _, p := range packets {
+		if p.skipped {
+			continue
+		}
+
+		if p.Stream != nil {
+			transport.receiveStreamPacket(state, p)
+		}
+		if p.Window != nil {
+			transport.receiveStreamWindow(state, p.Window)
+		}
+		if p.Stream != nil || p.Window != nil {
+			continue
+		}
+
+		data := p.Data
+		if p.Fragment != nil {
+			message, complete := state.ReassembleFragment(transport, p)
+			if !complete {
+				continue
+			}
+			data = message
+		}
+
 		messagesToDeliver = append(messagesToDeliver, TransportMessage{
 			Contact: *session.Contact,
 			Session: sessionID,
-			Data:    p.Data,
+			Data:    data,
 		})
 	}
 
@@ -23,16 +23,92 @@ func FuzzCodingDataPacket(f *testing.F) {
 		assert.NoError(t, err)
 
 		assert.EqualValues(t, packet, decoded)
+
+		// Packets without extension headers keep the plain DATA layout
+		assert.Equal(t, byte(transport_layer.DATA), encoded[0])
+		assert.Len(t, encoded, 5+len(data))
 	})
 
 }
 
+func FuzzCodingPiggybackedACKDataPacket(f *testing.F) {
+	f.Add(uint32(12), uint32(10), uint32(4), uint16(2), []byte("hello"))
+
+	f.Fuzz(func(t *testing.T, _seqID uint32, latestSeqID uint32, missingStart uint32, missingLength uint16, data []byte) {
+		missing := []transport_layer.SequenceID{}
+		for i := uint16(0); i < missingLength%64; i++ {
+			missing = append(missing, transport_layer.SequenceID(missingStart)+transport_layer.SequenceID(i))
+		}
+
+		packet := transport_layer.NewDATAPacket(transport_layer.SequenceID(_seqID), data)
+		packet.ACK = transport_layer.NewSACKPacket(transport_layer.SequenceID(latestSeqID), missing)
+
+		encoded := packet.EncodePacket()
+		decoded, err := transport_layer.DecodeDataPacket(encoded)
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, packet, decoded)
+	})
+}
+
+func FuzzCodingStreamDataPacket(f *testing.F) {
+	f.Add(uint32(1), uint32(42), uint32(0), false, false, []byte("hello"))
+	f.Add(uint32(2), uint32(42), uint32(1), true, false, []byte{})
+	f.Add(uint32(3), uint32(43), uint32(0), false, true, []byte{})
+
+	f.Fuzz(func(t *testing.T, _seqID uint32, streamID uint32, streamSeq uint32, fin bool, reset bool, data []byte) {
+		packet := transport_layer.NewDATAPacket(transport_layer.SequenceID(_seqID), data)
+		packet.Stream = &transport_layer.StreamFrame{ID: streamID, Seq: streamSeq, Fin: fin, Reset: reset}
+
+		encoded := packet.EncodePacket()
+		decoded, err := transport_layer.DecodeDataPacket(encoded)
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, packet, decoded)
+	})
+}
+
+func FuzzCodingStreamWindowDataPacket(f *testing.F) {
+	f.Add(uint32(1), uint32(42), uint32(64))
+
+	f.Fuzz(func(t *testing.T, _seqID uint32, streamID uint32, limit uint32) {
+		packet := transport_layer.NewDATAPacket(transport_layer.SequenceID(_seqID), []byte{})
+		packet.Window = &transport_layer.StreamWindowUpdate{ID: streamID, Limit: limit}
+
+		encoded := packet.EncodePacket()
+		decoded, err := transport_layer.DecodeDataPacket(encoded)
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, packet, decoded)
+	})
+}
+
+func FuzzCodingFragmentDataPacket(f *testing.F) {
+	f.Add(uint32(1), uint32(7), uint16(0), uint16(3), []byte("hello"))
+
+	f.Fuzz(func(t *testing.T, _seqID uint32, id uint32, index uint16, count uint16, data []byte) {
+		seqID := transport_layer.SequenceID(_seqID)
+		fragment := transport_layer.Fragment{ID: id, Index: index, Count: count}
+
+		packet := transport_layer.NewFragmentDATAPacket(seqID, fragment, data)
+
+		encoded := packet.EncodePacket()
+		decoded, err := transport_layer.DecodeDataPacket(encoded)
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, packet, decoded)
+	})
+}
+
 func FuzzDecodingDataPacket(f *testing.F) {
 	random := rand.New(rand.NewSource(1234))
 
 	packet := transport_layer.NewDATAPacket(1, []byte("hello"))
 	f.Add(packet.EncodePacket())
 
+	fragment := transport_layer.NewFragmentDATAPacket(2, transport_layer.Fragment{ID: 1, Index: 0, Count: 2}, []byte("hello"))
+	f.Add(fragment.EncodePacket())
+
 	invalid_packet := [45]byte{}
 	if n, err := random.Read(invalid_packet[:]); n != 45 || err != nil {
 		f.Fatal()
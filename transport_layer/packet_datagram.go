@@ -0,0 +1,82 @@
+package transport_layer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// DATAGRAMPacket carries a message without a sequence ID.
+// It is never acknowledged or retransmitted and is delivered immediately in any order.
+type DATAGRAMPacket struct {
+	Data []byte
+}
+
+func NewDATAGRAMPacket(data []byte) *DATAGRAMPacket {
+	return &DATAGRAMPacket{
+		Data: data,
+	}
+}
+
+func (d *DATAGRAMPacket) PacketType() PacketType {
+	return DATAGRAM
+}
+
+func (d *DATAGRAMPacket) EncodePacket() []byte {
+	buf := []byte{}
+
+	buf = append(buf, byte(DATAGRAM))
+	buf = append(buf, d.Data...)
+
+	return buf
+}
+
+func DecodeDATAGRAMPacket(buf []byte) (*DATAGRAMPacket, error) {
+	if len(buf) < 1 {
+		return nil, fmt.Errorf("buffer too small when decoding DATAGRAM packet: %d", len(buf))
+	}
+
+	if buf[0] != byte(DATAGRAM) {
+		return nil, fmt.Errorf("wrong packet header when decoding DATAGRAM packet: %d", buf[0])
+	}
+
+	return NewDATAGRAMPacket(buf[1:]), nil
+}
+
+// SendDatagram sends a message on the session without sequencing or acknowledgements.
+// The message is not retransmitted if it is lost and no delivery notification is given.
+func (transport *TransportLayer) SendDatagram(sessionID device.SessionID, message []byte) (device.MessageID, error) {
+	if _, found := transport.networkLayer.GetSession(sessionID); !found {
+		return 0, errors.New("session not found")
+	}
+
+	if transport.options.MaxFragmentSize > 0 && len(message) > transport.options.MaxFragmentSize {
+		return 0, fmt.Errorf("datagram of %d bytes exceeds the max fragment size", len(message))
+	}
+
+	messageID := device.MessageID(transport.dev.Rand().Uint64())
+	packet := NewDATAGRAMPacket(message)
+
+	if err := transport.sendPacket(sessionID, packet); err != nil {
+		return 0, err
+	}
+
+	return messageID, nil
+}
+
+func (transport *TransportLayer) handleDatagramPacket(sessionID device.SessionID, packet *DATAGRAMPacket) []TransportMessage {
+	transport.logf("packet:datagram:handle:%d", sessionID)
+
+	session, found := transport.networkLayer.GetSession(sessionID)
+	if !found {
+		transport.logf("packet:datagram:handle:error:%d 'session was not found, ignoring packet'", sessionID)
+		return nil
+	}
+
+	return []TransportMessage{{
+		Contact: *session.Contact,
+		Session: sessionID,
+		Data:    packet.Data,
+	}}
+}
@@ -0,0 +1,26 @@
+package transport_layer_test
+
+import (
+	"testing"
+
+	"github.com/starling-protocol/starling/transport_layer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func FuzzCodingDatagramPacket(f *testing.F) {
+	f.Add([]byte("hello"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet := transport_layer.NewDATAGRAMPacket(data)
+
+		encoded := packet.EncodePacket()
+		assert.Len(t, encoded, 1+len(data))
+
+		decoded, err := transport_layer.DecodeDATAGRAMPacket(encoded)
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, packet.Data, decoded.Data)
+	})
+}
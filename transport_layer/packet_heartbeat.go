@@ -0,0 +1,128 @@
+package transport_layer
+
+import (
+	"fmt"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// HEARTBEATPacket probes an idle session, the peer answers with a reply heartbeat.
+type HEARTBEATPacket struct {
+	Reply bool
+}
+
+func NewHEARTBEATPacket(reply bool) *HEARTBEATPacket {
+	return &HEARTBEATPacket{
+		Reply: reply,
+	}
+}
+
+func (d *HEARTBEATPacket) PacketType() PacketType {
+	return HEARTBEAT
+}
+
+func (d *HEARTBEATPacket) EncodePacket() []byte {
+	buf := []byte{}
+
+	buf = append(buf, byte(HEARTBEAT))
+	if d.Reply {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+
+	return buf
+}
+
+func DecodeHEARTBEATPacket(buf []byte) (*HEARTBEATPacket, error) {
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("buffer too small when decoding HEARTBEAT packet: %d", len(buf))
+	}
+
+	if buf[0] != byte(HEARTBEAT) {
+		return nil, fmt.Errorf("wrong packet header when decoding HEARTBEAT packet: %d", buf[0])
+	}
+
+	if buf[1] > 1 {
+		return nil, fmt.Errorf("invalid reply flag when decoding HEARTBEAT packet: %d", buf[1])
+	}
+
+	return NewHEARTBEATPacket(buf[1] == 1), nil
+}
+
+func (transport *TransportLayer) handleHeartbeatPacket(sessionID device.SessionID, packet *HEARTBEATPacket) {
+	transport.logf("packet:heartbeat:handle:%d:%t", sessionID, packet.Reply)
+
+	if packet.Reply {
+		return
+	}
+
+	reply := NewHEARTBEATPacket(true)
+	if err := transport.sendPacket(sessionID, reply); err != nil {
+		transport.logf("packet:heartbeat:reply:error:%d '%v'", sessionID, err)
+	}
+}
+
+// startHeartbeatTimer periodically checks whether anything has been received on the session.
+// A heartbeat is sent when the session has been idle for a whole interval,
+// and the session is timed out once MaxMissedHeartbeats heartbeats in a row went unanswered.
+func (state *SessionState) startHeartbeatTimer(transport *TransportLayer) {
+	interval := transport.options.HeartbeatInterval
+	if interval <= 0 {
+		return
+	}
+
+	state.receiveLock.Lock()
+	if state.receiver.heartbeatTimer {
+		state.receiveLock.Unlock()
+		return
+	}
+	state.receiver.heartbeatTimer = true
+	state.receiveLock.Unlock()
+
+	var beat func()
+	beat = func() {
+		if current, found := transport.sessionStates[state.sessionID]; !found || current != state {
+			transport.logf("session:timer:heartbeat:stopped:%d 'session state was removed'", state.sessionID)
+			return
+		}
+
+		state.receiveLock.Lock()
+		if state.receiver.activity {
+			state.receiver.activity = false
+			state.receiver.missedHeartbeats = 0
+			state.receiveLock.Unlock()
+			transport.dev.Delay(beat, interval)
+			return
+		}
+
+		if state.receiver.missedHeartbeats >= transport.options.MaxMissedHeartbeats {
+			state.receiver.heartbeatTimer = false
+			state.receiveLock.Unlock()
+			transport.logf("session:timer:heartbeat:timed_out:%d 'no heartbeat reply, breaking session'", state.sessionID)
+			transport.TimeoutSession(state.sessionID)
+			return
+		}
+
+		state.receiver.missedHeartbeats++
+		state.receiveLock.Unlock()
+
+		transport.logf("session:timer:heartbeat:send:%d 'session is idle, sending heartbeat'", state.sessionID)
+		heartbeat := NewHEARTBEATPacket(false)
+		if err := transport.sendPacket(state.sessionID, heartbeat); err != nil {
+			transport.logf("session:timer:heartbeat:send:error:%d '%v'", state.sessionID, err)
+		}
+
+		transport.dev.Delay(beat, interval)
+	}
+
+	transport.dev.Delay(beat, interval)
+}
+
+// markActivity records that a packet was received on the session.
+func (state *SessionState) markActivity() {
+	state.receiveLock.Lock()
+	defer state.receiveLock.Unlock()
+
+	state.receiver.activity = true
+}
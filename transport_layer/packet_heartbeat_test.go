@@ -0,0 +1,37 @@
+package transport_layer_test
+
+import (
+	"testing"
+
+	"github.com/starling-protocol/starling/transport_layer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func FuzzCodingHeartbeatPacket(f *testing.F) {
+	f.Add(false)
+	f.Add(true)
+
+	f.Fuzz(func(t *testing.T, reply bool) {
+		packet := transport_layer.NewHEARTBEATPacket(reply)
+
+		encoded := packet.EncodePacket()
+		assert.Len(t, encoded, 2)
+
+		decoded, err := transport_layer.DecodeHEARTBEATPacket(encoded)
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, packet, decoded)
+	})
+}
+
+func FuzzDecodingHeartbeatPacket(f *testing.F) {
+	f.Add(transport_layer.NewHEARTBEATPacket(false).EncodePacket())
+	f.Add([]byte{0x06, 0x02})
+
+	f.Fuzz(func(t *testing.T, bytes []byte) {
+		assert.NotPanics(t, func() {
+			transport_layer.DecodeHEARTBEATPacket(bytes)
+		})
+	})
+}
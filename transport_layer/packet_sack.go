@@ -0,0 +1,144 @@
+package transport_layer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MaxSACKRanges is the maximum number of missing ranges reported in a single SACK packet.
+// It bounds the size of an encoded SACK packet to 6+MaxSACKRanges*6 bytes.
+const MaxSACKRanges = 16
+
+// A SequenceRange is a consecutive run of sequence IDs starting at Start.
+type SequenceRange struct {
+	Start  SequenceID
+	Length uint16
+}
+
+// Contains returns whether the sequence ID lies within the range.
+func (r SequenceRange) Contains(seq SequenceID) bool {
+	return uint32(seq-r.Start) < uint32(r.Length)
+}
+
+// SACKPacket is a selective acknowledgement that reports missing sequence IDs as ranges.
+// Everything up to and including LatestSeqID that is not in one of the missing ranges has been received.
+type SACKPacket struct {
+	LatestSeqID   SequenceID
+	MissingRanges []SequenceRange
+}
+
+// NewSACKPacket compresses the sorted list of missing sequence IDs into ranges.
+// When there are more holes than fit in MaxSACKRanges, the oldest holes are reported
+// and LatestSeqID is lowered to just before the first hole that was left out,
+// such that the sender does not consider the unreported packets delivered.
+func NewSACKPacket(latestSeqID SequenceID, missingSeqIDs []SequenceID) *SACKPacket {
+	ranges := []SequenceRange{}
+
+	for _, seq := range missingSeqIDs {
+		if len(ranges) > 0 {
+			last := &ranges[len(ranges)-1]
+			if seq == last.Start+SequenceID(last.Length) && last.Length < math.MaxUint16 {
+				last.Length++
+				continue
+			}
+		}
+
+		if len(ranges) == MaxSACKRanges {
+			latestSeqID = seq - 1
+			break
+		}
+
+		ranges = append(ranges, SequenceRange{Start: seq, Length: 1})
+	}
+
+	return &SACKPacket{
+		LatestSeqID:   latestSeqID,
+		MissingRanges: ranges,
+	}
+}
+
+func (d *SACKPacket) PacketType() PacketType {
+	return SACK
+}
+
+func (d *SACKPacket) latest() SequenceID {
+	return d.LatestSeqID
+}
+
+func (d *SACKPacket) missing(seq SequenceID) bool {
+	for _, r := range d.MissingRanges {
+		if r.Contains(seq) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *SACKPacket) EncodePacket() []byte {
+	buf := []byte{}
+
+	buf = append(buf, byte(SACK))
+	buf = d.encodeBody(buf)
+
+	return buf
+}
+
+// encodeBody appends the SACK packet without its header,
+// such that it can be embedded in other packets.
+func (d *SACKPacket) encodeBody(buf []byte) []byte {
+	buf = d.LatestSeqID.Encode(buf)
+	buf = append(buf, byte(len(d.MissingRanges)))
+	for _, r := range d.MissingRanges {
+		// The start of a range is encoded as its distance below the latest sequence ID
+		buf = binary.BigEndian.AppendUint32(buf, uint32(d.LatestSeqID-r.Start))
+		buf = binary.BigEndian.AppendUint16(buf, r.Length)
+	}
+
+	return buf
+}
+
+func DecodeSACKPacket(buf []byte) (*SACKPacket, error) {
+	if len(buf) < 6 {
+		return nil, fmt.Errorf("buffer too small when decoding SACK packet: %d", len(buf))
+	}
+
+	if buf[0] != byte(SACK) {
+		return nil, fmt.Errorf("wrong packet header when decoding SACK packet: %d", buf[0])
+	}
+
+	packet, _, err := decodeSACKBody(buf[1:])
+	return packet, err
+}
+
+// decodeSACKBody decodes a SACK packet without its header and returns the remaining bytes.
+func decodeSACKBody(buf []byte) (*SACKPacket, []byte, error) {
+	if len(buf) < 5 {
+		return nil, nil, fmt.Errorf("buffer too small when decoding SACK packet: %d", len(buf))
+	}
+
+	latestSeqID := DecodeSequenceID(buf[0:])
+	count := int(buf[4])
+
+	if count > MaxSACKRanges {
+		return nil, nil, fmt.Errorf("too many ranges in SACK packet: %d", count)
+	}
+
+	if len(buf) < 5+count*6 {
+		return nil, nil, fmt.Errorf("buffer too small when decoding '%d' missing ranges in SACK packet: %d", count, len(buf))
+	}
+
+	ranges := make([]SequenceRange, count)
+	for i := 0; i < count; i++ {
+		offset := binary.BigEndian.Uint32(buf[5+i*6:])
+		ranges[i] = SequenceRange{
+			Start:  latestSeqID - SequenceID(offset),
+			Length: binary.BigEndian.Uint16(buf[9+i*6:]),
+		}
+	}
+
+	return &SACKPacket{
+		LatestSeqID:   latestSeqID,
+		MissingRanges: ranges,
+	}, buf[5+count*6:], nil
+}
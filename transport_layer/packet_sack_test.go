@@ -0,0 +1,93 @@
+package transport_layer_test
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/starling-protocol/starling/transport_layer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func FuzzCodingSACKPacket(f *testing.F) {
+	missingSeqs := []byte{}
+	missingSeqs = binary.BigEndian.AppendUint32(missingSeqs, 345)
+	missingSeqs = binary.BigEndian.AppendUint32(missingSeqs, 346)
+	missingSeqs = binary.BigEndian.AppendUint32(missingSeqs, 678)
+	f.Add(uint32(1000), missingSeqs)
+
+	f.Fuzz(func(t *testing.T, latestSeqID uint32, _missingSeqIDs []byte) {
+		missingSeqIDs := []transport_layer.SequenceID{}
+		for i := 0; i < len(_missingSeqIDs)/4; i++ {
+			seq := binary.BigEndian.Uint32(_missingSeqIDs[i*4:])
+			missingSeqIDs = append(missingSeqIDs, transport_layer.SequenceID(seq))
+		}
+
+		packet := transport_layer.NewSACKPacket(transport_layer.SequenceID(latestSeqID), missingSeqIDs)
+		assert.LessOrEqual(t, len(packet.MissingRanges), transport_layer.MaxSACKRanges)
+
+		encoded := packet.EncodePacket()
+		assert.LessOrEqual(t, len(encoded), 6+transport_layer.MaxSACKRanges*6)
+
+		decoded, err := transport_layer.DecodeSACKPacket(encoded)
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, packet, decoded)
+	})
+}
+
+func FuzzDecodingSACKPacket(f *testing.F) {
+	random := rand.New(rand.NewSource(1234))
+
+	packet := transport_layer.NewSACKPacket(transport_layer.SequenceID(500), []transport_layer.SequenceID{40, 41, 42, 300})
+	f.Add(packet.EncodePacket())
+
+	invalid_packet := [45]byte{}
+	if n, err := random.Read(invalid_packet[:]); n != 45 || err != nil {
+		f.Fatal()
+	}
+	f.Add(invalid_packet[:])
+
+	f.Fuzz(func(t *testing.T, bytes []byte) {
+		assert.NotPanics(t, func() {
+			transport_layer.DecodeSACKPacket(bytes)
+		})
+	})
+}
+
+func TestSACKRanges(t *testing.T) {
+	missing := []transport_layer.SequenceID{3, 4, 5, 9, 11, 12}
+	packet := transport_layer.NewSACKPacket(20, missing)
+
+	assert.Equal(t, transport_layer.SequenceID(20), packet.LatestSeqID)
+	assert.Equal(t, []transport_layer.SequenceRange{
+		{Start: 3, Length: 3},
+		{Start: 9, Length: 1},
+		{Start: 11, Length: 2},
+	}, packet.MissingRanges)
+	assert.Len(t, packet.EncodePacket(), 6+3*6)
+}
+
+// When more holes exist than fit in a single SACK, the oldest holes are reported
+// and the latest sequence ID is lowered to exclude the holes that were left out.
+func TestSACKTruncation(t *testing.T) {
+	missing := []transport_layer.SequenceID{}
+	for seq := transport_layer.SequenceID(2); seq < 200; seq += 2 {
+		missing = append(missing, seq)
+	}
+
+	packet := transport_layer.NewSACKPacket(200, missing)
+	assert.Len(t, packet.MissingRanges, transport_layer.MaxSACKRanges)
+	assert.Equal(t, transport_layer.SequenceID(2), packet.MissingRanges[0].Start)
+
+	firstOmitted := missing[transport_layer.MaxSACKRanges]
+	assert.Equal(t, firstOmitted-1, packet.LatestSeqID)
+
+	for _, seq := range missing[:transport_layer.MaxSACKRanges] {
+		assert.True(t, slices.ContainsFunc(packet.MissingRanges, func(r transport_layer.SequenceRange) bool {
+			return r.Contains(seq)
+		}))
+	}
+}
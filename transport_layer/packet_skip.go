@@ -0,0 +1,86 @@
+package transport_layer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// SKIPPacket tells the receiver that the sequence IDs belong to a message which was dropped by the sender.
+// The receiver treats them as received, such that later packets are not held back waiting for them.
+type SKIPPacket struct {
+	SeqIDs []SequenceID
+}
+
+// NewSKIPPacket creates a SKIP packet for the sequence IDs.
+// At most math.MaxUint16 sequence IDs are included.
+func NewSKIPPacket(seqIDs []SequenceID) *SKIPPacket {
+	if len(seqIDs) > math.MaxUint16 {
+		seqIDs = seqIDs[:math.MaxUint16]
+	}
+	return &SKIPPacket{
+		SeqIDs: seqIDs,
+	}
+}
+
+func (d *SKIPPacket) PacketType() PacketType {
+	return SKIP
+}
+
+func (d *SKIPPacket) EncodePacket() []byte {
+	buf := []byte{}
+
+	buf = append(buf, byte(SKIP))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(d.SeqIDs)))
+	for _, seqID := range d.SeqIDs {
+		buf = seqID.Encode(buf)
+	}
+
+	return buf
+}
+
+func DecodeSKIPPacket(buf []byte) (*SKIPPacket, error) {
+	if len(buf) < 3 {
+		return nil, fmt.Errorf("buffer too small when decoding SKIP packet: %d", len(buf))
+	}
+
+	if buf[0] != byte(SKIP) {
+		return nil, fmt.Errorf("wrong packet header when decoding SKIP packet: %d", buf[0])
+	}
+
+	count := int(binary.BigEndian.Uint16(buf[1:]))
+	if len(buf) < 3+count*4 {
+		return nil, fmt.Errorf("buffer too small when decoding '%d' sequence ids in SKIP packet: %d", count, len(buf))
+	}
+
+	seqIDs := make([]SequenceID, count)
+	for i := 0; i < count; i++ {
+		seqIDs[i] = DecodeSequenceID(buf[3+i*4:])
+	}
+
+	return &SKIPPacket{
+		SeqIDs: seqIDs,
+	}, nil
+}
+
+func (transport *TransportLayer) handleSkipPacket(sessionID device.SessionID, packet *SKIPPacket) []TransportMessage {
+	transport.logf("packet:skip:handle:%d '%d sequence id(s)'", sessionID, len(packet.SeqIDs))
+
+	if _, found := transport.networkLayer.GetSession(sessionID); !found {
+		transport.logf("packet:skip:handle:error:%d 'session was not found, ignoring packet'", sessionID)
+		return nil
+	}
+
+	state := transport.SessionState(sessionID)
+
+	messages := []TransportMessage{}
+	for _, seqID := range packet.SeqIDs {
+		// A skipped sequence ID is received as an empty placeholder which is never delivered
+		placeholder := &DATAPacket{SeqID: seqID, skipped: true}
+		messages = append(messages, transport.deliverDataPackets(sessionID, state.ReceiveDATA(transport, placeholder))...)
+	}
+
+	return messages
+}
@@ -0,0 +1,55 @@
+package transport_layer_test
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/starling-protocol/starling/transport_layer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func FuzzCodingSKIPPacket(f *testing.F) {
+	seqIDs := []byte{}
+	seqIDs = binary.BigEndian.AppendUint32(seqIDs, 12)
+	seqIDs = binary.BigEndian.AppendUint32(seqIDs, 13)
+	f.Add(seqIDs)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, _seqIDs []byte) {
+		seqIDs := []transport_layer.SequenceID{}
+		for i := 0; i < len(_seqIDs)/4; i++ {
+			seqIDs = append(seqIDs, transport_layer.SequenceID(binary.BigEndian.Uint32(_seqIDs[i*4:])))
+		}
+
+		packet := transport_layer.NewSKIPPacket(seqIDs)
+
+		encoded := packet.EncodePacket()
+		assert.Len(t, encoded, 3+len(packet.SeqIDs)*4)
+
+		decoded, err := transport_layer.DecodeSKIPPacket(encoded)
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, packet, decoded)
+	})
+}
+
+func FuzzDecodingSKIPPacket(f *testing.F) {
+	random := rand.New(rand.NewSource(1234))
+
+	packet := transport_layer.NewSKIPPacket([]transport_layer.SequenceID{1, 2, 3})
+	f.Add(packet.EncodePacket())
+
+	invalid_packet := [45]byte{}
+	if n, err := random.Read(invalid_packet[:]); n != 45 || err != nil {
+		f.Fatal()
+	}
+	f.Add(invalid_packet[:])
+
+	f.Fuzz(func(t *testing.T, bytes []byte) {
+		assert.NotPanics(t, func() {
+			transport_layer.DecodeSKIPPacket(bytes)
+		})
+	})
+}
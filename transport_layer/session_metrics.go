@@ -0,0 +1,105 @@
+package transport_layer
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+// rttSmoothing is the weight given to a new round trip time sample, as recommended by RFC 6298.
+const rttSmoothing = 0.125
+
+// updateRTT folds a round trip time sample into the smoothed estimate.
+// Samples of retransmitted packets are ambiguous and must not be given (Karn's algorithm).
+// It must be called with the send lock held.
+func (state *SessionState) updateRTT(sample time.Duration) {
+	if state.sender.rtt == 0 {
+		state.sender.rtt = sample
+		return
+	}
+
+	state.sender.rtt += time.Duration(rttSmoothing * float64(sample-state.sender.rtt))
+}
+
+// Metrics returns a snapshot of the transport metrics of the session.
+// The contact is left empty, since it is only known by the network layer.
+func (state *SessionState) Metrics(now time.Time) device.SessionMetrics {
+	metrics := device.SessionMetrics{
+		Session: state.sessionID,
+	}
+
+	state.sendLock.Lock()
+	metrics.RTT = state.sender.rtt
+	metrics.Retransmissions = state.sender.retransmissions
+	metrics.BytesSent = state.sender.bytesSent
+	metrics.UnackedMessages = len(state.sender.awaitingACKs) + len(state.sender.outbox)
+	if len(state.sender.awaitingACKs) > 0 {
+		metrics.UnackedAge = now.Sub(state.sender.awaitingACKs[0].timestamp)
+	}
+	state.sendLock.Unlock()
+
+	state.receiveLock.Lock()
+	metrics.BytesReceived = state.receiver.bytesReceived
+	state.receiveLock.Unlock()
+
+	return metrics
+}
+
+// SessionMetrics returns the transport metrics of an established session.
+func (transport *TransportLayer) SessionMetrics(sessionID device.SessionID) (*device.SessionMetrics, error) {
+	contact, found := transport.SessionContact(sessionID)
+	if !found {
+		return nil, errors.New("session not found")
+	}
+
+	state, found := transport.sessionStates[sessionID]
+	if !found {
+		state = NewSessionState(sessionID)
+	}
+
+	metrics := state.Metrics(transport.dev.Now())
+	metrics.Contact = *contact
+	return &metrics, nil
+}
+
+// AllSessionMetrics returns the transport metrics of every established session, ordered by session ID.
+func (transport *TransportLayer) AllSessionMetrics() []device.SessionMetrics {
+	sessionIDs := []device.SessionID{}
+	for sessionID := range transport.sessionStates {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	slices.Sort(sessionIDs)
+
+	allMetrics := []device.SessionMetrics{}
+	for _, sessionID := range sessionIDs {
+		metrics, err := transport.SessionMetrics(sessionID)
+		if err != nil {
+			continue
+		}
+		allMetrics = append(allMetrics, *metrics)
+	}
+	return allMetrics
+}
+
+// sendPacket encodes and sends a transport packet on the session, counting the bytes sent.
+func (transport *TransportLayer) sendPacket(sessionID device.SessionID, packet Packet) error {
+	data := packet.EncodePacket()
+
+	if state, found := transport.sessionStates[sessionID]; found {
+		state.sendLock.Lock()
+		state.sender.bytesSent += len(data)
+		state.sendLock.Unlock()
+	}
+
+	return transport.networkLayer.SendData(sessionID, data)
+}
+
+// countReceived records the bytes of a transport packet received on the session.
+func (state *SessionState) countReceived(bytes int) {
+	state.receiveLock.Lock()
+	defer state.receiveLock.Unlock()
+
+	state.receiver.bytesReceived += bytes
+}
@@ -1,7 +1,6 @@
 package transport_layer
 
 import (
-	"cmp"
 	"encoding/binary"
 	"slices"
 	"sync"
@@ -12,6 +11,9 @@ import (
 
 type SequenceID uint32
 
+// maxMissingSeqs bounds the number of missing sequence IDs a receiver keeps track of.
+const maxMissingSeqs = 1024
+
 func (s SequenceID) Encode(buf []byte) []byte {
 	return binary.BigEndian.AppendUint32(buf, uint32(s))
 }
@@ -20,17 +22,43 @@ func DecodeSequenceID(buf []byte) SequenceID {
 	return SequenceID(binary.BigEndian.Uint32(buf))
 }
 
+// Before reports whether s precedes other using serial number arithmetic (RFC 1982),
+// such that the ordering stays correct when the sequence IDs wrap around.
+// Two sequence IDs are only comparable when they are less than 2^31 apart.
+func (s SequenceID) Before(other SequenceID) bool {
+	return int32(uint32(s)-uint32(other)) < 0
+}
+
+// Compare returns -1, 0 or +1 depending on whether s precedes, equals or follows other
+// using serial number arithmetic.
+func (s SequenceID) Compare(other SequenceID) int {
+	if s == other {
+		return 0
+	}
+	if s.Before(other) {
+		return -1
+	}
+	return 1
+}
+
 type ReceiverState struct {
 	ackTimer         bool
+	ackPending       bool
+	heartbeatTimer   bool
+	activity         bool
+	missedHeartbeats int
+	bytesReceived    int
 	latestSeq        SequenceID
 	missingSeqs      []SequenceID
 	awaitingDelivery []*DATAPacket
+	reassemblies     map[uint32]*reassembly
 }
 
 type awaitingACK struct {
-	message    outboxMessage
-	sequenceID SequenceID
-	timestamp  time.Time
+	message       outboxMessage
+	sequenceID    SequenceID
+	timestamp     time.Time
+	retransmitted bool
 }
 
 func newAwaitingACK(sequenceID SequenceID, message outboxMessage, timestamp time.Time) awaitingACK {
@@ -42,36 +70,80 @@ func newAwaitingACK(sequenceID SequenceID, message outboxMessage, timestamp time
 }
 
 type SenderState struct {
-	timeoutTimer   bool
-	awaitingACKs   []awaitingACK
-	nextSequenceID SequenceID
+	timeoutTimer    bool
+	awaitingACKs    []awaitingACK
+	outbox          []outboxMessage
+	skippedSeqs     []SequenceID
+	progress        map[device.MessageID]*messageProgress
+	nextSequenceID  SequenceID
+	nextFragmentID  uint32
+	retransmissions int
+	bytesSent       int
+	rtt             time.Duration
 }
 
 type SessionState struct {
 	sendLock    sync.Mutex
 	receiveLock sync.Mutex
+	streamLock  sync.Mutex
 	sessionID   device.SessionID
 	sender      *SenderState
 	receiver    *ReceiverState
+	streams     map[uint32]*Stream
+	// nextStreamID is the ID of the next stream opened by this side of the session.
+	// nextRemoteStreamID is above the IDs of all streams opened by the peer, and remoteStreamGaps
+	// are the IDs below it which the peer has not used yet, see admitRemoteStream.
+	nextStreamID       uint32
+	nextRemoteStreamID uint32
+	remoteStreamGaps   map[uint32]bool
 }
 
 func NewSessionState(sessionID device.SessionID) *SessionState {
 	return &SessionState{
 		sessionID: sessionID,
 		sender: &SenderState{
-			timeoutTimer:   false,
-			awaitingACKs:   []awaitingACK{},
-			nextSequenceID: 1,
+			timeoutTimer:    false,
+			awaitingACKs:    []awaitingACK{},
+			outbox:          []outboxMessage{},
+			skippedSeqs:     []SequenceID{},
+			progress:        map[device.MessageID]*messageProgress{},
+			nextSequenceID:  1,
+			nextFragmentID:  0,
+			retransmissions: 0,
+			bytesSent:       0,
+			rtt:             0,
 		},
 		receiver: &ReceiverState{
-			ackTimer:    false,
-			latestSeq:   0,
-			missingSeqs: []SequenceID{},
+			ackTimer:         false,
+			ackPending:       false,
+			heartbeatTimer:   false,
+			activity:         false,
+			missedHeartbeats: 0,
+			bytesReceived:    0,
+			latestSeq:        0,
+			missingSeqs:      []SequenceID{},
+			reassemblies:     map[uint32]*reassembly{},
 		},
+		streams:            map[uint32]*Stream{},
+		nextStreamID:       1,
+		nextRemoteStreamID: 0,
+		remoteStreamGaps:   map[uint32]bool{},
 	}
 }
 
-// DeliverMessage registers a message as awaiting an ack,
+// DebugSetSequenceIDs overrides the next sequence ID to send and the latest sequence ID received.
+// It is only used for testing.
+func (state *SessionState) DebugSetSequenceIDs(nextSequenceID SequenceID, latestSeq SequenceID) {
+	state.sendLock.Lock()
+	state.sender.nextSequenceID = nextSequenceID
+	state.sendLock.Unlock()
+
+	state.receiveLock.Lock()
+	state.receiver.latestSeq = latestSeq
+	state.receiveLock.Unlock()
+}
+
+// DeliverMessage registers a message as awaiting an ack without passing through the outbox,
 // it returns the sequence ID for the new packet to be delivered.
 func (state *SessionState) DeliverMessage(transport *TransportLayer, message outboxMessage) SequenceID {
 	state.sendLock.Lock()
@@ -85,33 +157,168 @@ func (state *SessionState) DeliverMessage(transport *TransportLayer, message out
 	return seqID
 }
 
-func (state *SessionState) ReceiveACK(transport *TransportLayer, packet *ACKPacket) []*DATAPacket {
+// enqueue inserts messages into the outbox after all messages of the same or higher priority.
+// It must be called with the send lock held.
+func (state *SessionState) enqueue(messages ...outboxMessage) {
+	if len(messages) == 0 {
+		return
+	}
+
+	priority := messages[0].priority
+	index := len(state.sender.outbox)
+	for index > 0 && state.sender.outbox[index-1].priority < priority {
+		index--
+	}
+
+	state.sender.outbox = slices.Insert(state.sender.outbox, index, messages...)
+}
+
+// DropMessage removes all pending parts of a message from the outbox and awaitingACKs.
+// It returns whether the message was found along with the sequence IDs the receiver should skip.
+func (state *SessionState) DropMessage(transport *TransportLayer, messageID device.MessageID) (bool, []SequenceID) {
 	state.sendLock.Lock()
 	defer state.sendLock.Unlock()
 
-	resendPackets := []*DATAPacket{}
+	found := false
+
+	newOutbox := []outboxMessage{}
+	for _, message := range state.sender.outbox {
+		if message.messageID == messageID {
+			found = true
+			continue
+		}
+		newOutbox = append(newOutbox, message)
+	}
+	state.sender.outbox = newOutbox
+
+	skipped := []SequenceID{}
+	newAwaitingACKs := []awaitingACK{}
+	for _, awaiting := range state.sender.awaitingACKs {
+		if awaiting.message.messageID == messageID {
+			found = true
+			skipped = append(skipped, awaiting.sequenceID)
+			continue
+		}
+		newAwaitingACKs = append(newAwaitingACKs, awaiting)
+	}
+	state.sender.awaitingACKs = newAwaitingACKs
+	state.sender.skippedSeqs = append(state.sender.skippedSeqs, skipped...)
+
+	delete(state.sender.progress, messageID)
+
+	if found {
+		transport.logf("session:drop_message:%d:%d '%d sequence id(s) skipped'", state.sessionID, messageID, len(skipped))
+	}
+
+	return found, skipped
+}
+
+// NextOutboxPackets assigns sequence IDs to messages in the outbox as long as the send window allows it.
+// The returned packets are registered as awaiting an ack, the caller is responsible for sending them.
+func (state *SessionState) NextOutboxPackets(transport *TransportLayer) []*DATAPacket {
+	state.sendLock.Lock()
+
+	packets := []*DATAPacket{}
+	window := transport.options.SendWindow
+	streamWindow := transport.options.StreamWindow
+	for i := 0; i < len(state.sender.outbox) && (window <= 0 || len(state.sender.awaitingACKs) < window); {
+		if state.outstandingSeqs() >= maxMissingSeqs {
+			// The receiver would refuse packets beyond the holes it keeps track of
+			break
+		}
+		message := state.sender.outbox[i]
+		if message.stream != nil && streamWindow > 0 && state.streamInFlight(message.stream.ID) >= streamWindow {
+			// The stream has too many chunks in flight, other messages may still be sent
+			i++
+			continue
+		}
+		state.sender.outbox = slices.Delete(state.sender.outbox, i, i+1)
+
+		seqID := state.sender.nextSequenceID
+		state.sender.nextSequenceID++
+		state.sender.awaitingACKs = append(state.sender.awaitingACKs, newAwaitingACK(seqID, message, transport.dev.Now()))
+		packets = append(packets, message.packet(seqID))
+	}
+
+	state.sendLock.Unlock()
+
+	if len(packets) > 0 {
+		state.startTimeoutTimer(transport)
+	}
+
+	return packets
+}
+
+// outstandingSeqs returns the number of sequence IDs from the oldest one which the receiver may still be missing
+// up to the next one to be sent. The receiver keeps track of at most maxMissingSeqs holes, so the sender must not get further ahead.
+func (state *SessionState) outstandingSeqs() int {
+	oldest := state.sender.nextSequenceID
+	for _, awaiting := range state.sender.awaitingACKs {
+		if awaiting.sequenceID.Before(oldest) {
+			oldest = awaiting.sequenceID
+		}
+	}
+	for _, seqID := range state.sender.skippedSeqs {
+		if seqID.Before(oldest) {
+			oldest = seqID
+		}
+	}
+	return int(state.sender.nextSequenceID - oldest)
+}
+
+// ReceiveACK updates the sender state with the acknowledgement.
+// It returns the packets that should be retransmitted.
+func (state *SessionState) ReceiveACK(transport *TransportLayer, packet acknowledgement) []Packet {
+	state.sendLock.Lock()
+	defer state.sendLock.Unlock()
+
+	resendPackets := []Packet{}
 	newAwaitingACKs := []awaitingACK{}
 
 	for _, awaiting := range state.sender.awaitingACKs {
 		seqID := awaiting.sequenceID
 
 		// Look at all relevant msgs in awaitingACK
-		if seqID <= packet.LatestSeqID {
-			if slices.Contains(packet.MissingSeqIDs, seqID) {
+		if !packet.latest().Before(seqID) {
+			if packet.missing(seqID) {
 				// Resend the msg
-				dataPacket := NewDATAPacket(seqID, awaiting.message.body)
-				resendPackets = append(resendPackets, dataPacket)
+				resendPackets = append(resendPackets, awaiting.message.packet(seqID))
+				awaiting.retransmitted = true
+				state.sender.retransmissions++
 				newAwaitingACKs = append(newAwaitingACKs, awaiting)
 			} else {
 				// Message has been delivered
-				transport.events.MessageDelivered(awaiting.message.messageID)
+				if !awaiting.retransmitted {
+					state.updateRTT(transport.dev.Now().Sub(awaiting.timestamp))
+				}
+				state.messageAcknowledged(transport, awaiting.message)
 			}
+		} else {
+			// Message is not covered by the acknowledgement yet
+			newAwaitingACKs = append(newAwaitingACKs, awaiting)
 		}
 	}
 
-	transport.logf("packet:ack:handle:done:%d:%d '%d message(s) delivered'", len(resendPackets), len(state.sender.awaitingACKs), len(state.sender.awaitingACKs)-len(resendPackets))
+	transport.logf("packet:ack:handle:done:%d:%d '%d message(s) delivered'", len(resendPackets), len(state.sender.awaitingACKs), len(state.sender.awaitingACKs)-len(newAwaitingACKs))
 	state.sender.awaitingACKs = newAwaitingACKs
 
+	// Skipped sequence IDs are forgotten once the receiver has seen them, otherwise the skip is repeated
+	resendSkips := []SequenceID{}
+	newSkippedSeqs := []SequenceID{}
+	for _, seqID := range state.sender.skippedSeqs {
+		if packet.latest().Before(seqID) {
+			newSkippedSeqs = append(newSkippedSeqs, seqID)
+		} else if packet.missing(seqID) {
+			resendSkips = append(resendSkips, seqID)
+			newSkippedSeqs = append(newSkippedSeqs, seqID)
+		}
+	}
+	state.sender.skippedSeqs = newSkippedSeqs
+
+	if len(resendSkips) > 0 {
+		resendPackets = append(resendPackets, NewSKIPPacket(resendSkips))
+	}
+
 	return resendPackets
 }
 
@@ -125,9 +332,23 @@ func (state *SessionState) ReceiveDATA(transport *TransportLayer, packet *DATAPa
 
 	packetsToDeliver := []*DATAPacket{}
 
-	if state.receiver.latestSeq < packet.SeqID {
+	if !state.receiver.latestSeq.Before(packet.SeqID) && !slices.Contains(state.receiver.missingSeqs, packet.SeqID) {
+		transport.logf("session:receive:duplicate:%d:%d", state.sessionID, packet.SeqID)
+		return packetsToDeliver
+	}
+
+	if state.receiver.latestSeq.Before(packet.SeqID) {
+		// Refuse packets that would open more holes than we are willing to keep track of.
+		// Honest senders never get more than maxMissingSeqs ahead of the oldest unacknowledged packet,
+		// so this only happens if the sender misbehaves, and the refused packets are lost.
+		holes := int(packet.SeqID - state.receiver.latestSeq - 1)
+		if len(state.receiver.missingSeqs)+holes > maxMissingSeqs {
+			transport.logf("session:receive:drop:%d:%d 'too many missing packets'", state.sessionID, packet.SeqID)
+			return packetsToDeliver
+		}
+
 		// Add potential missing sequenceIDs
-		for seq := state.receiver.latestSeq + 1; seq < packet.SeqID; seq++ {
+		for seq := state.receiver.latestSeq + 1; seq != packet.SeqID; seq++ {
 			state.receiver.missingSeqs = append(state.receiver.missingSeqs, seq)
 		}
 		state.receiver.latestSeq = packet.SeqID
@@ -145,7 +366,7 @@ func (state *SessionState) ReceiveDATA(transport *TransportLayer, packet *DATAPa
 
 			newAwaitingDelivery := []*DATAPacket{}
 			for _, p := range state.receiver.awaitingDelivery {
-				if p.SeqID < deliverUntil {
+				if p.SeqID.Before(deliverUntil) {
 					// Packet should be delivered
 					packetsToDeliver = append(packetsToDeliver, p)
 				} else {
@@ -157,9 +378,14 @@ func (state *SessionState) ReceiveDATA(transport *TransportLayer, packet *DATAPa
 
 			packetsToDeliver = append(packetsToDeliver, packet)
 
-		} else if state.receiver.missingSeqs[0] < packet.SeqID {
-			// There is a packet we have not received yet before this packet. Add this packet to awaitingDelivery
-			state.receiver.awaitingDelivery = append(state.receiver.awaitingDelivery, packet)
+		} else if state.receiver.missingSeqs[0].Before(packet.SeqID) {
+			if packet.Stream != nil {
+				// Streams are ordered independently, so stream chunks are not held back by missing packets
+				packetsToDeliver = append(packetsToDeliver, packet)
+			} else {
+				// There is a packet we have not received yet before this packet. Add this packet to awaitingDelivery
+				state.receiver.awaitingDelivery = append(state.receiver.awaitingDelivery, packet)
+			}
 		}
 	} else {
 		// No missing packets. Thus deliver received packet.
@@ -175,14 +401,30 @@ func (state *SessionState) ReceiveDATA(transport *TransportLayer, packet *DATAPa
 	}
 
 	slices.SortFunc(packetsToDeliver, func(a *DATAPacket, b *DATAPacket) int {
-		return cmp.Compare(int(a.SeqID), int(b.SeqID))
+		return a.SeqID.Compare(b.SeqID)
 	})
 	return packetsToDeliver
 }
 
+// piggybackACK returns the pending acknowledgement to be carried by an outgoing DATA packet,
+// such that the ack timer does not need to send it separately.
+// It returns nil if there is nothing new to acknowledge.
+func (state *SessionState) piggybackACK() *SACKPacket {
+	state.receiveLock.Lock()
+	defer state.receiveLock.Unlock()
+
+	if !state.receiver.ackPending {
+		return nil
+	}
+
+	state.receiver.ackPending = false
+	return NewSACKPacket(state.receiver.latestSeq, state.receiver.missingSeqs)
+}
+
 func (state *SessionState) startAckTimer(transport *TransportLayer) {
 	state.receiveLock.Lock()
 
+	state.receiver.ackPending = true
 	if state.receiver.ackTimer {
 		state.receiveLock.Unlock()
 		return
@@ -194,11 +436,18 @@ func (state *SessionState) startAckTimer(transport *TransportLayer) {
 
 	transport.dev.Delay(func() {
 		state.receiveLock.Lock()
-		ackPacket := NewACKPacket(state.receiver.latestSeq, state.receiver.missingSeqs)
+		ackPacket := NewSACKPacket(state.receiver.latestSeq, state.receiver.missingSeqs)
+		ackPending := state.receiver.ackPending
 		sessionID := state.sessionID
 		state.receiver.ackTimer = false
+		state.receiver.ackPending = false
 		state.receiveLock.Unlock()
 
+		if !ackPending {
+			transport.logf("session:timer:ack:piggybacked:%d 'ack was already sent with data'", sessionID)
+			return
+		}
+
 		_, found := transport.networkLayer.GetSession(sessionID)
 		if !found {
 			transport.logf("session:timer:ack:send:error:%d 'Session not found'", sessionID)
@@ -206,7 +455,7 @@ func (state *SessionState) startAckTimer(transport *TransportLayer) {
 		}
 
 		transport.logf("session:timer:ack:send:%d 'Sending ack reply'", sessionID)
-		transport.networkLayer.SendData(sessionID, ackPacket.EncodePacket())
+		transport.sendPacket(sessionID, ackPacket)
 	}, transport.options.ACKDelay)
 }
 
@@ -274,4 +523,6 @@ func (transport *TransportLayer) TimeoutSession(sessionID device.SessionID) {
 
 	state.sendLock.Unlock()
 	state.receiveLock.Unlock()
+
+	state.closeStreams(errSessionBroken)
 }
@@ -0,0 +1,27 @@
+package transport_layer_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/starling-protocol/starling/transport_layer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenceIDSerialArithmetic(t *testing.T) {
+	max := transport_layer.SequenceID(math.MaxUint32)
+
+	assert.True(t, transport_layer.SequenceID(1).Before(2))
+	assert.False(t, transport_layer.SequenceID(2).Before(1))
+	assert.False(t, transport_layer.SequenceID(5).Before(5))
+
+	// Comparisons across the wrap
+	assert.True(t, max.Before(0))
+	assert.True(t, (max - 10).Before(10))
+	assert.False(t, transport_layer.SequenceID(0).Before(max))
+
+	assert.Equal(t, -1, max.Compare(0))
+	assert.Equal(t, 1, transport_layer.SequenceID(0).Compare(max))
+	assert.Equal(t, 0, max.Compare(max))
+}
@@ -0,0 +1,573 @@
+package transport_layer
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/starling-protocol/starling/device"
+)
+
+var errSessionBroken = errors.New("session broken")
+
+// ErrStreamEmpty is returned by TryRead when no data is available yet.
+var ErrStreamEmpty = errors.New("no data available on stream")
+
+// ErrStreamFull is returned by TryWrite when the receive window of the peer is full.
+var ErrStreamFull = errors.New("stream window is full")
+
+// ErrStreamReset is returned by TryRead and TryWrite once the peer has reset the stream,
+// which it does when it has too many open streams.
+var ErrStreamReset = errors.New("stream reset by peer")
+
+var errStreamWindowExceeded = errors.New("stream receive window exceeded by peer")
+
+var errTooManyStreams = errors.New("too many open streams")
+
+// initialStreamWindow is the number of chunks which may be sent on a stream before the peer has announced its window.
+const initialStreamWindow = 4
+
+// A StreamFrame marks a DATA packet as carrying a chunk of a stream.
+type StreamFrame struct {
+	// ID identifies the stream within the session.
+	ID uint32
+	// Seq is the position of the chunk within the stream.
+	Seq uint32
+	// Fin marks the last chunk of the stream, it carries no data.
+	Fin bool
+	// Reset aborts the stream, it carries no data.
+	Reset bool
+}
+
+// A StreamWindowUpdate marks a DATA packet as announcing the receive window of a stream.
+// It is piggybacked on a chunk of the stream when there is one to send, or else sent on its own.
+type StreamWindowUpdate struct {
+	// ID identifies the stream within the session.
+	ID uint32
+	// Limit is the position of the first chunk of the stream which the peer may not send yet.
+	Limit uint32
+}
+
+// A Stream is an ordered and reliable byte stream multiplexed over a session.
+// Each stream is ordered independently, such that a lost packet only holds back its own stream.
+//
+// Like the rest of the protocol, streams are not safe for concurrent use and must be used from the
+// thread which drives the protocol. Reads and writes never block: TryRead returns ErrStreamEmpty when
+// no data is available, and TryWrite returns ErrStreamFull once the receive window of the peer is full.
+// The device is notified through StreamReady when the stream can be read from or written to again.
+// Streams are therefore not an io.Reader or io.Writer, whose callers expect them to block.
+//
+// Streams opened by the initiator of the session have even IDs and those opened by the responder odd IDs,
+// such that both sides can open streams at the same time. Each side uses its IDs in order and never reuses
+// them, so chunks arriving for a stream which has been closed are ignored. A side may have at most
+// MaxConcurrentStreams streams open, and further streams opened by the peer are reset.
+//
+// The receiver buffers at most StreamReceiveWindow chunks of each stream, and announces to the sender
+// how far it may write as the application reads the data. At most StreamWindow chunks of each stream
+// are awaiting an ack at any time.
+type Stream struct {
+	transport *TransportLayer
+	state     *SessionState
+	id        uint32
+	// remote is set if the stream was opened by the peer
+	remote bool
+
+	lock sync.Mutex
+	// readBuf holds the chunks which are ready to be read, in stream order
+	readBuf [][]byte
+	// pending holds chunks that arrived before earlier chunks of the stream
+	pending  map[uint32]*DATAPacket
+	readSeq  uint32
+	writeSeq uint32
+	// readChunks is the number of chunks which have been read by the application
+	readChunks uint32
+	// announced is the receive window limit last announced to the peer
+	announced uint32
+	// sendLimit is the receive window limit announced by the peer
+	sendLimit uint32
+	localFin  bool
+	remoteFin bool
+	err       error
+}
+
+func newStream(transport *TransportLayer, state *SessionState, id uint32, remote bool) *Stream {
+	return &Stream{
+		transport:  transport,
+		state:      state,
+		id:         id,
+		remote:     remote,
+		readBuf:    [][]byte{},
+		pending:    map[uint32]*DATAPacket{},
+		readSeq:    0,
+		writeSeq:   0,
+		readChunks: 0,
+		announced:  initialStreamWindow,
+		sendLimit:  initialStreamWindow,
+		localFin:   false,
+		remoteFin:  false,
+		err:        nil,
+	}
+}
+
+// ID returns the identifier of the stream within its session.
+func (stream *Stream) ID() uint32 {
+	return stream.id
+}
+
+// Session returns the session the stream is multiplexed over.
+func (stream *Stream) Session() device.SessionID {
+	return stream.state.sessionID
+}
+
+// TryRead reads the data which is available on the stream, it returns ErrStreamEmpty if there is none.
+// It returns io.EOF once the peer has closed the stream and all data has been read.
+func (stream *Stream) TryRead(p []byte) (int, error) {
+	stream.lock.Lock()
+
+	n := 0
+	for len(stream.readBuf) > 0 && n < len(p) {
+		copied := copy(p[n:], stream.readBuf[0])
+		n += copied
+		stream.readBuf[0] = stream.readBuf[0][copied:]
+		if len(stream.readBuf[0]) == 0 {
+			stream.readBuf = stream.readBuf[1:]
+			stream.readChunks++
+		}
+	}
+
+	limit, announce := stream.nextWindow()
+	err := stream.err
+	remoteFin := stream.remoteFin
+
+	stream.lock.Unlock()
+
+	if announce {
+		stream.transport.announceStreamWindow(stream.state, stream.id, limit)
+	}
+
+	if n > 0 || len(p) == 0 {
+		return n, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if remoteFin {
+		return 0, io.EOF
+	}
+	return 0, ErrStreamEmpty
+}
+
+// TryWrite queues the data for delivery on the stream, and returns the number of bytes queued.
+// If the receive window of the peer is full, only the data which fits is queued and ErrStreamFull is returned.
+// The count includes the data which was queued even if sending it right away fails.
+func (stream *Stream) TryWrite(p []byte) (int, error) {
+	stream.lock.Lock()
+
+	if stream.err != nil {
+		stream.lock.Unlock()
+		return 0, stream.err
+	}
+
+	if stream.localFin {
+		stream.lock.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+
+	chunkSize := stream.transport.options.MaxFragmentSize
+	if chunkSize <= 0 {
+		chunkSize = len(p)
+	}
+
+	messageID := device.MessageID(stream.transport.dev.Rand().Uint64())
+	chunks := []outboxMessage{}
+	written := 0
+	// The last chunk of the window is kept for the fin, such that the stream can always be closed
+	for written < len(p) && seqBefore(stream.writeSeq+1, stream.sendLimit) {
+		chunk := p[written:min(written+chunkSize, len(p))]
+		chunks = append(chunks, stream.newChunk(messageID, chunk, false))
+		written += len(chunk)
+	}
+	stream.attachWindow(chunks)
+	stream.state.queueStreamChunks(chunks)
+
+	stream.lock.Unlock()
+
+	if err := stream.transport.sendOutbox(stream.state); err != nil {
+		return written, err
+	}
+
+	if written < len(p) {
+		return written, ErrStreamFull
+	}
+	return written, nil
+}
+
+// Close ends the writing side of the stream.
+// The peer reads io.EOF once it has read all data written before the stream was closed.
+func (stream *Stream) Close() error {
+	stream.lock.Lock()
+
+	if stream.localFin || stream.err != nil {
+		stream.lock.Unlock()
+		return nil
+	}
+
+	stream.localFin = true
+	messageID := device.MessageID(stream.transport.dev.Rand().Uint64())
+	chunks := []outboxMessage{stream.newChunk(messageID, []byte{}, true)}
+	stream.attachWindow(chunks)
+	stream.state.queueStreamChunks(chunks)
+	finished := stream.remoteFin
+
+	stream.lock.Unlock()
+
+	if finished {
+		stream.state.removeStream(stream.id)
+	}
+
+	return stream.transport.sendOutbox(stream.state)
+}
+
+// nextWindow returns the receive window limit to announce to the peer, once the application has read enough
+// of the window to make an announcement worthwhile. Windows are only announced once the peer knows the stream.
+// It must be called with the stream lock held.
+func (stream *Stream) nextWindow() (uint32, bool) {
+	if !stream.remote && stream.writeSeq == 0 {
+		return 0, false
+	}
+
+	window := uint32(stream.transport.options.StreamReceiveWindow)
+	if window == 0 {
+		window = 1 << 30
+	}
+
+	limit := stream.readChunks + window
+	if int32(limit-stream.announced) < int32(max(window/2, 1)) {
+		return 0, false
+	}
+	stream.announced = limit
+	return limit, true
+}
+
+// attachWindow piggybacks the receive window on the first of the chunks, if it should be announced.
+// It must be called with the stream lock held.
+func (stream *Stream) attachWindow(chunks []outboxMessage) {
+	if len(chunks) == 0 {
+		return
+	}
+	if limit, announce := stream.nextWindow(); announce {
+		chunks[0].window = &StreamWindowUpdate{ID: stream.id, Limit: limit}
+	}
+}
+
+// newChunk creates the outbox message for the next chunk of the stream.
+// It must be called with the stream lock held.
+func (stream *Stream) newChunk(messageID device.MessageID, body []byte, fin bool) outboxMessage {
+	message := newOutboxMessage(stream.state.sessionID, messageID, device.PriorityNormal, nil, body)
+	message.stream = &StreamFrame{
+		ID:  stream.id,
+		Seq: stream.writeSeq,
+		Fin: fin,
+	}
+	stream.writeSeq++
+	return message
+}
+
+// receive adds a chunk to the stream, chunks are made available for reading in stream order.
+// It returns whether new data can be read, and whether both sides of the stream have been closed.
+func (stream *Stream) receive(packet *DATAPacket) (bool, bool) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if stream.err != nil || !seqBefore(packet.Stream.Seq-stream.readSeq, 1<<31) {
+		// The stream has failed, or the chunk was already read
+		return false, false
+	}
+
+	if !seqBefore(packet.Stream.Seq, stream.announced) {
+		stream.transport.logf("stream:error:%d:%d 'receive window exceeded'", stream.state.sessionID, stream.id)
+		stream.err = errStreamWindowExceeded
+		return true, false
+	}
+
+	stream.pending[packet.Stream.Seq] = packet
+
+	readable := false
+	for {
+		next, found := stream.pending[stream.readSeq]
+		if !found {
+			break
+		}
+
+		if len(next.Data) > 0 {
+			stream.readBuf = append(stream.readBuf, next.Data)
+		} else {
+			stream.readChunks++
+		}
+		if next.Stream.Fin {
+			stream.remoteFin = true
+		}
+		readable = true
+
+		delete(stream.pending, stream.readSeq)
+		stream.readSeq++
+	}
+
+	return readable, stream.remoteFin && stream.localFin
+}
+
+// updateWindow records the receive window announced by the peer.
+// It returns whether the window has grown, such that more data can be written.
+func (stream *Stream) updateWindow(limit uint32) bool {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if !seqBefore(stream.sendLimit, limit) {
+		return false
+	}
+	stream.sendLimit = limit
+	return stream.err == nil && !stream.localFin
+}
+
+// fail makes further reads and writes return the error.
+func (stream *Stream) fail(err error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if stream.err == nil {
+		stream.err = err
+	}
+}
+
+// seqBefore compares positions within a stream using serial number arithmetic.
+func seqBefore(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// OpenStream opens a new stream on the session.
+// The peer is notified of the stream when it receives the first data written to it.
+func (transport *TransportLayer) OpenStream(sessionID device.SessionID) (*Stream, error) {
+	if _, found := transport.networkLayer.GetSession(sessionID); !found {
+		return nil, errors.New("session not found")
+	}
+
+	state := transport.SessionState(sessionID)
+
+	state.streamLock.Lock()
+	defer state.streamLock.Unlock()
+
+	if state.countStreams(false) >= transport.options.MaxConcurrentStreams {
+		return nil, errTooManyStreams
+	}
+	if state.nextStreamID > math.MaxUint32-2 {
+		return nil, errors.New("stream ids of session exhausted")
+	}
+	id := state.nextStreamID
+	state.nextStreamID += 2
+
+	stream := newStream(transport, state, id, false)
+	state.streams[id] = stream
+
+	transport.logf("stream:open:%d:%d", sessionID, id)
+	return stream, nil
+}
+
+type streamAdmission int
+
+const (
+	streamClosed streamAdmission = iota
+	streamRefused
+	streamAccepted
+)
+
+// admitRemoteStream decides whether a chunk of an unknown stream opens a new stream of the peer.
+// Chunks of streams opened by this side, or of streams the peer has already closed, are not admitted.
+// The peer uses its IDs in order, but the first chunks of its streams may arrive out of order, so the IDs
+// it skipped are kept until their streams are opened, and count towards the limit of open streams.
+// It must be called with the stream lock held.
+func (state *SessionState) admitRemoteStream(id uint32, maxStreams int) streamAdmission {
+	if id%2 == state.nextStreamID%2 {
+		return streamClosed
+	}
+
+	if id < state.nextRemoteStreamID {
+		if !state.remoteStreamGaps[id] {
+			return streamClosed
+		}
+		delete(state.remoteStreamGaps, id)
+		return streamAccepted
+	}
+
+	skipped := int((id - state.nextRemoteStreamID) / 2)
+	if id > math.MaxUint32-2 || state.countStreams(true)+len(state.remoteStreamGaps)+skipped >= maxStreams {
+		return streamRefused
+	}
+	for gap := state.nextRemoteStreamID; gap < id; gap += 2 {
+		state.remoteStreamGaps[gap] = true
+	}
+	state.nextRemoteStreamID = id + 2
+	return streamAccepted
+}
+
+// countStreams returns the number of open streams opened by the peer, or by this side.
+// It must be called with the stream lock held.
+func (state *SessionState) countStreams(remote bool) int {
+	count := 0
+	for _, stream := range state.streams {
+		if stream.remote == remote {
+			count++
+		}
+	}
+	return count
+}
+
+// receiveStreamPacket passes a stream chunk to its stream, opening the stream if it is new.
+func (transport *TransportLayer) receiveStreamPacket(state *SessionState, packet *DATAPacket) {
+	streamID := packet.Stream.ID
+
+	state.streamLock.Lock()
+	stream, found := state.streams[streamID]
+	admission := streamAccepted
+	if found && packet.Stream.Reset {
+		delete(state.streams, streamID)
+	} else if !found && !packet.Stream.Reset {
+		admission = state.admitRemoteStream(streamID, transport.options.MaxConcurrentStreams)
+		if admission == streamAccepted {
+			stream = newStream(transport, state, streamID, true)
+			state.streams[streamID] = stream
+		}
+	}
+	state.streamLock.Unlock()
+
+	if packet.Stream.Reset {
+		if found {
+			transport.logf("stream:reset_by_peer:%d:%d", state.sessionID, streamID)
+			stream.fail(ErrStreamReset)
+			transport.events.StreamReady(state.sessionID, stream)
+		}
+		return
+	}
+
+	switch admission {
+	case streamClosed:
+		transport.logf("stream:closed:%d:%d 'ignoring chunk of closed stream'", state.sessionID, streamID)
+		return
+	case streamRefused:
+		transport.logf("stream:refused:%d:%d 'too many open streams'", state.sessionID, streamID)
+		transport.resetStream(state, streamID)
+		return
+	}
+
+	if !found {
+		transport.logf("stream:opened_by_peer:%d:%d", state.sessionID, streamID)
+		transport.events.StreamOpened(state.sessionID, stream)
+	}
+
+	readable, finished := stream.receive(packet)
+	if finished {
+		state.removeStream(stream.id)
+	}
+
+	stream.lock.Lock()
+	limit, announce := stream.nextWindow()
+	stream.lock.Unlock()
+
+	if announce {
+		transport.announceStreamWindow(state, stream.id, limit)
+	}
+	if readable {
+		transport.events.StreamReady(state.sessionID, stream)
+	}
+}
+
+// receiveStreamWindow updates the receive window of a stream as announced by the peer.
+func (transport *TransportLayer) receiveStreamWindow(state *SessionState, update *StreamWindowUpdate) {
+	state.streamLock.Lock()
+	stream, found := state.streams[update.ID]
+	state.streamLock.Unlock()
+
+	if !found {
+		transport.logf("stream:window:unknown:%d:%d", state.sessionID, update.ID)
+		return
+	}
+
+	if stream.updateWindow(update.Limit) {
+		transport.logf("stream:window:%d:%d:%d", state.sessionID, update.ID, update.Limit)
+		transport.events.StreamReady(state.sessionID, stream)
+	}
+}
+
+// announceStreamWindow sends the receive window of a stream to the peer.
+// The announcement is delivered reliably like any other message.
+func (transport *TransportLayer) announceStreamWindow(state *SessionState, streamID uint32, limit uint32) {
+	message := newOutboxMessage(state.sessionID, 0, device.PriorityNormal, nil, []byte{})
+	message.window = &StreamWindowUpdate{ID: streamID, Limit: limit}
+	state.queueStreamChunks([]outboxMessage{message})
+
+	if err := transport.sendOutbox(state); err != nil {
+		transport.logf("stream:window:error:%d:%d '%s'", state.sessionID, streamID, err)
+	}
+}
+
+// resetStream tells the peer that a stream it opened has been refused.
+// The reset is delivered reliably like any other message.
+func (transport *TransportLayer) resetStream(state *SessionState, streamID uint32) {
+	message := newOutboxMessage(state.sessionID, 0, device.PriorityNormal, nil, []byte{})
+	message.stream = &StreamFrame{ID: streamID, Reset: true}
+	state.queueStreamChunks([]outboxMessage{message})
+
+	if err := transport.sendOutbox(state); err != nil {
+		transport.logf("stream:reset:error:%d:%d '%s'", state.sessionID, streamID, err)
+	}
+}
+
+// setInitiator assigns the stream IDs of each side of the session, see Stream.
+func (state *SessionState) setInitiator(initiator bool) {
+	state.streamLock.Lock()
+	defer state.streamLock.Unlock()
+
+	state.nextStreamID, state.nextRemoteStreamID = 1, 0
+	if initiator {
+		state.nextStreamID, state.nextRemoteStreamID = 0, 1
+	}
+}
+
+// queueStreamChunks adds the chunks of a stream to the outbox.
+func (state *SessionState) queueStreamChunks(chunks []outboxMessage) {
+	state.sendLock.Lock()
+	defer state.sendLock.Unlock()
+
+	state.enqueue(chunks...)
+}
+
+// streamInFlight returns the number of chunks of the stream awaiting an ack.
+// It must be called with the send lock held.
+func (state *SessionState) streamInFlight(streamID uint32) int {
+	count := 0
+	for _, awaiting := range state.sender.awaitingACKs {
+		if awaiting.message.stream != nil && awaiting.message.stream.ID == streamID {
+			count++
+		}
+	}
+	return count
+}
+
+func (state *SessionState) removeStream(streamID uint32) {
+	state.streamLock.Lock()
+	defer state.streamLock.Unlock()
+
+	delete(state.streams, streamID)
+}
+
+// closeStreams fails all streams of the session, such that further reads and writes return the error.
+func (state *SessionState) closeStreams(err error) {
+	state.streamLock.Lock()
+	streams := state.streams
+	state.streams = map[uint32]*Stream{}
+	state.streamLock.Unlock()
+
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+}
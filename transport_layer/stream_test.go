@@ -0,0 +1,265 @@
+package transport_layer_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/starling-protocol/starling/device"
+	"github.com/starling-protocol/starling/transport_layer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAll(t *testing.T, stream device.Stream, length int) []byte {
+	buf := make([]byte, length)
+	for n := 0; n < length; {
+		read, err := stream.TryRead(buf[n:])
+		if !assert.NoError(t, err) {
+			break
+		}
+		n += read
+	}
+	return buf
+}
+
+// A lost packet on one stream does not hold back the other streams of the session
+func TestStreamsOrderedIndependently(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupConnection(t, addressA, addressB)
+
+	fileStream, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+	chatStream, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+
+	_, err = fileStream.TryWrite([]byte("file data"))
+	assert.NoError(t, err)
+	_, err = chatStream.TryWrite([]byte("hello"))
+	assert.NoError(t, err)
+
+	packets := popAllPackets(nodeA)
+	assert.Len(t, packets, 2)
+
+	// The file chunk is lost
+	receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, packets[1])
+	assert.Empty(t, receivedMessages)
+	assert.Len(t, nodeB.dev.StreamsOpened, 1)
+	assert.Equal(t, []byte("hello"), readAll(t, nodeB.dev.StreamsOpened[0], 5))
+
+	// The ACK reports the lost file chunk, which is retransmitted
+	nodeB.dev.ExecuteNextDelayAction()
+	nodeA.transportLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, nodeB.dev.StreamsOpened, 2)
+	receivedFile := nodeB.dev.StreamsOpened[1]
+	assert.Equal(t, []byte("file data"), readAll(t, receivedFile, 9))
+
+	assert.NoError(t, fileStream.Close())
+	nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+
+	n, err := receivedFile.TryRead(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = fileStream.TryWrite([]byte("more"))
+	assert.Error(t, err)
+}
+
+// A stream with a full window does not block messages or other streams
+func TestStreamWindow(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.MaxFragmentSize = 4
+	options.StreamWindow = 2
+	nodeA, nodeB := setupConnectionWithOptions(t, addressA, addressB, options)
+
+	stream, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+
+	_, err = stream.TryWrite([]byte("abcdefghijkl"))
+	assert.NoError(t, err)
+	_, err = nodeA.transportLayer.SendMessage(nodeA.session, []byte("msg"))
+	assert.NoError(t, err)
+
+	packets := popAllPackets(nodeA)
+	assert.Len(t, packets, 3)
+
+	receivedMessages := [][]byte{}
+	for _, packet := range packets {
+		for _, message := range nodeB.transportLayer.ReceivePacket(addressA, packet) {
+			receivedMessages = append(receivedMessages, message.Data)
+		}
+	}
+	assert.Equal(t, [][]byte{[]byte("msg")}, receivedMessages)
+
+	// The acknowledgement opens the stream window for the last chunk
+	nodeB.dev.ExecuteNextDelayAction()
+	nodeA.transportLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+
+	assert.Len(t, nodeB.dev.StreamsOpened, 1)
+	assert.Equal(t, []byte("abcdefghijkl"), readAll(t, nodeB.dev.StreamsOpened[0], 12))
+}
+
+func TestStreamSessionBroken(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, _ := setupConnection(t, addressA, addressB)
+
+	stream, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+
+	nodeA.transportLayer.TimeoutSession(nodeA.session)
+
+	_, err = stream.TryRead(make([]byte, 1))
+	assert.Error(t, err)
+	_, err = stream.TryWrite([]byte("data"))
+	assert.Error(t, err)
+}
+
+func deliverAll(from *TestNode, to *TestNode) {
+	for _, packet := range popAllPackets(from) {
+		to.transportLayer.ReceivePacket(from.address, packet)
+	}
+}
+
+// The writer does not get further ahead than the receive window announced by the reader
+func TestStreamReceiveWindow(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.MaxFragmentSize = 1
+	options.StreamWindow = 0
+	options.StreamReceiveWindow = 8
+	nodeA, nodeB := setupConnectionWithOptions(t, addressA, addressB, options)
+
+	stream, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+
+	// Before the window has been announced, only the initial window can be written, keeping the last chunk for the fin
+	data := []byte("abcdefghijklmnopqrst")
+	n, err := stream.TryWrite(data)
+	assert.ErrorIs(t, err, transport_layer.ErrStreamFull)
+	assert.Equal(t, 3, n)
+	written := n
+
+	// The reader announces its window as soon as it learns about the stream
+	deliverAll(nodeA, nodeB)
+	assert.Len(t, nodeB.dev.StreamsOpened, 1)
+	received := nodeB.dev.StreamsOpened[0]
+	deliverAll(nodeB, nodeA)
+	assert.Contains(t, nodeA.dev.StreamsReady, stream)
+
+	n, err = stream.TryWrite(data[written:])
+	assert.ErrorIs(t, err, transport_layer.ErrStreamFull)
+	assert.Equal(t, 4, n)
+	written += n
+
+	n, err = stream.TryWrite(data[written:])
+	assert.ErrorIs(t, err, transport_layer.ErrStreamFull)
+	assert.Equal(t, 0, n)
+
+	// Reading frees up the window, which is announced to the writer
+	deliverAll(nodeA, nodeB)
+	assert.Equal(t, data[:written], readAll(t, received, written))
+	_, err = received.TryRead(make([]byte, 1))
+	assert.ErrorIs(t, err, transport_layer.ErrStreamEmpty)
+
+	nodeA.dev.StreamsReady = nil
+	deliverAll(nodeB, nodeA)
+	assert.Contains(t, nodeA.dev.StreamsReady, stream)
+
+	n, err = stream.TryWrite(data[written:])
+	assert.ErrorIs(t, err, transport_layer.ErrStreamFull)
+	assert.Equal(t, 7, n)
+	written += n
+
+	deliverAll(nodeA, nodeB)
+	assert.Equal(t, data[7:written], readAll(t, received, written-7))
+}
+
+// Streams opened by both sides at the same time get different IDs, and IDs are not reused
+func TestStreamIDs(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupConnection(t, addressA, addressB)
+
+	streamA, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+	streamB, err := nodeB.transportLayer.OpenStream(nodeB.session)
+	assert.NoError(t, err)
+
+	// The initiator of the session uses even IDs, and the responder odd IDs
+	assert.Zero(t, streamA.ID()%2)
+	assert.Equal(t, uint32(1), streamB.ID()%2)
+
+	_, err = streamA.TryWrite([]byte("from A"))
+	assert.NoError(t, err)
+	_, err = streamB.TryWrite([]byte("from B"))
+	assert.NoError(t, err)
+	deliverAll(nodeA, nodeB)
+	deliverAll(nodeB, nodeA)
+
+	assert.Len(t, nodeA.dev.StreamsOpened, 1)
+	assert.Len(t, nodeB.dev.StreamsOpened, 1)
+	assert.Equal(t, []byte("from B"), readAll(t, nodeA.dev.StreamsOpened[0], 6))
+	assert.Equal(t, []byte("from A"), readAll(t, nodeB.dev.StreamsOpened[0], 6))
+
+	// Once the stream is closed on both sides, a new stream gets a new ID
+	assert.NoError(t, streamA.Close())
+	assert.NoError(t, nodeB.dev.StreamsOpened[0].Close())
+	deliverAll(nodeA, nodeB)
+	deliverAll(nodeB, nodeA)
+
+	next, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+	assert.Equal(t, streamA.ID()+2, next.ID())
+	_, err = next.TryWrite([]byte("again"))
+	assert.NoError(t, err)
+	deliverAll(nodeA, nodeB)
+	assert.Len(t, nodeB.dev.StreamsOpened, 2)
+	assert.Equal(t, []byte("again"), readAll(t, nodeB.dev.StreamsOpened[1], 5))
+}
+
+// Streams opened by the peer beyond MaxConcurrentStreams are reset
+func TestStreamLimit(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.MaxConcurrentStreams = 2
+	peerOptions := device.DefaultProtocolOptions()
+	peerOptions.MaxConcurrentStreams = 1
+	nodeA, nodeB := setupConnectionWithPeerOptions(t, addressA, addressB, options, peerOptions)
+
+	first, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+	second, err := nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+	_, err = nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.Error(t, err)
+
+	// The first stream has not been written to yet, but B counts it as open
+	_, err = second.TryWrite([]byte("second"))
+	assert.NoError(t, err)
+	deliverAll(nodeA, nodeB)
+	assert.Empty(t, nodeB.dev.StreamsOpened)
+
+	deliverAll(nodeB, nodeA)
+	assert.Contains(t, nodeA.dev.StreamsReady, second)
+	_, err = second.TryRead(make([]byte, 1))
+	assert.ErrorIs(t, err, transport_layer.ErrStreamReset)
+	_, err = second.TryWrite([]byte("more"))
+	assert.ErrorIs(t, err, transport_layer.ErrStreamReset)
+
+	_, err = first.TryWrite([]byte("first"))
+	assert.NoError(t, err)
+	deliverAll(nodeA, nodeB)
+	assert.Len(t, nodeB.dev.StreamsOpened, 1)
+	assert.Equal(t, []byte("first"), readAll(t, nodeB.dev.StreamsOpened[0], 5))
+
+	// The reset stream no longer counts towards the limit of A
+	_, err = nodeA.transportLayer.OpenStream(nodeA.session)
+	assert.NoError(t, err)
+}
@@ -14,7 +14,6 @@ type TransportLayer struct {
 	events        TransportEvents
 	options       device.ProtocolOptions
 	networkLayer  *network_layer.NetworkLayer
-	outbox        []outboxMessage
 	sessionStates map[device.SessionID]*SessionState
 }
 
@@ -23,6 +22,10 @@ type TransportEvents interface {
 	SessionBroken(session device.SessionID)
 	ReplyPayload(session device.SessionID, contact device.ContactID) []byte
 	MessageDelivered(messageID device.MessageID)
+	MessageProgress(messageID device.MessageID, sent int, total int)
+	MessageFailed(messageID device.MessageID)
+	StreamOpened(session device.SessionID, stream *Stream)
+	StreamReady(session device.SessionID, stream *Stream)
 }
 
 //TODO: Discuss. How can a node which is currently in communication with a contact distinguish packets sent by the contact from its own packets?
@@ -34,7 +37,6 @@ func NewTransportLayer(dev device.Device, events TransportEvents, options device
 		events:        events,
 		options:       options,
 		networkLayer:  nil,
-		outbox:        []outboxMessage{},
 		sessionStates: map[device.SessionID]*SessionState{},
 	}
 
@@ -79,6 +81,16 @@ func (transport *TransportLayer) AllSessions(contact device.ContactID) []device.
 	return transport.networkLayer.AllSessions(contact)
 }
 
+// AddPolicy adds a policy for the packets relayed by the network layer.
+func (transport *TransportLayer) AddPolicy(policy network_layer.Policy) {
+	transport.networkLayer.AddPolicy(policy)
+}
+
+// RemovePolicy removes a policy which was added before.
+func (transport *TransportLayer) RemovePolicy(policy network_layer.Policy) {
+	transport.networkLayer.RemovePolicy(policy)
+}
+
 // func (transport *TransportLayer) ContactSecret(contact device.ContactID) (device.SharedSecret, bool) {
 // 	return transport.networkLayer.ContactSecret(contact)
 // }
@@ -89,6 +101,7 @@ func (transport *TransportLayer) handleDisconnect(address device.DeviceAddress)
 
 		if !found {
 			transport.logf("handle_disconnect:clear_state:%d:%s:session_not_found", sessID, address)
+			transport.sessionStates[sessID].closeStreams(errSessionBroken)
 			delete(transport.sessionStates, sessID)
 			continue
 		}
@@ -96,6 +109,7 @@ func (transport *TransportLayer) handleDisconnect(address device.DeviceAddress)
 		if (session.SourceNeighbour != nil && *session.SourceNeighbour == address) ||
 			(session.TargetNeighbour != nil && *session.TargetNeighbour == address) {
 			transport.logf("handle_disconnect:clear_state:%d:%s", sessID, address)
+			transport.sessionStates[sessID].closeStreams(errSessionBroken)
 			delete(transport.sessionStates, sessID)
 			continue
 		}
@@ -129,6 +143,10 @@ func (transport *TransportLayer) handlePacket(sessionID device.SessionID, data [
 		return nil
 	}
 
+	state := transport.SessionState(sessionID)
+	state.markActivity()
+	state.countReceived(len(data))
+
 	switch packet.PacketType() {
 	case DATA:
 		dataPacket := packet.(*DATAPacket)
@@ -137,6 +155,20 @@ func (transport *TransportLayer) handlePacket(sessionID device.SessionID, data [
 		ACKPacket := packet.(*ACKPacket)
 		transport.handleACKPacket(sessionID, ACKPacket)
 		return nil
+	case SACK:
+		SACKPacket := packet.(*SACKPacket)
+		transport.handleACKPacket(sessionID, SACKPacket)
+		return nil
+	case DATAGRAM:
+		datagramPacket := packet.(*DATAGRAMPacket)
+		return transport.handleDatagramPacket(sessionID, datagramPacket)
+	case SKIP:
+		skipPacket := packet.(*SKIPPacket)
+		return transport.handleSkipPacket(sessionID, skipPacket)
+	case HEARTBEAT:
+		heartbeatPacket := packet.(*HEARTBEATPacket)
+		transport.handleHeartbeatPacket(sessionID, heartbeatPacket)
+		return nil
 	default:
 		transport.logf("packet:handle:error 'unknown transport packet type %v'", packet.PacketType())
 		return nil
@@ -154,17 +186,40 @@ func (transport *TransportLayer) logf(msg string, args ...any) {
 type outboxMessage struct {
 	session   device.SessionID
 	messageID device.MessageID
+	priority  device.MessagePriority
+	fragment  *Fragment
+	stream    *StreamFrame
+	window    *StreamWindowUpdate
 	body      []byte
 }
 
-func newOutboxMessage(session device.SessionID, messageID device.MessageID, body []byte) outboxMessage {
+func newOutboxMessage(session device.SessionID, messageID device.MessageID, priority device.MessagePriority, fragment *Fragment, body []byte) outboxMessage {
 	return outboxMessage{
 		session:   session,
 		messageID: messageID,
+		priority:  priority,
+		fragment:  fragment,
 		body:      body,
 	}
 }
 
+// packet builds the DATA packet carrying the message with the given sequence ID.
+func (msg outboxMessage) packet(seqID SequenceID) *DATAPacket {
+	if msg.fragment != nil {
+		return NewFragmentDATAPacket(seqID, *msg.fragment, msg.body)
+	}
+	packet := NewDATAPacket(seqID, msg.body)
+	if msg.stream != nil {
+		stream := *msg.stream
+		packet.Stream = &stream
+	}
+	if msg.window != nil {
+		window := *msg.window
+		packet.Window = &window
+	}
+	return packet
+}
+
 // Creates a new message and registers it for delivery, the caller is responsible for sending it.
 func (transport *TransportLayer) newMessage(sessionID device.SessionID, message []byte) (*DATAPacket, device.MessageID, error) {
 	session, found := transport.networkLayer.GetSession(sessionID)
@@ -173,28 +228,125 @@ func (transport *TransportLayer) newMessage(sessionID device.SessionID, message
 	}
 
 	messageID := device.MessageID(transport.dev.Rand().Uint64())
-	msg := newOutboxMessage(session.SessionID, messageID, message)
+	msg := newOutboxMessage(session.SessionID, messageID, device.PriorityNormal, nil, message)
 
 	state := transport.SessionState(session.SessionID)
 
 	nextSeqID := state.DeliverMessage(transport, msg)
-	dataPacket := NewDATAPacket(nextSeqID, msg.body)
-	return dataPacket, messageID, nil
+	return msg.packet(nextSeqID), messageID, nil
 }
 
+// SendMessage queues a message for reliable delivery on the session using the default send options.
 func (transport *TransportLayer) SendMessage(sessionID device.SessionID, message []byte) (device.MessageID, error) {
-	dataPacket, messageID, err := transport.newMessage(sessionID, message)
-	if err != nil {
+	return transport.SendMessageWithOptions(sessionID, message, nil)
+}
+
+// SendMessageWithOptions queues a message for delivery on the session.
+// Messages larger than MaxFragmentSize are split into fragments which are acknowledged independently.
+func (transport *TransportLayer) SendMessageWithOptions(sessionID device.SessionID, message []byte, options *device.SendOptions) (device.MessageID, error) {
+	if options == nil {
+		options = device.DefaultSendOptions()
+	}
+
+	if options.Unreliable {
+		return transport.SendDatagram(sessionID, message)
+	}
+
+	session, found := transport.networkLayer.GetSession(sessionID)
+	if !found {
+		return 0, errors.New("session not found")
+	}
+
+	if !options.Expiry.IsZero() && !transport.dev.Now().Before(options.Expiry) {
+		return 0, errors.New("message expired before it was sent")
+	}
+
+	messageID := device.MessageID(transport.dev.Rand().Uint64())
+	state := transport.SessionState(session.SessionID)
+
+	if err := state.QueueMessage(transport, messageID, message, options.Priority); err != nil {
 		return 0, err
 	}
 
-	if err := transport.networkLayer.SendData(sessionID, dataPacket.EncodePacket()); err != nil {
+	if !options.Expiry.IsZero() {
+		transport.dev.Delay(func() {
+			transport.expireMessage(session.SessionID, messageID)
+		}, options.Expiry.Sub(transport.dev.Now()))
+	}
+
+	if err := transport.sendOutbox(state); err != nil {
 		return 0, err
 	}
 
 	return messageID, nil
 }
 
+// CancelMessage stops the delivery of a message which has not been acknowledged yet.
+// The receiver is told to skip the parts of the message it has not received.
+func (transport *TransportLayer) CancelMessage(messageID device.MessageID) error {
+	for _, state := range transport.sessionStates {
+		if transport.dropMessage(state, messageID) {
+			transport.logf("message:cancelled:%d:%d", state.sessionID, messageID)
+			return nil
+		}
+	}
+
+	return errors.New("message not found")
+}
+
+// expireMessage stops the delivery of a message that has not been acknowledged before its expiry.
+func (transport *TransportLayer) expireMessage(sessionID device.SessionID, messageID device.MessageID) {
+	state, found := transport.sessionStates[sessionID]
+	if !found {
+		return
+	}
+
+	if !transport.dropMessage(state, messageID) {
+		return
+	}
+
+	transport.logf("message:expired:%d:%d", sessionID, messageID)
+	transport.events.MessageFailed(messageID)
+}
+
+// dropMessage removes a message from the outbox and from the packets awaiting an ack.
+// The receiver is told to skip the sequence IDs which were already assigned to the message.
+// It returns false if the message was not pending on the session.
+func (transport *TransportLayer) dropMessage(state *SessionState, messageID device.MessageID) bool {
+	found, skipped := state.DropMessage(transport, messageID)
+	if !found {
+		return false
+	}
+
+	if len(skipped) > 0 {
+		skipPacket := NewSKIPPacket(skipped)
+		if err := transport.sendPacket(state.sessionID, skipPacket); err != nil {
+			transport.logf("message:drop:send_skip:error:%d '%v'", state.sessionID, err)
+		}
+	}
+
+	if err := transport.sendOutbox(state); err != nil {
+		transport.logf("message:drop:send_outbox:error:%d '%v'", state.sessionID, err)
+	}
+
+	return true
+}
+
+// sendOutbox sends the queued messages of the session that fit within the send window.
+func (transport *TransportLayer) sendOutbox(state *SessionState) error {
+	packets := state.NextOutboxPackets(transport)
+	if len(packets) > 0 {
+		packets[0].ACK = state.piggybackACK()
+	}
+
+	for _, packet := range packets {
+		if err := transport.sendPacket(state.sessionID, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // func (transport *TransportLayer) NewContact(sharedSecret device.SharedSecret) (device.ContactID, error) {
 // 	return transport.networkLayer.NewContact(sharedSecret)
 // }
@@ -2,8 +2,11 @@ package transport_layer_test
 
 import (
 	"bytes"
+	"fmt"
+	"math"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/starling-protocol/starling/device"
 	"github.com/starling-protocol/starling/testutils"
@@ -31,19 +34,29 @@ func NewTestNode(address device.DeviceAddress, transportLayer *transport_layer.T
 }
 
 func setupConnection(t *testing.T, addressA device.DeviceAddress, addressB device.DeviceAddress) (*TestNode, *TestNode) {
+	return setupConnectionWithOptions(t, addressA, addressB, device.DefaultProtocolOptions())
+}
+
+func setupConnectionWithOptions(t *testing.T, addressA device.DeviceAddress, addressB device.DeviceAddress, protoOptions *device.ProtocolOptions) (*TestNode, *TestNode) {
+	return setupConnectionWithPeerOptions(t, addressA, addressB, protoOptions, protoOptions)
+}
+
+// setupConnectionWithPeerOptions sets up a session between A and B, which use different options.
+// The options must have the same HeartbeatInterval.
+func setupConnectionWithPeerOptions(t *testing.T, addressA device.DeviceAddress, addressB device.DeviceAddress, protoOptions *device.ProtocolOptions, peerOptions *device.ProtocolOptions) (*TestNode, *TestNode) {
 	seed := rand.NewSource(rand.Int63())
 	random := rand.New(seed)
 	t.Logf("Testing with seed: %d", seed.Int63())
 	sharedSecret := bytes.Repeat([]byte{0x01}, 32)
-	protoOptions := device.DefaultProtocolOptions()
 	protoOptions.DisableAutoRREQOnConnection = true
+	peerOptions.DisableAutoRREQOnConnection = true
 
 	devA := testutils.NewDeviceMock(t, random)
 	transportLayerA := transport_layer.NewTransportLayer(devA, transportEvents{devA}, *protoOptions)
 	contactA := devA.Contacts.DebugLink(sharedSecret)
 
 	devB := testutils.NewDeviceMock(t, random)
-	transportLayerB := transport_layer.NewTransportLayer(devB, transportEvents{devB}, *protoOptions)
+	transportLayerB := transport_layer.NewTransportLayer(devB, transportEvents{devB}, *peerOptions)
 	contactB := devB.Contacts.DebugLink(sharedSecret)
 
 	assert.Equal(t, contactA, contactB)
@@ -64,11 +77,21 @@ func setupConnection(t *testing.T, addressA device.DeviceAddress, addressB devic
 	// ACK for RREP
 	transportLayerB.ReceivePacket(addressA, devA.PopLastPacket())
 
+	// Only the heartbeat timers remain scheduled
+	remainingTimers := 0
+	if protoOptions.HeartbeatInterval > 0 {
+		remainingTimers = 1
+
+		// The heartbeat timer of B was scheduled before the ACK timeout
+		heartbeat := devB.DelayActions[0]
+		devB.DelayActions = append(devB.DelayActions[1:], heartbeat)
+	}
+
 	// Delay for ACK timeout
 	devB.ExecuteNextDelayAction()
 
-	assert.Empty(t, devA.DelayActions)
-	assert.Empty(t, devB.DelayActions)
+	assert.Len(t, devA.DelayActions, remainingTimers)
+	assert.Len(t, devB.DelayActions, remainingTimers)
 
 	nodeA := NewTestNode(addressA, transportLayerA, devA, contactA, devA.Sessions[0])
 	nodeB := NewTestNode(addressB, transportLayerB, devB, contactB, devA.Sessions[0])
@@ -265,6 +288,388 @@ func TestMultiDataAndAckPacketDrop(t *testing.T) {
 	assert.Equal(t, receivedMessages[3].Data, []byte("Message 6"))
 }
 
+// The sequence IDs wrap around while a packet is dropped
+func TestSequenceIDWraparound(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupConnection(t, addressA, addressB)
+
+	nodeA.transportLayer.SessionState(nodeA.session).DebugSetSequenceIDs(math.MaxUint32-1, 0)
+	nodeB.transportLayer.SessionState(nodeB.session).DebugSetSequenceIDs(1, math.MaxUint32-2)
+
+	// Sequence IDs MaxUint32-1 and MaxUint32 are delivered
+	receivedMessages := sendAndReceiveMessage(t, "Message 1", nodeA, nodeB)
+	assert.Len(t, receivedMessages, 1)
+	receivedMessages = sendAndReceiveMessage(t, "Message 2", nodeA, nodeB)
+	assert.Len(t, receivedMessages, 1)
+
+	// Sequence ID 0 is dropped
+	nodeA.transportLayer.SendMessage(nodeA.session, []byte("Message 3"))
+	nodeA.dev.PopLastPacket()
+
+	// Sequence IDs 1 and 2 wait for the dropped packet
+	receivedMessages = sendAndReceiveMessage(t, "Message 4", nodeA, nodeB)
+	assert.Empty(t, receivedMessages)
+	receivedMessages = sendAndReceiveMessage(t, "Message 5", nodeA, nodeB)
+	assert.Empty(t, receivedMessages)
+
+	// B acknowledges, and A resends the missing packet
+	ackMessage(t, nodeA, nodeB)
+	assert.Len(t, nodeA.dev.PacketsReceived, 4)
+
+	receivedMessages = nodeB.transportLayer.ReceivePacket(nodeA.address, nodeA.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 3)
+	assert.Equal(t, []byte("Message 3"), receivedMessages[0].Data)
+	assert.Equal(t, []byte("Message 4"), receivedMessages[1].Data)
+	assert.Equal(t, []byte("Message 5"), receivedMessages[2].Data)
+
+	// All messages are acknowledged
+	ackMessage(t, nodeA, nodeB)
+	assert.Len(t, nodeA.dev.PacketsReceived, 5)
+}
+
+// A large message is split into fragments, where one is dropped and retransmitted
+func TestFragmentedMessage(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.MaxFragmentSize = 10
+	nodeA, nodeB := setupConnectionWithOptions(t, addressA, addressB, options)
+
+	message := []byte("This message is split into five fragments")
+	messageID, err := nodeA.transportLayer.SendMessage(nodeA.session, message)
+	assert.NoError(t, err)
+
+	fragments := popAllPackets(nodeA)
+	assert.Len(t, fragments, 5)
+
+	// The third fragment is dropped
+	for i, fragment := range fragments {
+		if i == 2 {
+			continue
+		}
+		receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, fragment)
+		assert.Empty(t, receivedMessages)
+	}
+
+	// B acknowledges, and A reports the progress of the acknowledged fragments
+	nodeB.dev.ExecuteNextDelayAction()
+	nodeA.transportLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	assert.Equal(t, []int{10, 20, 30, 31}, nodeA.dev.ProgressReports[messageID])
+	assert.Empty(t, nodeA.dev.PacketsReceived)
+
+	// A resends the missing fragment which completes the message
+	receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 1)
+	assert.Equal(t, message, receivedMessages[0].Data)
+
+	ackMessage(t, nodeA, nodeB)
+	assert.Equal(t, []int{10, 20, 30, 31, 41}, nodeA.dev.ProgressReports[messageID])
+	assert.Equal(t, []device.MessageID{messageID}, nodeA.dev.PacketsReceived)
+}
+
+// Messages exceeding the send window are queued until earlier messages are acknowledged
+func TestSendWindow(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.SendWindow = 2
+	nodeA, nodeB := setupConnectionWithOptions(t, addressA, addressB, options)
+
+	for _, message := range []string{"Message 1", "Message 2", "Message 3"} {
+		_, err := nodeA.transportLayer.SendMessage(nodeA.session, []byte(message))
+		assert.NoError(t, err)
+	}
+
+	packets := popAllPackets(nodeA)
+	assert.Len(t, packets, 2)
+	for _, packet := range packets {
+		nodeB.transportLayer.ReceivePacket(addressA, packet)
+	}
+
+	// The acknowledgement opens the window for the third message
+	ackMessage(t, nodeA, nodeB)
+	receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 1)
+	assert.Equal(t, []byte("Message 3"), receivedMessages[0].Data)
+}
+
+// The sender does not get further ahead of a lost packet than the receiver keeps track of,
+// so all messages are delivered once the lost packet has been retransmitted.
+func TestSendWindowBoundedByMissingSeqs(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.SendWindow = 0
+	nodeA, nodeB := setupConnectionWithOptions(t, addressA, addressB, options)
+
+	const messageCount = 1100
+	for i := range messageCount {
+		_, err := nodeA.transportLayer.SendMessage(nodeA.session, []byte(fmt.Sprintf("Message %d", i)))
+		assert.NoError(t, err)
+	}
+
+	packets := popAllPackets(nodeA)
+	assert.Len(t, packets, 1024)
+
+	// The first packet is lost
+	received := []transport_layer.TransportMessage{}
+	for _, packet := range packets[1:] {
+		received = append(received, nodeB.transportLayer.ReceivePacket(addressA, packet)...)
+	}
+	assert.Empty(t, received)
+
+	// The acknowledgement reports the lost packet, which is retransmitted and fills the gap
+	ackMessage(t, nodeA, nodeB)
+	for _, packet := range popAllPackets(nodeA) {
+		received = append(received, nodeB.transportLayer.ReceivePacket(addressA, packet)...)
+	}
+	assert.Len(t, received, 1024)
+
+	// The next acknowledgement opens the window for the remaining messages
+	ackMessage(t, nodeA, nodeB)
+	for _, packet := range popAllPackets(nodeA) {
+		received = append(received, nodeB.transportLayer.ReceivePacket(addressA, packet)...)
+	}
+
+	assert.Len(t, received, messageCount)
+	for i, message := range received {
+		assert.Equal(t, []byte(fmt.Sprintf("Message %d", i)), message.Data)
+	}
+}
+
+// Datagrams are delivered immediately, even when earlier DATA packets are missing,
+// and they are neither acknowledged nor counted towards the session timeout.
+func TestDatagram(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.MaxFragmentSize = 1024
+	nodeA, nodeB := setupConnectionWithOptions(t, addressA, addressB, options)
+
+	// A reliable message is dropped
+	nodeA.transportLayer.SendMessage(nodeA.session, []byte("Message 1"))
+	nodeA.dev.PopLastPacket()
+	assert.Len(t, nodeA.dev.DelayActions, 1)
+
+	_, err := nodeA.transportLayer.SendDatagram(nodeA.session, []byte("Datagram"))
+	assert.NoError(t, err)
+	assert.Len(t, nodeA.dev.DelayActions, 1)
+
+	receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 1)
+	assert.Equal(t, []byte("Datagram"), receivedMessages[0].Data)
+	assert.Empty(t, nodeB.dev.DelayActions)
+
+	// Datagrams larger than a fragment are refused
+	_, err = nodeA.transportLayer.SendDatagram(nodeA.session, make([]byte, options.MaxFragmentSize+1))
+	assert.Error(t, err)
+}
+
+func TestMessagePriority(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.SendWindow = 1
+	nodeA, nodeB := setupConnectionWithOptions(t, addressA, addressB, options)
+
+	messages := []struct {
+		body     string
+		priority device.MessagePriority
+	}{
+		{"Low", device.PriorityLow},
+		{"Normal", device.PriorityNormal},
+		{"High", device.PriorityHigh},
+	}
+	for _, message := range messages {
+		sendOptions := device.DefaultSendOptions()
+		sendOptions.Priority = message.priority
+		_, err := nodeA.transportLayer.SendMessageWithOptions(nodeA.session, []byte(message.body), sendOptions)
+		assert.NoError(t, err)
+	}
+
+	// The first message was sent before the others were queued
+	receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 1)
+	assert.Equal(t, []byte("Low"), receivedMessages[0].Data)
+
+	for _, expected := range []string{"High", "Normal"} {
+		ackMessage(t, nodeA, nodeB)
+		receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+		assert.Len(t, receivedMessages, 1)
+		assert.Equal(t, []byte(expected), receivedMessages[0].Data)
+	}
+}
+
+func TestMessageExpiry(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupConnection(t, addressA, addressB)
+
+	sendOptions := device.DefaultSendOptions()
+	sendOptions.Expiry = nodeA.dev.Now().Add(time.Minute)
+	expiringID, err := nodeA.transportLayer.SendMessageWithOptions(nodeA.session, []byte("Expiring"), sendOptions)
+	assert.NoError(t, err)
+	_, err = nodeA.transportLayer.SendMessage(nodeA.session, []byte("Message 2"))
+	assert.NoError(t, err)
+
+	packets := popAllPackets(nodeA)
+	assert.Len(t, packets, 2)
+
+	// The expiring message is lost, so the second message is held back
+	receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, packets[1])
+	assert.Empty(t, receivedMessages)
+
+	// The expiry is the first delay action scheduled by the sender
+	nodeA.dev.ExecuteNextDelayAction()
+	assert.Equal(t, []device.MessageID{expiringID}, nodeA.dev.MessagesFailed)
+
+	// The receiver skips the sequence ID of the expired message
+	receivedMessages = nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 1)
+	assert.Equal(t, []byte("Message 2"), receivedMessages[0].Data)
+
+	// A late retransmission of the expired message is not delivered
+	receivedMessages = nodeB.transportLayer.ReceivePacket(addressA, packets[0])
+	assert.Empty(t, receivedMessages)
+
+	_, err = nodeA.transportLayer.SendMessageWithOptions(nodeA.session, []byte("Expired"), &device.SendOptions{Expiry: nodeA.dev.Now().Add(-time.Second)})
+	assert.Error(t, err)
+}
+
+func TestCancelMessage(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupConnection(t, addressA, addressB)
+
+	cancelledID, err := nodeA.transportLayer.SendMessage(nodeA.session, []byte("Cancelled"))
+	assert.NoError(t, err)
+	_, err = nodeA.transportLayer.SendMessage(nodeA.session, []byte("Message 2"))
+	assert.NoError(t, err)
+
+	packets := popAllPackets(nodeA)
+	assert.Len(t, packets, 2)
+
+	receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, packets[1])
+	assert.Empty(t, receivedMessages)
+
+	assert.NoError(t, nodeA.transportLayer.CancelMessage(cancelledID))
+	assert.Empty(t, nodeA.dev.MessagesFailed)
+
+	receivedMessages = nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 1)
+	assert.Equal(t, []byte("Message 2"), receivedMessages[0].Data)
+
+	// The message is no longer pending
+	assert.Error(t, nodeA.transportLayer.CancelMessage(cancelledID))
+}
+
+func TestPiggybackedACK(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupConnection(t, addressA, addressB)
+
+	messageID, err := nodeA.transportLayer.SendMessage(nodeA.session, []byte("Message A"))
+	assert.NoError(t, err)
+	receivedMessages := nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 1)
+
+	// The reply carries the acknowledgement of the first message
+	_, err = nodeB.transportLayer.SendMessage(nodeB.session, []byte("Message B"))
+	assert.NoError(t, err)
+	receivedMessages = nodeA.transportLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	assert.Len(t, receivedMessages, 1)
+	assert.Equal(t, []byte("Message B"), receivedMessages[0].Data)
+	assert.Equal(t, []device.MessageID{messageID}, nodeA.dev.PacketsReceived)
+
+	// The ack timer of B does not send a separate ACK
+	nodeB.dev.ExecuteNextDelayAction()
+	assert.Empty(t, nodeB.dev.PacketsSent)
+}
+
+func TestHeartbeat(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	options := device.DefaultProtocolOptions()
+	options.HeartbeatInterval = time.Second
+	options.MaxMissedHeartbeats = 2
+	nodeA, nodeB := setupConnectionWithOptions(t, addressA, addressB, options)
+
+	// The session was active during setup, so no heartbeat is needed yet
+	nodeA.dev.ExecuteNextDelayAction()
+	assert.Empty(t, nodeA.dev.PacketsSent)
+
+	// The idle session is probed and the peer answers
+	nodeA.dev.ExecuteNextDelayAction()
+	nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+	nodeA.transportLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+
+	nodeA.dev.ExecuteNextDelayAction()
+	assert.Empty(t, nodeA.dev.PacketsSent)
+
+	// The peer disappears and the heartbeats go unanswered
+	for i := 0; i < options.MaxMissedHeartbeats; i++ {
+		nodeA.dev.ExecuteNextDelayAction()
+		assert.NotEmpty(t, nodeA.dev.PopLastPacket())
+		assert.Equal(t, 0, nodeA.dev.SessionsBroken)
+	}
+
+	nodeA.dev.ExecuteNextDelayAction()
+	assert.Equal(t, 1, nodeA.dev.SessionsBroken)
+	assert.Empty(t, nodeA.dev.DelayActions)
+}
+
+func TestSessionMetrics(t *testing.T) {
+	addressA := device.DeviceAddress("1000")
+	addressB := device.DeviceAddress("2000")
+	nodeA, nodeB := setupConnection(t, addressA, addressB)
+
+	// The first message is dropped
+	nodeA.transportLayer.SendMessage(nodeA.session, []byte("Message 1"))
+	nodeA.dev.PopLastPacket()
+	nodeA.transportLayer.SendMessage(nodeA.session, []byte("Message 2"))
+	nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+
+	metrics, err := nodeA.transportLayer.SessionMetrics(nodeA.session)
+	assert.NoError(t, err)
+	assert.Equal(t, nodeA.session, metrics.Session)
+	assert.Equal(t, nodeA.contact, metrics.Contact)
+	assert.Equal(t, 2, metrics.UnackedMessages)
+	assert.Equal(t, 0, metrics.Retransmissions)
+	assert.Positive(t, metrics.BytesSent)
+
+	// B reports the first message missing, and A retransmits it
+	nodeB.dev.ExecuteNextDelayAction()
+	nodeA.transportLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+	nodeB.transportLayer.ReceivePacket(addressA, nodeA.dev.PopLastPacket())
+
+	metrics, err = nodeA.transportLayer.SessionMetrics(nodeA.session)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, metrics.UnackedMessages)
+	assert.Equal(t, 1, metrics.Retransmissions)
+	assert.Positive(t, metrics.RTT)
+	assert.Positive(t, metrics.BytesReceived)
+
+	// B acknowledges the retransmission
+	nodeB.dev.ExecuteNextDelayAction()
+	nodeA.transportLayer.ReceivePacket(addressB, nodeB.dev.PopLastPacket())
+
+	metrics, err = nodeA.transportLayer.SessionMetrics(nodeA.session)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, metrics.UnackedMessages)
+	assert.Zero(t, metrics.UnackedAge)
+
+	// The dropped message was sent by A but never received by B
+	metricsB, err := nodeB.transportLayer.SessionMetrics(nodeB.session)
+	assert.NoError(t, err)
+	assert.Less(t, metricsB.BytesReceived, metrics.BytesSent)
+
+	assert.Len(t, nodeA.transportLayer.AllSessionMetrics(), 1)
+
+	_, err = nodeA.transportLayer.SessionMetrics(device.SessionID(0))
+	assert.Error(t, err)
+}
+
 type transportEvents struct {
 	dev device.Device
 }
@@ -286,6 +691,29 @@ func (t transportEvents) MessageDelivered(messageID device.MessageID) {
 	t.dev.MessageDelivered(messageID)
 }
 
+func (t transportEvents) MessageProgress(messageID device.MessageID, sent int, total int) {
+	t.dev.MessageProgress(messageID, sent, total)
+}
+
+func (t transportEvents) StreamOpened(session device.SessionID, stream *transport_layer.Stream) {
+	t.dev.StreamOpened(session, stream)
+}
+
+func (t transportEvents) StreamReady(session device.SessionID, stream *transport_layer.Stream) {
+	t.dev.StreamReady(session, stream)
+}
+
+func (t transportEvents) MessageFailed(messageID device.MessageID) {
+	t.dev.MessageFailed(messageID)
+}
+
+// popAllPackets removes the packets sent by the node in the order they were sent
+func popAllPackets(node *TestNode) [][]byte {
+	packets := node.dev.PacketsSent
+	node.dev.PacketsSent = [][]byte{}
+	return packets
+}
+
 func sendAndReceiveMessage(t *testing.T, message string, nodeA *TestNode, nodeB *TestNode) []transport_layer.TransportMessage {
 	nodeA.transportLayer.SendMessage(nodeA.session, []byte(message))
 	assert.NotEmpty(t, nodeA.dev.PacketsSent)